@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit event names
+const (
+	AuditLoginSuccess = "login.success"
+	AuditLoginFailure = "login.failure"
+	AuditLoginLockout = "login.lockout"
+	AuditLogout       = "logout"
+	AuditFileSave     = "file.save"
+	AuditFileUpload   = "file.upload"
+	AuditFileCreate   = "file.create"
+	AuditFileDelete   = "file.delete"
+	AuditRunStart     = "run.start"
+	AuditRunExit      = "run.exit"
+	AuditShellOpen    = "shell.open"
+	AuditShellClose   = "shell.close"
+)
+
+// AuditEvent is one line of the audit log; fields that do not apply are left out
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	User       string    `json:"user,omitempty"`
+	ClientIP   string    `json:"clientIP,omitempty"`
+	Method     string    `json:"method,omitempty"` // how a login was authenticated
+	Path       string    `json:"path,omitempty"`
+	Args       []string  `json:"args,omitempty"`
+	IsDir      bool      `json:"isDir,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	RunID      string    `json:"runId,omitempty"`
+	ShellID    string    `json:"shellId,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	DurationMs int64     `json:"durationMs,omitempty"`
+	ExitCode   *int      `json:"exitCode,omitempty"`
+	Signal     string    `json:"signal,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// AuditLog appends events as JSON lines. When the file would grow past
+// maxSize it is renamed to path.1 (older files shift up to path.maxFiles)
+// and a new one is started. A nil *AuditLog records nothing.
+type AuditLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	mutex    sync.Mutex
+}
+
+func OpenAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	if maxFiles < 1 {
+		return nil, fmt.Errorf("at least one rotated audit log file must be kept")
+	}
+	al := &AuditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *AuditLog) open() error {
+	file, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("opening audit log: %v", err)
+	}
+	al.file = file
+	al.size = info.Size()
+	return nil
+}
+
+// The audit log at path followed by the rotated files rotate keeps of it
+func auditLogFiles(path string, maxFiles int) []string {
+	files := []string{path}
+	for i := 1; i <= maxFiles; i++ {
+		files = append(files, fmt.Sprintf("%s.%d", path, i))
+	}
+	return files
+}
+
+// Shift path.N up by one, move the current file to path.1 and start afresh; the caller holds the lock
+func (al *AuditLog) rotate() error {
+	al.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", al.path, al.maxFiles))
+	for i := al.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", al.path, i), fmt.Sprintf("%s.%d", al.path, i+1))
+	}
+	if err := os.Rename(al.path, al.path+".1"); err != nil && !os.IsNotExist(err) {
+		log.Printf("⚠️ Failed to rotate audit log: %v", err)
+	}
+	return al.open()
+}
+
+// Record appends an event, stamping it with the current time
+func (al *AuditLog) Record(event AuditEvent) {
+	if al == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("⚠️ Failed to encode audit event %s: %v", event.Event, err)
+		return
+	}
+	line = append(line, '\n')
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	if al.maxSize > 0 && al.size > 0 && al.size+int64(len(line)) > al.maxSize {
+		if err := al.rotate(); err != nil {
+			log.Printf("⚠️ Audit event %s lost: %v", event.Event, err)
+			return
+		}
+	}
+	n, err := al.file.Write(line)
+	al.size += int64(n)
+	if err != nil {
+		log.Printf("⚠️ Failed to write audit event %s: %v", event.Event, err)
+	}
+}
+
+// audit records an event on behalf of the user and client behind a request
+func (ts *TerminalServer) audit(r *http.Request, event AuditEvent) {
+	if ts.auditLog == nil {
+		return
+	}
+	if event.User == "" {
+		event.User = ts.clientIdentity(r)
+	}
+	event.ClientIP = ts.rateLimiter.getClientIP(r)
+	ts.auditLog.Record(event)
+}
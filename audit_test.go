@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The events in each file of an audit log, by suffix ("" for the log itself),
+// named by their Name field or, for lines that are not events, the line
+func readAuditLogs(t *testing.T, path string) map[string]string {
+	t.Helper()
+	matches, _ := filepath.Glob(path + "*")
+	files := map[string]string{}
+	for _, match := range matches {
+		content, err := os.ReadFile(match)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+			var event AuditEvent
+			if json.Unmarshal([]byte(line), &event) == nil {
+				line = event.Name
+			}
+			names = append(names, line)
+		}
+		files[strings.TrimPrefix(match, path)] = strings.Join(names, " ")
+	}
+	return files
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxSize  int64
+		maxFiles int
+		existing map[string]string // files there before the log is opened
+		events   []string
+		want     map[string]string
+	}{
+		{"never rotated", 0, 2, nil, []string{"a", "b", "c"},
+			map[string]string{"": "a b c"}},
+		{"under the size", 1 << 20, 2, nil, []string{"a", "b", "c"},
+			map[string]string{"": "a b c"}},
+		{"rotated on every event", 1, 2, nil, []string{"a", "b", "c", "d"},
+			map[string]string{"": "d", ".1": "c", ".2": "b"}},
+		{"one rotated file kept", 1, 1, nil, []string{"a", "b", "c"},
+			map[string]string{"": "c", ".1": "b"}},
+		{"appends to an existing log", 0, 2, map[string]string{"": "old\n"}, []string{"a"},
+			map[string]string{"": "old a"}},
+		{"rotates an existing log", 1, 2, map[string]string{"": "old\n", ".1": "older\n", ".2": "oldest\n"}, []string{"a"},
+			map[string]string{"": "a", ".1": "old", ".2": "older"}},
+		{"shifts past a missing file", 1, 3, map[string]string{"": "old\n", ".2": "older\n"}, []string{"a"},
+			map[string]string{"": "a", ".1": "old", ".3": "older"}},
+		{"leaves other files alone", 1, 1, map[string]string{".bak": "backup\n"}, []string{"a", "b"},
+			map[string]string{"": "b", ".1": "a", ".bak": "backup"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			for suffix, content := range test.existing {
+				os.WriteFile(path+suffix, []byte(content), 0600)
+			}
+			al, err := OpenAuditLog(path, test.maxSize, test.maxFiles)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range test.events {
+				al.Record(AuditEvent{Event: AuditRunStart, Name: name})
+			}
+			al.file.Close()
+
+			if got := readAuditLogs(t, path); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("files = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOpenAuditLogKeepsAFile(t *testing.T) {
+	if _, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"), 1, 0); err == nil {
+		t.Error("opened an audit log that keeps no rotated files")
+	}
+}
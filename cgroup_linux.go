@@ -0,0 +1,179 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Mount point of the unified (v2) cgroup hierarchy
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Controllers the per-run groups need
+var cgroupControllers = []string{"memory", "pids"}
+
+// setupCgroups prepares a cgroup v2 group for run and shell groups. "auto"
+// uses the server's own group, moving the server into a "server" child so
+// that its parent may hand out controllers; anything else names a group
+// delegated to the server.
+func setupCgroups(path string) (*CgroupManager, error) {
+	auto := path == "auto"
+	if auto {
+		own, err := ownCgroup()
+		if err != nil {
+			return nil, err
+		}
+		path = own
+	}
+	available, err := os.ReadFile(filepath.Join(path, "cgroup.controllers"))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a cgroup v2 group: %v", path, err)
+	}
+	for _, controller := range cgroupControllers {
+		if !slices.Contains(strings.Fields(string(available)), controller) {
+			return nil, fmt.Errorf("the %s controller is not available in %s", controller, path)
+		}
+	}
+
+	err = enableCgroupControllers(path)
+	if errors.Is(err, syscall.EBUSY) && auto {
+		// A group with processes in it cannot hand out controllers
+		server := filepath.Join(path, "server")
+		if err = os.Mkdir(server, 0755); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+		if err = os.WriteFile(filepath.Join(server, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			return nil, fmt.Errorf("moving the server into %s: %v", server, err)
+		}
+		err = enableCgroupControllers(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("enabling controllers in %s: %v", path, err)
+	}
+	return &CgroupManager{base: path, open: make(map[string]*os.File)}, nil
+}
+
+// The server's own group, from the "0::" line of /proc/self/cgroup
+func ownCgroup() (string, error) {
+	file, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return filepath.Join(cgroupRoot, path), nil
+		}
+	}
+	return "", fmt.Errorf("not in a cgroup v2 hierarchy")
+}
+
+func enableCgroupControllers(path string) error {
+	enable := "+" + strings.Join(cgroupControllers, " +")
+	return os.WriteFile(filepath.Join(path, "cgroup.subtree_control"), []byte(enable), 0644)
+}
+
+// Create makes the group for one run or shell and sets its limits
+func (cm *CgroupManager) Create(name string, limits ResourceLimits) (string, error) {
+	dir := filepath.Join(cm.base, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+	settings := map[string]string{}
+	if limits.Memory > 0 {
+		settings["memory.max"] = strconv.FormatInt(limits.Memory, 10)
+		settings["memory.swap.max"] = "0"
+	}
+	if limits.Procs > 0 {
+		settings["pids.max"] = strconv.Itoa(limits.Procs)
+	}
+	for file, value := range settings {
+		err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+		if err != nil && !(file == "memory.swap.max" && os.IsNotExist(err)) {
+			os.Remove(dir)
+			return "", fmt.Errorf("setting %s: %v", file, err)
+		}
+	}
+	return dir, nil
+}
+
+// startIn makes the command start in the group (CLONE_INTO_CGROUP, Linux
+// 5.7 and later), so nothing it does runs outside it, even in a sandbox
+// whose cgroup file system is read-only
+func (cm *CgroupManager) startIn(cmd *exec.Cmd, dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	cm.mutex.Lock()
+	cm.open[dir] = file
+	cm.mutex.Unlock()
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(file.Fd())
+	return nil
+}
+
+// Remove kills whatever is left in a group and deletes it
+func (cm *CgroupManager) Remove(dir string) {
+	if cm == nil || dir == "" {
+		return
+	}
+	cm.mutex.Lock()
+	if file := cm.open[dir]; file != nil {
+		file.Close()
+		delete(cm.open, dir)
+	}
+	cm.mutex.Unlock()
+	os.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0644)
+	for i := 0; i < 50; i++ {
+		if err := os.Remove(dir); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Count of an event in a cgroup events file such as memory.events
+func cgroupEvent(dir, file, event string) int {
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if name, value, ok := strings.Cut(line, " "); ok && name == event {
+			n, _ := strconv.Atoi(value)
+			return n
+		}
+	}
+	return 0
+}
+
+// cgroupLimitHit reports a limit the group ran into: the OOM killer, or a
+// fork refused because of the process limit
+func cgroupLimitHit(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	if cgroupEvent(dir, "memory.events", "oom_kill") > 0 {
+		return LimitMemory
+	}
+	if cgroupEvent(dir, "pids.events", "max") > 0 {
+		return LimitProcs
+	}
+	return ""
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// cgroups only exist on Linux; elsewhere rlimits are all there is
+func setupCgroups(path string) (*CgroupManager, error) {
+	return nil, fmt.Errorf("cgroups are only available on Linux")
+}
+
+func (cm *CgroupManager) Create(name string, limits ResourceLimits) (string, error) {
+	return "", fmt.Errorf("cgroups are only available on Linux")
+}
+
+func (cm *CgroupManager) Remove(dir string) {}
+
+func cgroupLimitHit(dir string) string {
+	return ""
+}
+
+func (cm *CgroupManager) startIn(cmd *exec.Cmd, dir string) error {
+	return fmt.Errorf("cgroups are only available on Linux")
+}
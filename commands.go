@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// subcommand is a maintenance task run as `snakeflex <name> [flags]` instead of the server
+type subcommand struct {
+	usage string
+	run   func(args []string) int
+}
+
+var subcommands = map[string]subcommand{
+	"hash-password": {
+		usage: hashPasswordUsage,
+		run:   hashPasswordCommand,
+	},
+	"token": {
+		usage: tokenUsage,
+		run:   tokenCommand,
+	},
+	"exec-limited": {
+		usage: execLimitedUsage,
+		run:   execLimitedCommand,
+	},
+	"exec-sandboxed": {
+		usage: execSandboxedUsage,
+		run:   execSandboxedCommand,
+	},
+}
+
+const hashPasswordUsage = "Print an argon2id (or bcrypt) hash for --pass-hash, --pass-hash-file or a users file"
+
+func hashPasswordCommand(args []string) int {
+	fs := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	useBcrypt := fs.Bool("bcrypt", false, "Produce a bcrypt hash instead of argon2id")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: snakeflex hash-password [--bcrypt] < password\n\n%s\n\n", hashPasswordUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	password, err := readPassword()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "Error: password must not be empty")
+		return 1
+	}
+
+	var hash string
+	if *useBcrypt {
+		hash, err = generateBcryptHash(password)
+	} else {
+		hash, err = generatePasswordHash(password)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error hashing password: %v\n", err)
+		return 1
+	}
+	fmt.Println(hash)
+	return 0
+}
+
+const tokenUsage = "Create, list or revoke API tokens in a --token-file"
+
+func tokenCommand(args []string) int {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	file := fs.String("file", "", "Token file (the server's --token-file)")
+	user := fs.String("user", "", "User the token acts as (create)")
+	usersFile := fs.String("users", "", "Users file (the server's --users) that --user must be in (create)")
+	scopes := fs.String("scopes", "", "Comma-separated scopes: "+strings.Join(rolePermissions["admin"], ", ")+" (create)")
+	name := fs.String("name", "", "Description of the token, e.g. ci (create)")
+	expires := fs.Duration("expires", 0, "Lifetime of the token, e.g. 720h; 0 never expires (create)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: snakeflex token create --file FILE --user USER --scopes SCOPES [--users FILE] [--name NAME] [--expires DURATION]\n"+
+			"       snakeflex token list --file FILE\n"+
+			"       snakeflex token revoke --file FILE ID\n\n%s\n\n", tokenUsage)
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+	action := args[0]
+	fs.Parse(args[1:])
+
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "Error: --file is required")
+		return 2
+	}
+	store, err := LoadTokenStore(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	switch action {
+	case "create":
+		if !validUsername.MatchString(*user) {
+			fmt.Fprintln(os.Stderr, "Error: --user must name an existing user")
+			return 2
+		}
+		if *usersFile != "" {
+			users, err := LoadUserStore(*usersFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return 1
+			}
+			if !users.Exists(*user) {
+				fmt.Fprintf(os.Stderr, "Error: %s has no user %q\n", *usersFile, *user)
+				return 2
+			}
+		}
+		scopeList, err := parseScopes(*scopes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 2
+		}
+		secret, token, err := store.Create(*user, *name, scopeList, *expires)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Created token %s for %s (%s). It is shown only once:\n", token.ID, token.Username, strings.Join(token.Scopes, ","))
+		fmt.Println(secret)
+	case "list":
+		tokens, err := store.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		for _, token := range tokens {
+			expiry := "never"
+			if token.ExpiresAt != nil {
+				expiry = token.ExpiresAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%s  %-12s %-16s %-40s expires %s\n", token.ID, token.Username, token.Name, strings.Join(token.Scopes, ","), expiry)
+		}
+	case "revoke":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 2
+		}
+		if err := store.Revoke(fs.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Revoked token %s\n", fs.Arg(0))
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
+
+// Prompt twice without echo on a terminal; otherwise take the first line of stdin
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("reading password from stdin: %v", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(first) != string(second) {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return string(first), nil
+}
+
+// usage extends the default flag help with the available subcommands
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags]\n       %s <command> [flags]\n\nCommands:\n", os.Args[0], os.Args[0])
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-15s %s\n", name, subcommands[name].usage)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Mutating requests carry the CSRF token in this header; the login form
+// double-submits it in a field and a cookie
+const (
+	csrfHeader      = "X-CSRF-Token"
+	csrfFormField   = "csrf_token"
+	loginCSRFCookie = "snakeflex_csrf"
+)
+
+// Context key for the CSRF token a request's page was given
+const csrfContextKey contextKey = "csrf"
+
+func newCSRFKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// The CSRF token of a login session is derived from its secret cookie, so it
+// needs no storage and survives restarts with --session-file
+func sessionCSRFToken(sessionToken string) string {
+	sum := sha256.Sum256([]byte("snakeflex-csrf:" + sessionToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Requests without a session (no authentication, or a user identified by a
+// proxy) get a token bound to their identity for the life of the process
+func (ts *TerminalServer) signedCSRFToken(binding string) string {
+	mac := hmac.New(sha256.New, ts.csrfKey)
+	mac.Write([]byte(binding))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func csrfSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// serveWithCSRF rejects mutating requests that do not carry the token and
+// leaves it in the context for pages that hand it to the browser
+func (ts *TerminalServer) serveWithCSRF(w http.ResponseWriter, r *http.Request, token string, next http.HandlerFunc) {
+	if !csrfSafeMethod(r.Method) {
+		sent := r.Header.Get(csrfHeader)
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			log.Printf("⛔ Rejected %s %s from %s without a valid CSRF token", r.Method, r.URL.Path, ts.rateLimiter.getClientIP(r))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Missing or invalid CSRF token; reload the page"})
+			return
+		}
+	}
+	next(w, r.WithContext(context.WithValue(r.Context(), csrfContextKey, token)))
+}
+
+// CSRF token for the page being served, or "" for API token requests
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfContextKey).(string)
+	return token
+}
+
+// loginCSRFToken returns the token for the login form, setting its cookie
+// when the browser does not have one yet
+func (ts *TerminalServer) loginCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(loginCSRFCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	bytes := make([]byte, 32)
+	rand.Read(bytes)
+	token := base64.RawURLEncoding.EncodeToString(bytes)
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCSRFCookie,
+		Value:    token,
+		Path:     ts.cookiePath(r),
+		HttpOnly: true,
+		Secure:   ts.secureRequest(r),
+		SameSite: http.SameSiteStrictMode,
+		Expires:  time.Now().Add(defaultSessionLifetime),
+	})
+	return token
+}
+
+// A login form post is only accepted with the token from its own cookie
+func validLoginCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(loginCSRFCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.FormValue(csrfFormField)), []byte(cookie.Value)) == 1
+}
+
+// parseAllowedOrigins normalizes origins such as https://ide.example.com
+func parseAllowedOrigins(list string) []string {
+	var origins []string
+	for _, origin := range splitList(list) {
+		origins = append(origins, strings.ToLower(strings.TrimSuffix(origin, "/")))
+	}
+	return origins
+}
+
+// checkOrigin lets browsers open WebSockets only from our own pages or from
+// the configured origins. Clients that send no Origin are not browsers.
+func (ts *TerminalServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err == nil && parsed.Host != "" {
+		if strings.EqualFold(parsed.Host, r.Host) {
+			return true
+		}
+		if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" && ts.fromTrustedProxy(r) && strings.EqualFold(parsed.Host, forwarded) {
+			return true
+		}
+	}
+	normalized := strings.ToLower(strings.TrimSuffix(origin, "/"))
+	for _, allowed := range ts.allowedOrigins {
+		if allowed == "*" || allowed == normalized {
+			return true
+		}
+	}
+	log.Printf("⛔ Rejected WebSocket from origin %s for %s (see --allowed-origins)", origin, r.URL.Path)
+	return false
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestServeWithCSRF(t *testing.T) {
+	ts := &TerminalServer{rateLimiter: &RateLimiter{}}
+	token := sessionCSRFToken("session-secret")
+
+	tests := []struct {
+		method string
+		sent   string
+		want   int
+	}{
+		{"GET", "", http.StatusOK},
+		{"HEAD", "", http.StatusOK},
+		{"OPTIONS", "", http.StatusOK},
+		{"POST", token, http.StatusOK},
+		{"POST", "", http.StatusForbidden},
+		{"POST", token + "x", http.StatusForbidden},
+		{"POST", sessionCSRFToken("another-session"), http.StatusForbidden},
+		{"PUT", "", http.StatusForbidden},
+		{"DELETE", "", http.StatusForbidden},
+		{"PATCH", token, http.StatusOK},
+		{"get", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/api/files", nil)
+		if test.sent != "" {
+			r.Header.Set(csrfHeader, test.sent)
+		}
+		w := httptest.NewRecorder()
+		var seen string
+		ts.serveWithCSRF(w, r, token, func(w http.ResponseWriter, r *http.Request) {
+			seen = csrfToken(r)
+		})
+		if w.Code != test.want {
+			t.Errorf("%s with token %q: status %d, want %d", test.method, test.sent, w.Code, test.want)
+		}
+		if w.Code == http.StatusOK && seen != token {
+			t.Errorf("%s: handler saw token %q", test.method, seen)
+		}
+	}
+}
+
+func TestCSRFTokens(t *testing.T) {
+	if sessionCSRFToken("a") == sessionCSRFToken("b") || sessionCSRFToken("a") != sessionCSRFToken("a") {
+		t.Error("session CSRF tokens are not bound to the session")
+	}
+	if strings.Contains(sessionCSRFToken("session-secret"), "session-secret") {
+		t.Error("session CSRF token gives the session away")
+	}
+
+	ts := &TerminalServer{csrfKey: newCSRFKey()}
+	other := &TerminalServer{csrfKey: newCSRFKey()}
+	if ts.signedCSRFToken("proxy:alice") != ts.signedCSRFToken("proxy:alice") {
+		t.Error("signed CSRF token changes between requests")
+	}
+	if ts.signedCSRFToken("proxy:alice") == ts.signedCSRFToken("proxy:bob") {
+		t.Error("signed CSRF token is not bound to the user")
+	}
+	if ts.signedCSRFToken("proxy:alice") == other.signedCSRFToken("proxy:alice") {
+		t.Error("signed CSRF token does not depend on the key")
+	}
+}
+
+func TestLoginCSRF(t *testing.T) {
+	ts := &TerminalServer{}
+
+	// The login page sets a cookie once and then reuses it
+	w := httptest.NewRecorder()
+	token := ts.loginCSRFToken(w, httptest.NewRequest("GET", "/login", nil))
+	cookies := w.Result().Cookies()
+	if token == "" || len(cookies) != 1 || cookies[0].Value != token || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("login CSRF token %q with cookies %v", token, cookies)
+	}
+	r := httptest.NewRequest("GET", "/login", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	if again := ts.loginCSRFToken(w, r); again != token || len(w.Result().Cookies()) != 0 {
+		t.Errorf("second visit got token %q and cookies %v", again, w.Result().Cookies())
+	}
+
+	tests := []struct {
+		name   string
+		cookie string
+		field  string
+		want   bool
+	}{
+		{"matching", token, token, true},
+		{"no cookie", "", token, false},
+		{"no field", token, "", false},
+		{"neither", "", "", false},
+		{"different", token, token[1:], false},
+	}
+	for _, test := range tests {
+		form := url.Values{csrfFormField: {test.field}}
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: loginCSRFCookie, Value: test.cookie})
+		}
+		if got := validLoginCSRF(r); got != test.want {
+			t.Errorf("%s: validLoginCSRF = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		origin         string
+		host           string
+		forwardedHost  string
+		remoteAddr     string
+		allowedOrigins string
+		want           bool
+	}{
+		{"no origin", "", "localhost:8080", "", "127.0.0.1:5000", "", true},
+		{"same host", "http://localhost:8080", "localhost:8080", "", "127.0.0.1:5000", "", true},
+		{"same host, other case", "https://IDE.example.com", "ide.example.com", "", "192.0.2.1:5000", "", true},
+		{"other port", "http://localhost:9090", "localhost:8080", "", "127.0.0.1:5000", "", false},
+		{"other site", "https://evil.example.com", "localhost:8080", "", "127.0.0.1:5000", "", false},
+		{"lookalike", "https://localhost:8080.evil.example.com", "localhost:8080", "", "127.0.0.1:5000", "", false},
+		{"null", "null", "localhost:8080", "", "127.0.0.1:5000", "", false},
+		{"forwarded host from a trusted proxy", "https://ide.example.com", "10.0.0.9:8080", "ide.example.com", "10.0.0.5:5000", "", true},
+		{"forwarded host from anyone else", "https://evil.example.com", "localhost:8080", "evil.example.com", "192.0.2.1:5000", "", false},
+		{"allowed", "https://Tools.example.com/", "localhost:8080", "", "192.0.2.1:5000", "https://tools.example.com", true},
+		{"allowed list", "https://b.example.com", "localhost:8080", "", "192.0.2.1:5000", "https://a.example.com, https://b.example.com/", true},
+		{"not in the list", "https://c.example.com", "localhost:8080", "", "192.0.2.1:5000", "https://a.example.com,https://b.example.com", false},
+		{"everyone", "https://evil.example.com", "localhost:8080", "", "192.0.2.1:5000", "*", true},
+	}
+	for _, test := range tests {
+		ts := &TerminalServer{trustedProxies: proxies, allowedOrigins: parseAllowedOrigins(test.allowedOrigins)}
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.Host = test.host
+		r.RemoteAddr = test.remoteAddr
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.forwardedHost != "" {
+			r.Header.Set("X-Forwarded-Host", test.forwardedHost)
+		}
+		if got := ts.checkOrigin(r); got != test.want {
+			t.Errorf("%s: checkOrigin = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
@@ -5,6 +5,9 @@ go 1.21
 require (
 	github.com/creack/pty v1.1.24
 	github.com/gorilla/websocket v1.5.1
+	golang.org/x/crypto v0.14.0
+	golang.org/x/sys v0.14.0
+	golang.org/x/term v0.14.0
 )
 
 require golang.org/x/net v0.17.0 // indirect
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of Python interpreter a run or shell can use
+const (
+	InterpreterSystem = "system"
+	InterpreterVenv   = "venv"
+	InterpreterConda  = "conda"
+	InterpreterPyenv  = "pyenv"
+)
+
+// Default location of per-folder interpreter choices, relative to the working directory
+const defaultInterpreterFile = ".snakeflex/interpreters.json"
+
+// How deep below the working directory environments are looked for, and how
+// long one scan is reused
+const (
+	interpreterScanDepth = 3
+	interpreterScanTTL   = 30 * time.Second
+)
+
+// Directories never searched for environments
+var interpreterScanSkip = map[string]bool{
+	".git":          true,
+	"node_modules":  true,
+	"__pycache__":   true,
+	"site-packages": true,
+}
+
+// Interpreter is a Python that runs and shells can be started with
+type Interpreter struct {
+	ID      string `json:"id"` // "system", "pyenv:<version>", "conda:<name>" or the environment's path relative to the working directory
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	Python  string `json:"python"`         // executable
+	Root    string `json:"root,omitempty"` // environment prefix; empty for the system interpreter
+	Version string `json:"version,omitempty"`
+}
+
+// Directory holding an environment's executables
+func (interp Interpreter) binDir() string {
+	if interp.Root == "" {
+		return ""
+	}
+	return filepath.Dir(interp.Python)
+}
+
+// activate changes an environment list the way the environment's activate
+// script would: its executables come first on PATH and it is named in the
+// variables tools look for
+func (interp Interpreter) activate(env []string) []string {
+	if interp.Root == "" {
+		return env
+	}
+	bin := interp.binDir()
+	activated := []string{}
+	hasPath := false
+	for _, entry := range env {
+		name, value, _ := strings.Cut(entry, "=")
+		switch {
+		case strings.EqualFold(name, "PATH"):
+			activated = append(activated, name+"="+bin+string(os.PathListSeparator)+value)
+			hasPath = true
+		case name == "PYTHONHOME", name == "VIRTUAL_ENV", name == "CONDA_PREFIX", name == "CONDA_DEFAULT_ENV", name == "PYENV_VERSION":
+		default:
+			activated = append(activated, entry)
+		}
+	}
+	if !hasPath {
+		activated = append(activated, "PATH="+bin)
+	}
+
+	switch interp.Kind {
+	case InterpreterVenv:
+		activated = append(activated, "VIRTUAL_ENV="+interp.Root)
+	case InterpreterConda:
+		activated = append(activated, "CONDA_PREFIX="+interp.Root, "CONDA_DEFAULT_ENV="+interp.Name)
+	case InterpreterPyenv:
+		activated = append(activated, "PYENV_VERSION="+strings.TrimPrefix(interp.ID, "pyenv:"))
+	}
+	return activated
+}
+
+// Python executable of an environment, if it has one
+func environmentPython(root string) string {
+	candidates := []string{filepath.Join("bin", "python3"), filepath.Join("bin", "python")}
+	if runtime.GOOS == "windows" {
+		candidates = []string{filepath.Join("Scripts", "python.exe"), "python.exe"}
+	}
+	for _, candidate := range candidates {
+		path := filepath.Join(root, candidate)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// Kind of environment rooted at a directory, or "" for an ordinary directory
+func environmentKind(dir string) string {
+	if _, err := os.Stat(filepath.Join(dir, "pyvenv.cfg")); err == nil {
+		return InterpreterVenv
+	}
+	if info, err := os.Stat(filepath.Join(dir, "conda-meta")); err == nil && info.IsDir() {
+		return InterpreterConda
+	}
+	return ""
+}
+
+// Normalize a folder relative to the working directory; the root is ""
+func cleanFolder(folder string) string {
+	folder = filepath.ToSlash(filepath.Clean(folder))
+	if folder == "." || folder == "/" {
+		return ""
+	}
+	return strings.TrimPrefix(folder, "/")
+}
+
+// InterpreterManager discovers interpreters and remembers which one each
+// folder of the project uses. Folder choices are kept in a JSON file in the
+// project, like run configurations.
+type InterpreterManager struct {
+	workingDir string
+	systemCmd  string
+	path       string
+	folders    map[string]string // folder -> interpreter ID
+	modTime    time.Time
+	scanned    []Interpreter
+	scannedAt  time.Time
+	versions   map[string]string // executable -> version
+	mutex      sync.Mutex
+}
+
+func NewInterpreterManager(workingDir, systemCmd, path string) (*InterpreterManager, error) {
+	im := &InterpreterManager{
+		workingDir: workingDir,
+		systemCmd:  systemCmd,
+		path:       path,
+		versions:   make(map[string]string),
+	}
+	if err := im.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return im, nil
+}
+
+// Re-read the folder choices if the file changed on disk; the caller holds the lock
+func (im *InterpreterManager) reloadIfChanged() error {
+	info, err := os.Stat(im.path)
+	if os.IsNotExist(err) {
+		im.folders = make(map[string]string)
+		im.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading interpreter settings: %v", err)
+	}
+	if info.ModTime().Equal(im.modTime) {
+		return nil
+	}
+
+	// Remember this version even if it is broken, so it is reported once
+	im.modTime = info.ModTime()
+	data, err := os.ReadFile(im.path)
+	if err != nil {
+		return fmt.Errorf("reading interpreter settings: %v", err)
+	}
+	var settings struct {
+		Folders map[string]string `json:"folders"`
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return fmt.Errorf("parsing interpreter settings %s: %v", im.path, err)
+		}
+	}
+	im.folders = make(map[string]string, len(settings.Folders))
+	for folder, id := range settings.Folders {
+		im.folders[cleanFolder(folder)] = id
+	}
+	return nil
+}
+
+// Write the folder choices to a temporary file and rename it into place; the caller holds the lock
+func (im *InterpreterManager) save() error {
+	data, err := json.MarshalIndent(map[string]interface{}{"folders": im.folders}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(im.path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(im.path), ".interpreters-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), im.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(im.path); err == nil {
+		im.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Version reported by an interpreter, cached per executable; the caller holds the lock
+func (im *InterpreterManager) version(python string) string {
+	if version, ok := im.versions[python]; ok {
+		return version
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, python, "--version").CombinedOutput()
+	version := ""
+	if err == nil {
+		version = strings.TrimPrefix(strings.TrimSpace(string(output)), "Python ")
+	}
+	im.versions[python] = version
+	return version
+}
+
+// Look for environments again if the last scan is too old; the caller holds the lock
+func (im *InterpreterManager) scanIfStale() {
+	if !im.scannedAt.IsZero() && time.Since(im.scannedAt) < interpreterScanTTL {
+		return
+	}
+	found := []Interpreter{{ID: InterpreterSystem, Kind: InterpreterSystem, Name: "System Python (" + im.systemCmd + ")", Python: im.systemCmd}}
+	seen := make(map[string]bool)
+	add := func(interp Interpreter) {
+		if interp.Python == "" || seen[interp.Root] {
+			return
+		}
+		seen[interp.Root] = true
+		found = append(found, interp)
+	}
+
+	// Environments inside the project, such as .venv or a conda prefix
+	filepath.WalkDir(im.workingDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(im.workingDir, path)
+		if rel == "." {
+			return nil
+		}
+		if interpreterScanSkip[entry.Name()] || strings.Count(rel, string(filepath.Separator)) >= interpreterScanDepth {
+			return filepath.SkipDir
+		}
+		if kind := environmentKind(path); kind != "" {
+			id := filepath.ToSlash(rel)
+			add(Interpreter{ID: id, Kind: kind, Name: id, Python: environmentPython(path), Root: path})
+			return filepath.SkipDir
+		}
+		return nil
+	})
+
+	// Named conda environments, as registered by conda itself
+	if home, err := os.UserHomeDir(); err == nil {
+		if file, err := os.Open(filepath.Join(home, ".conda", "environments.txt")); err == nil {
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				root := strings.TrimSpace(scanner.Text())
+				if root == "" || environmentKind(root) != InterpreterConda {
+					continue
+				}
+				name := filepath.Base(root)
+				if filepath.Base(filepath.Dir(root)) != "envs" {
+					name = "base"
+				}
+				add(Interpreter{ID: "conda:" + name, Kind: InterpreterConda, Name: "conda " + name, Python: environmentPython(root), Root: root})
+			}
+			file.Close()
+		}
+	}
+
+	// Versions installed with pyenv
+	pyenvRoot := os.Getenv("PYENV_ROOT")
+	if home, err := os.UserHomeDir(); err == nil && pyenvRoot == "" {
+		pyenvRoot = filepath.Join(home, ".pyenv")
+	}
+	if entries, err := os.ReadDir(filepath.Join(pyenvRoot, "versions")); err == nil {
+		for _, entry := range entries {
+			root := filepath.Join(pyenvRoot, "versions", entry.Name())
+			if entry.IsDir() || entry.Type()&fs.ModeSymlink != 0 {
+				add(Interpreter{ID: "pyenv:" + entry.Name(), Kind: InterpreterPyenv, Name: "pyenv " + entry.Name(), Python: environmentPython(root), Root: root})
+			}
+		}
+	}
+
+	for i := range found {
+		found[i].Version = im.version(found[i].Python)
+	}
+	// The system interpreter stays first, then the project's own environments
+	environments := found[1:]
+	sort.Slice(environments, func(i, j int) bool {
+		iGlobal, jGlobal := strings.Contains(environments[i].ID, ":"), strings.Contains(environments[j].ID, ":")
+		if iGlobal != jGlobal {
+			return jGlobal
+		}
+		return environments[i].ID < environments[j].ID
+	})
+	im.scanned = found
+	im.scannedAt = time.Now()
+}
+
+func (im *InterpreterManager) find(id string) (Interpreter, bool) {
+	for _, interp := range im.scanned {
+		if interp.ID == id {
+			return interp, true
+		}
+	}
+	return Interpreter{}, false
+}
+
+// List returns every interpreter found and the folders that chose one
+func (im *InterpreterManager) List() ([]Interpreter, map[string]string, error) {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	if err := im.reloadIfChanged(); err != nil {
+		return nil, nil, err
+	}
+	im.scanIfStale()
+	folders := make(map[string]string, len(im.folders))
+	for folder, id := range im.folders {
+		folders[folder] = id
+	}
+	return append([]Interpreter(nil), im.scanned...), folders, nil
+}
+
+// Resolve picks the interpreter for something started in a folder of the
+// project: the requested one, else the choice of the nearest folder above,
+// else the nearest environment in a folder above, else the system Python
+func (im *InterpreterManager) Resolve(folder, requested string) (Interpreter, error) {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	if err := im.reloadIfChanged(); err != nil {
+		return Interpreter{}, err
+	}
+	im.scanIfStale()
+
+	if requested != "" {
+		if interp, ok := im.find(requested); ok {
+			return interp, nil
+		}
+		return Interpreter{}, fmt.Errorf("unknown interpreter %q", requested)
+	}
+
+	for dir := cleanFolder(folder); ; dir = cleanFolder(filepath.Dir(dir)) {
+		if id, ok := im.folders[dir]; ok {
+			if interp, ok := im.find(id); ok {
+				return interp, nil
+			}
+			return Interpreter{}, fmt.Errorf("interpreter %q chosen for folder %q was not found", id, dir)
+		}
+		// Project environments are sorted by path, so .venv wins over venv
+		for _, interp := range im.scanned {
+			inProject := interp.Kind == InterpreterVenv || (interp.Kind == InterpreterConda && !strings.HasPrefix(interp.ID, "conda:"))
+			if inProject && cleanFolder(filepath.Dir(interp.ID)) == dir {
+				return interp, nil
+			}
+		}
+		if dir == "" {
+			break
+		}
+	}
+	interp, _ := im.find(InterpreterSystem)
+	return interp, nil
+}
+
+// SetFolder makes a folder and everything below it use an interpreter; an
+// empty ID goes back to automatic selection
+func (im *InterpreterManager) SetFolder(folder, id string) error {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	if err := im.reloadIfChanged(); err != nil {
+		return err
+	}
+	im.scanIfStale()
+	folder = cleanFolder(folder)
+	if id == "" {
+		delete(im.folders, folder)
+	} else {
+		if _, ok := im.find(id); !ok {
+			return fmt.Errorf("unknown interpreter %q", id)
+		}
+		im.folders[folder] = id
+	}
+	if err := im.save(); err != nil {
+		return fmt.Errorf("saving interpreter settings: %v", err)
+	}
+	return nil
+}
+
+// Rescan forgets the last scan so new environments show up at once
+func (im *InterpreterManager) Rescan() {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	im.scannedAt = time.Time{}
+}
+
+// Bash startup file for shells with an environment: the user's own startup
+// file runs first, then the environment is put back in front of PATH
+const activationBashrc = `[ -f ~/.bashrc ] && . ~/.bashrc
+if [ -n "$SNAKEFLEX_ENV_BIN" ]; then
+    export PATH="$SNAKEFLEX_ENV_BIN:$PATH"
+    PS1="($SNAKEFLEX_ENV_NAME) $PS1"
+fi
+`
+
+var (
+	activationRCPath string
+	activationRCErr  error
+	activationRCOnce sync.Once
+)
+
+// Path of the activation startup file, written once per server process
+func activationRCFile() (string, error) {
+	activationRCOnce.Do(func() {
+		file, err := os.CreateTemp("", "snakeflex-*.bashrc")
+		if err != nil {
+			activationRCErr = err
+			return
+		}
+		defer file.Close()
+		if _, err := file.WriteString(activationBashrc); err != nil {
+			activationRCErr = err
+			return
+		}
+		activationRCPath = file.Name()
+	})
+	return activationRCPath, activationRCErr
+}
+
+// Shown in the output before a run, e.g. ".venv/bin/python3 train.py --epochs 10"
+func (ts *TerminalServer) runCommandLine(interp Interpreter, run *ScriptRun) string {
+	python := interp.Python
+	if rel, err := filepath.Rel(ts.workingDir, python); err == nil && !strings.HasPrefix(rel, "..") {
+		python = filepath.ToSlash(rel)
+	}
+	command := []string{python, run.File}
+	if run.Module {
+		command = []string{python, "-m", run.File}
+	}
+	return strings.Join(append(command, run.Options.Args...), " ")
+}
+
+// interpretersHandler lists interpreters and folder choices (GET, ?file= also
+// resolves the one a script would use, ?refresh=1 rescans) and sets the
+// interpreter of a folder (POST {"folder", "interpreter"})
+func (ts *TerminalServer) interpretersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		if r.URL.Query().Get("refresh") != "" {
+			ts.interpreters.Rescan()
+		}
+		list, folders, err := ts.interpreters.List()
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		data := map[string]interface{}{"interpreters": list, "folders": folders}
+		if file := r.URL.Query().Get("file"); file != "" {
+			if resolved, err := ts.interpreters.Resolve(filepath.Dir(file), ""); err == nil {
+				data["resolved"] = resolved
+			}
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Data: data})
+
+	case "POST":
+		// The choice is saved in the project for everyone
+		if ts.denyUnlessPermitted(w, r, PermFilesWrite) {
+			return
+		}
+		var req struct {
+			Folder      string `json:"folder"`
+			Interpreter string `json:"interpreter"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Invalid request body"})
+			return
+		}
+		if _, err := ts.resolveRunDir(req.Folder); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		if err := ts.interpreters.SetFolder(req.Folder, req.Interpreter); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		if ts.verbose {
+			log.Printf("🐍 %s set the interpreter of %q to %q", ts.clientIdentity(r), cleanFolder(req.Folder), req.Interpreter)
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Interpreter saved"})
+
+	default:
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Method not allowed"})
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits a run or shell can hit
+const (
+	LimitTimeout = "timeout"
+	LimitCPU     = "cpu"
+	LimitMemory  = "memory"
+	LimitFiles   = "files"
+	LimitProcs   = "procs"
+)
+
+// Grace period added to the CPU limit before SIGXCPU becomes SIGKILL
+const cpuLimitGrace = 5 * time.Second
+
+// ResourceLimits bound what a single run or shell may use; zero is unlimited
+type ResourceLimits struct {
+	Timeout time.Duration // wall-clock time
+	CPU     time.Duration // CPU time, in whole seconds
+	Memory  int64         // bytes of resident memory (address space without cgroups)
+	Files   int           // open file descriptors per process
+	Procs   int           // processes and threads; needs a cgroup
+}
+
+// parseResourceLimits reads a spec such as "timeout=10m,cpu=60s,memory=512M,files=256,procs=64"
+func parseResourceLimits(spec string) (ResourceLimits, error) {
+	var limits ResourceLimits
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return limits, fmt.Errorf("limit %q is not name=value", part)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+
+		var err error
+		switch name {
+		case LimitTimeout:
+			limits.Timeout, err = parseLimitDuration(value)
+		case LimitCPU:
+			limits.CPU, err = parseLimitDuration(value)
+			limits.CPU = limits.CPU.Round(time.Second)
+			if err == nil && limits.CPU == 0 {
+				limits.CPU = time.Second
+			}
+		case LimitMemory:
+			limits.Memory, err = parseSize(value)
+		case LimitFiles:
+			limits.Files, err = parseLimitCount(value)
+		case LimitProcs:
+			limits.Procs, err = parseLimitCount(value)
+		default:
+			return limits, fmt.Errorf("unknown limit %q (use %s, %s, %s, %s or %s)", name, LimitTimeout, LimitCPU, LimitMemory, LimitFiles, LimitProcs)
+		}
+		if err != nil {
+			return limits, fmt.Errorf("limit %s: %v", name, err)
+		}
+	}
+	return limits, nil
+}
+
+// A duration such as 90s or 10m; a bare number counts seconds
+func parseLimitDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%q is not a positive duration", value)
+	}
+	return d, nil
+}
+
+// A byte count with an optional K, M or G suffix (powers of 1024)
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.TrimSuffix(strings.ToUpper(value), "B")
+	switch {
+	case strings.HasSuffix(number, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(number, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(number, "G"):
+		multiplier = 1 << 30
+	}
+	number = strings.TrimRight(number, "KMG")
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a positive size", value)
+	}
+	return n * multiplier, nil
+}
+
+func parseLimitCount(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a positive number", value)
+	}
+	return n, nil
+}
+
+func formatSize(bytes int64) string {
+	switch {
+	case bytes%(1<<30) == 0:
+		return fmt.Sprintf("%dG", bytes>>30)
+	case bytes%(1<<20) == 0:
+		return fmt.Sprintf("%dM", bytes>>20)
+	case bytes%(1<<10) == 0:
+		return fmt.Sprintf("%dK", bytes>>10)
+	}
+	return strconv.FormatInt(bytes, 10)
+}
+
+// String gives the limits back in the form parseResourceLimits reads
+func (limits ResourceLimits) String() string {
+	var parts []string
+	if limits.Timeout > 0 {
+		parts = append(parts, LimitTimeout+"="+limits.Timeout.String())
+	}
+	if limits.CPU > 0 {
+		parts = append(parts, LimitCPU+"="+limits.CPU.String())
+	}
+	if limits.Memory > 0 {
+		parts = append(parts, LimitMemory+"="+formatSize(limits.Memory))
+	}
+	if limits.Files > 0 {
+		parts = append(parts, fmt.Sprintf("%s=%d", LimitFiles, limits.Files))
+	}
+	if limits.Procs > 0 {
+		parts = append(parts, fmt.Sprintf("%s=%d", LimitProcs, limits.Procs))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (limits ResourceLimits) IsZero() bool {
+	return limits == ResourceLimits{}
+}
+
+// Tighten combines two sets of limits, keeping the stricter of each
+func (limits ResourceLimits) Tighten(other ResourceLimits) ResourceLimits {
+	stricter := func(a, b int64) int64 {
+		if a == 0 || (b != 0 && b < a) {
+			return b
+		}
+		return a
+	}
+	return ResourceLimits{
+		Timeout: time.Duration(stricter(int64(limits.Timeout), int64(other.Timeout))),
+		CPU:     time.Duration(stricter(int64(limits.CPU), int64(other.CPU))),
+		Memory:  stricter(limits.Memory, other.Memory),
+		Files:   int(stricter(int64(limits.Files), int64(other.Files))),
+		Procs:   int(stricter(int64(limits.Procs), int64(other.Procs))),
+	}
+}
+
+// Describe names a limit and its value for people, e.g. "memory limit of 512M"
+func (limits ResourceLimits) Describe(limit string) string {
+	switch limit {
+	case LimitTimeout:
+		return fmt.Sprintf("time limit of %v", limits.Timeout)
+	case LimitCPU:
+		return fmt.Sprintf("CPU limit of %v", limits.CPU)
+	case LimitMemory:
+		return fmt.Sprintf("memory limit of %s", formatSize(limits.Memory))
+	case LimitFiles:
+		return fmt.Sprintf("open file limit of %d", limits.Files)
+	case LimitProcs:
+		return fmt.Sprintf("process limit of %d", limits.Procs)
+	}
+	return limit + " limit"
+}
+
+// What programs print when an allocation fails: Python, C, C++, Go and numpy
+var allocationFailures = []string{"MemoryError", "Cannot allocate memory", "std::bad_alloc", "out of memory", "Unable to allocate"}
+
+// allocationWatch looks through a process's output for a failed allocation,
+// which is what ties a failure under the address space limit to the limit
+type allocationWatch struct {
+	tail   string // end of the output so far, for messages split across writes
+	failed bool
+}
+
+func (w *allocationWatch) Write(output string) {
+	if w.failed {
+		return
+	}
+	text := w.tail + output
+	for _, message := range allocationFailures {
+		if strings.Contains(text, message) {
+			w.failed = true
+			return
+		}
+	}
+	w.tail = text[max(0, len(text)-32):]
+}
+
+// limitReached works out which limit ended a process, if any; signaled is
+// whether the server or its user sent the process a signal and allocFailed
+// whether it said an allocation failed. Open files are refused rather than
+// fatal, so running out of them is never reported.
+func limitReached(limits ResourceLimits, state *os.ProcessState, cgroup string, timedOut, signaled, allocFailed bool) string {
+	if timedOut {
+		return LimitTimeout
+	}
+	if hit := cgroupLimitHit(cgroup); hit != "" {
+		return hit
+	}
+	// The usage reported can come out a little under the limit that fired
+	if limits.CPU > 0 && state != nil && (killedByCPULimit(state) || state.UserTime()+state.SystemTime() >= limits.CPU) {
+		return LimitCPU
+	}
+	// Without a cgroup nothing records that the address space ran out, and
+	// programs crash for plenty of other reasons, so a failure only counts
+	// when the process said an allocation failed
+	if limits.Memory > 0 && cgroup == "" && state != nil && !signaled && allocFailed && !state.Success() {
+		return LimitMemory
+	}
+	return ""
+}
+
+// Server executable, found once for re-running it as exec-limited
+var selfExecutable = func() string {
+	path, err := os.Executable()
+	if err != nil {
+		return os.Args[0]
+	}
+	return path
+}()
+
+// Path of the program a command runs, which stays valid once it is started
+// through another program
+func absoluteCommandPath(cmd *exec.Cmd) (string, error) {
+	if filepath.IsAbs(cmd.Path) {
+		return cmd.Path, nil
+	}
+	return filepath.Abs(cmd.Path)
+}
+
+// limitCommand makes a command start through exec-limited, which applies the
+// rlimits the kernel enforces per process before running it. Memory is left
+// to the cgroup, if the command has one, and processes always are: the
+// process rlimit counts everything the server's user runs, not one command.
+// The wall-clock timeout is left to the caller.
+func limitCommand(cmd *exec.Cmd, limits ResourceLimits, cgroup string) error {
+	enforced := limits
+	enforced.Timeout = 0
+	if err := checkLimitSupport(enforced); err != nil {
+		return err
+	}
+	if enforced.Procs > 0 && cgroup == "" {
+		return fmt.Errorf("the %s limit needs a cgroup (see --cgroup)", LimitProcs)
+	}
+
+	var args []string
+	if enforced.CPU > 0 {
+		args = append(args, "--cpu", strconv.Itoa(int(enforced.CPU/time.Second)))
+	}
+	if enforced.Memory > 0 && cgroup == "" {
+		args = append(args, "--address-space", strconv.FormatInt(enforced.Memory, 10))
+	}
+	if enforced.Files > 0 {
+		args = append(args, "--files", strconv.Itoa(enforced.Files))
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	target, err := absoluteCommandPath(cmd)
+	if err != nil {
+		return err
+	}
+	args = append(append([]string{selfExecutable, "exec-limited"}, args...), "--", target)
+	cmd.Path = selfExecutable
+	cmd.Args = append(args, cmd.Args[1:]...)
+	return nil
+}
+
+const execLimitedUsage = "Run a command under resource limits (used by the server for runs and shells)"
+
+func execLimitedCommand(args []string) int {
+	fs := flag.NewFlagSet("exec-limited", flag.ExitOnError)
+	cpu := fs.Int("cpu", 0, "CPU seconds before SIGXCPU")
+	addressSpace := fs.Int64("address-space", 0, "Largest address space in bytes")
+	files := fs.Int("files", 0, "Most open file descriptors")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: snakeflex exec-limited [flags] -- COMMAND [ARGS...]\n\n%s\n\n", execLimitedUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if err := applyRlimits(*cpu, *addressSpace, *files); err != nil {
+		fmt.Fprintf(os.Stderr, "snakeflex: setting resource limits: %v\n", err)
+		return 126
+	}
+	err := execReplace(fs.Arg(0), fs.Args())
+	fmt.Fprintf(os.Stderr, "snakeflex: %s: %v\n", fs.Arg(0), err)
+	return 127
+}
+
+// CgroupManager gives every limited run and shell a cgroup v2 group of its
+// own under one delegated to the server, so memory is limited by what is
+// resident and processes are counted per run. A nil *CgroupManager creates
+// nothing.
+type CgroupManager struct {
+	base  string
+	open  map[string]*os.File // groups commands are started in, until removed
+	mutex sync.Mutex
+}
+
+// cgroupFor creates a group for a run or shell when memory or processes are
+// limited, and has the kernel start the command in it. Failures are logged
+// and leave the rlimit fallback in place.
+func (cm *CgroupManager) cgroupFor(cmd *exec.Cmd, name string, limits ResourceLimits) string {
+	if cm == nil || (limits.Memory == 0 && limits.Procs == 0) {
+		return ""
+	}
+	dir, err := cm.Create(name, limits)
+	if err == nil {
+		if err = cm.startIn(cmd, dir); err != nil {
+			cm.Remove(dir)
+		}
+	}
+	if err != nil {
+		log.Printf("⚠️ No cgroup for %s, falling back to rlimits: %v", name, err)
+		return ""
+	}
+	return dir
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseResourceLimits(t *testing.T) {
+	tests := []struct {
+		spec  string
+		want  ResourceLimits
+		valid bool
+	}{
+		{"", ResourceLimits{}, true},
+		{"timeout=10m", ResourceLimits{Timeout: 10 * time.Minute}, true},
+		{"timeout=90", ResourceLimits{Timeout: 90 * time.Second}, true},
+		{"cpu=60s", ResourceLimits{CPU: time.Minute}, true},
+		{"cpu=1500ms", ResourceLimits{CPU: 2 * time.Second}, true},
+		{"cpu=100ms", ResourceLimits{CPU: time.Second}, true},
+		{"memory=512M", ResourceLimits{Memory: 512 << 20}, true},
+		{"memory=2g", ResourceLimits{Memory: 2 << 30}, true},
+		{"memory=64KB", ResourceLimits{Memory: 64 << 10}, true},
+		{"memory=1048576", ResourceLimits{Memory: 1 << 20}, true},
+		{" timeout = 5m , files=256,procs=64, ", ResourceLimits{Timeout: 5 * time.Minute, Files: 256, Procs: 64}, true},
+		{"timeout=0", ResourceLimits{}, false},
+		{"timeout=-1m", ResourceLimits{}, false},
+		{"cpu=soon", ResourceLimits{}, false},
+		{"memory=0", ResourceLimits{}, false},
+		{"memory=1T", ResourceLimits{}, false},
+		{"memory=M", ResourceLimits{}, false},
+		{"files=0", ResourceLimits{}, false},
+		{"procs=-5", ResourceLimits{}, false},
+		{"procs=many", ResourceLimits{}, false},
+		{"disk=1G", ResourceLimits{}, false},
+		{"timeout", ResourceLimits{}, false},
+	}
+	for _, test := range tests {
+		limits, err := parseResourceLimits(test.spec)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("parseResourceLimits(%q) = %+v, want an error", test.spec, limits)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseResourceLimits(%q): %v", test.spec, err)
+			continue
+		}
+		if limits != test.want {
+			t.Errorf("parseResourceLimits(%q) = %+v, want %+v", test.spec, limits, test.want)
+		}
+
+		// String gives back a spec that reads the same
+		again, err := parseResourceLimits(limits.String())
+		if err != nil || again != limits {
+			t.Errorf("parseResourceLimits(%q.String() = %q) = %+v, %v", test.spec, limits.String(), again, err)
+		}
+	}
+}
+
+func TestTightenLimits(t *testing.T) {
+	server := ResourceLimits{Timeout: 10 * time.Minute, Memory: 1 << 30, Files: 256}
+	tests := []struct {
+		config ResourceLimits
+		want   ResourceLimits
+	}{
+		{ResourceLimits{}, server},
+		{ResourceLimits{Timeout: time.Minute}, ResourceLimits{Timeout: time.Minute, Memory: 1 << 30, Files: 256}},
+		{ResourceLimits{Timeout: time.Hour, Memory: 2 << 30}, server},
+		{ResourceLimits{CPU: time.Second, Procs: 8}, ResourceLimits{Timeout: 10 * time.Minute, CPU: time.Second, Memory: 1 << 30, Files: 256, Procs: 8}},
+	}
+	for _, test := range tests {
+		if got := server.Tighten(test.config); got != test.want {
+			t.Errorf("Tighten(%+v) = %+v, want %+v", test.config, got, test.want)
+		}
+	}
+}
+
+func TestLimitCommand(t *testing.T) {
+	if err := checkLimitSupport(ResourceLimits{CPU: time.Second}); err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		name   string
+		limits ResourceLimits
+		cgroup string
+		want   []string // exec-limited flags; nil when the command is left alone
+		valid  bool
+	}{
+		{"no limits", ResourceLimits{}, "", nil, true},
+		{"only a timeout", ResourceLimits{Timeout: time.Minute}, "", nil, true},
+		{"rlimits", ResourceLimits{CPU: 90 * time.Second, Memory: 1 << 20, Files: 64}, "",
+			[]string{"--cpu", "90", "--address-space", "1048576", "--files", "64"}, true},
+		{"memory in a cgroup", ResourceLimits{Memory: 1 << 20, Procs: 8}, "/sys/fs/cgroup/snakeflex/run-1", nil, true},
+		{"processes without a cgroup", ResourceLimits{Procs: 8}, "", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := exec.Command("/usr/bin/python3", "-u", "main.py")
+			err := limitCommand(cmd, test.limits, test.cgroup)
+			if !test.valid {
+				if err == nil {
+					t.Errorf("allowed: %q", cmd.Args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.want == nil {
+				if !reflect.DeepEqual(cmd.Args, []string{"/usr/bin/python3", "-u", "main.py"}) {
+					t.Errorf("command changed to %q", cmd.Args)
+				}
+				return
+			}
+			want := append(append([]string{selfExecutable, "exec-limited"}, test.want...), "--", "/usr/bin/python3", "-u", "main.py")
+			if cmd.Path != selfExecutable || !reflect.DeepEqual(cmd.Args, want) {
+				t.Errorf("command = %s %q, want %q", cmd.Path, cmd.Args, want)
+			}
+		})
+	}
+}
+
+func TestAllocationWatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		output []string
+		want   bool
+	}{
+		{"nothing", nil, false},
+		{"ordinary output", []string{"loss 0.31\n", "loss 0.29\n"}, false},
+		{"Python", []string{"Traceback (most recent call last):\n", "MemoryError\n"}, true},
+		{"split across writes", []string{"Traceback (most recent call last):\nMemor", "yError\n"}, true},
+		{"C", []string{"malloc: Cannot allocate memory\n"}, true},
+		{"C++", []string{"terminate called after throwing an instance of 'std::bad_alloc'\n"}, true},
+		{"Go", []string{"fatal error: runtime: out of memory\n"}, true},
+		{"numpy", []string{"numpy.core._exceptions._ArrayMemoryError: Unable to allocate 8.00 GiB\n"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var watch allocationWatch
+			for _, output := range test.output {
+				watch.Write(output)
+			}
+			if watch.failed != test.want {
+				t.Errorf("failed = %v, want %v", watch.failed, test.want)
+			}
+		})
+	}
+}
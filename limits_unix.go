@@ -0,0 +1,63 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Every limit can be enforced on Unix-like systems
+func checkLimitSupport(limits ResourceLimits) error {
+	return nil
+}
+
+// Lower a resource limit, never past the current hard limit
+func lowerRlimit(resource int, soft, hard uint64) error {
+	var current unix.Rlimit
+	if err := unix.Getrlimit(resource, &current); err != nil {
+		return err
+	}
+	if hard > current.Max {
+		hard = current.Max
+	}
+	if soft > hard {
+		soft = hard
+	}
+	return unix.Setrlimit(resource, &unix.Rlimit{Cur: soft, Max: hard})
+}
+
+// applyRlimits limits the current process, and so the command it is about to become
+func applyRlimits(cpu int, addressSpace int64, files int) error {
+	if cpu > 0 {
+		// SIGXCPU at the limit, SIGKILL a little later if it is caught
+		if err := lowerRlimit(unix.RLIMIT_CPU, uint64(cpu), uint64(cpu)+uint64(cpuLimitGrace/time.Second)); err != nil {
+			return err
+		}
+	}
+	if addressSpace > 0 {
+		if err := lowerRlimit(unix.RLIMIT_AS, uint64(addressSpace), uint64(addressSpace)); err != nil {
+			return err
+		}
+	}
+	if files > 0 {
+		if err := lowerRlimit(unix.RLIMIT_NOFILE, uint64(files), uint64(files)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether the process died of the SIGXCPU sent at its CPU limit
+func killedByCPULimit(state *os.ProcessState) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGXCPU
+}
+
+// Replace the current process with the command
+func execReplace(path string, args []string) error {
+	return syscall.Exec(path, args, os.Environ())
+}
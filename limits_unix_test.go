@@ -0,0 +1,62 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// State of a shell command after it has ended
+func exitState(t *testing.T, script string) *os.ProcessState {
+	t.Helper()
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Run()
+	if cmd.ProcessState == nil {
+		t.Fatalf("%q did not run", script)
+	}
+	return cmd.ProcessState
+}
+
+func TestLimitReached(t *testing.T) {
+	limits := ResourceLimits{Timeout: time.Minute, CPU: 30 * time.Second, Memory: 1 << 30}
+	exited := exitState(t, "exit 1")
+	aborted := exitState(t, "kill -ABRT $$")
+	killed := exitState(t, "kill -KILL $$")
+	cpu := exitState(t, "kill -XCPU $$")
+	terminated := exitState(t, "kill -TERM $$")
+
+	tests := []struct {
+		name        string
+		limits      ResourceLimits
+		state       *os.ProcessState
+		cgroup      string
+		timedOut    bool
+		signaled    bool
+		allocFailed bool
+		want        string
+	}{
+		{"normal exit", limits, exited, "", false, false, false, ""},
+		{"timed out", limits, killed, "", true, true, false, LimitTimeout},
+		{"CPU limit", limits, cpu, "", false, false, false, LimitCPU},
+		{"SIGXCPU without a CPU limit", ResourceLimits{}, cpu, "", false, false, false, ""},
+		{"abort after a failed allocation", limits, aborted, "", false, false, true, LimitMemory},
+		{"MemoryError under the address space limit", limits, exited, "", false, false, true, LimitMemory},
+		{"abort under the address space limit", limits, aborted, "", false, false, false, ""},
+		{"killed under the address space limit", limits, killed, "", false, false, false, ""},
+		{"MemoryError handled", limits, exitState(t, "exit 0"), "", false, false, true, ""},
+		{"killed by a stop request", limits, killed, "", false, true, true, ""},
+		{"abort without a memory limit", ResourceLimits{CPU: time.Minute}, aborted, "", false, false, true, ""},
+		{"terminated", limits, terminated, "", false, false, false, ""},
+		{"abort in a cgroup that saw no OOM kill", limits, aborted, t.TempDir(), false, false, true, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := limitReached(test.limits, test.state, test.cgroup, test.timedOut, test.signaled, test.allocFailed); got != test.want {
+				t.Errorf("limitReached = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
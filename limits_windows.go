@@ -0,0 +1,28 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Windows has no rlimits; only the wall-clock timeout, kept by the server, applies
+func checkLimitSupport(limits ResourceLimits) error {
+	if !limits.IsZero() {
+		return fmt.Errorf("only the %s limit is supported on Windows", LimitTimeout)
+	}
+	return nil
+}
+
+func applyRlimits(cpu int, addressSpace int64, files int) error {
+	return fmt.Errorf("resource limits are not supported on Windows")
+}
+
+func execReplace(path string, args []string) error {
+	return fmt.Errorf("not supported on Windows")
+}
+
+func killedByCPULimit(state *os.ProcessState) bool {
+	return false
+}
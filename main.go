@@ -1,22 +1,21 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/sha256"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"embed"
-	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -29,21 +28,39 @@ import (
 //go:embed templates/terminal.html
 var embeddedTemplates embed.FS
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for development
-	},
-}
+// CheckOrigin is set in main once the allowed origins are known
+var upgrader = websocket.Upgrader{}
 
 type AuthConfig struct {
-	Password string
-	Enabled  bool
+	Users   *UserStore
+	TOTP    *TOTPStore  // nil unless --totp-file is set
+	Tokens  *TokenStore // nil unless --token-file is set
+	Enabled bool
 }
 
+// Cookie carrying a login that passed the password step and still needs a code
+const pendingLoginCookie = "snakeflex_mfa"
+
+// Request context key under which requireAuth stores the signed-in username
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+// Context key for the API token a request authenticated with, if any
+const tokenContextKey contextKey = "token"
+
+// Context key for the role of a single sign-on user, who has no users file entry
+const roleContextKey contextKey = "role"
+
+// Context key marking users identified outside SnakeFlex, by a trusted proxy
+// or a client certificate, who cannot sign out here
+const externalAuthContextKey contextKey = "external"
+
 // Rate limiting for failed authentication attempts
 type RateLimiter struct {
-	attempts map[string]*AttemptRecord
-	mutex    sync.RWMutex
+	attempts       map[string]*AttemptRecord
+	trustedProxies TrustedProxies
+	mutex          sync.RWMutex
 }
 
 type AttemptRecord struct {
@@ -52,9 +69,10 @@ type AttemptRecord struct {
 	LockedUntil time.Time
 }
 
-func NewRateLimiter() *RateLimiter {
+func NewRateLimiter(trustedProxies TrustedProxies) *RateLimiter {
 	rl := &RateLimiter{
-		attempts: make(map[string]*AttemptRecord),
+		attempts:       make(map[string]*AttemptRecord),
+		trustedProxies: trustedProxies,
 	}
 
 	// Clean up old records every 10 minutes
@@ -69,25 +87,9 @@ func NewRateLimiter() *RateLimiter {
 	return rl
 }
 
+// Address failed attempts are counted against; forwarding headers only count from trusted proxies
 func (rl *RateLimiter) getClientIP(r *http.Request) string {
-	// Check for forwarded IP first (if behind proxy)
-	forwarded := r.Header.Get("X-Forwarded-For")
-	if forwarded != "" {
-		return strings.Split(forwarded, ",")[0]
-	}
-
-	// Check for real IP header
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP != "" {
-		return realIP
-	}
-
-	// Fall back to remote address
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-	return ip
+	return clientIP(r, rl.trustedProxies)
 }
 
 func (rl *RateLimiter) IsBlocked(r *http.Request) (bool, time.Duration) {
@@ -168,71 +170,6 @@ func (rl *RateLimiter) CleanupOldRecords() {
 	}
 }
 
-type SessionManager struct {
-	sessions map[string]time.Time
-	mutex    sync.RWMutex
-}
-
-func NewSessionManager() *SessionManager {
-	sm := &SessionManager{
-		sessions: make(map[string]time.Time),
-	}
-
-	// Clean up expired sessions every hour
-	go func() {
-		ticker := time.NewTicker(time.Hour)
-		defer ticker.Stop()
-		for range ticker.C {
-			sm.CleanupExpiredSessions()
-		}
-	}()
-
-	return sm
-}
-
-func (sm *SessionManager) CreateSession() string {
-	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
-
-	// Generate secure random token
-	bytes := make([]byte, 32)
-	rand.Read(bytes)
-	token := base64.URLEncoding.EncodeToString(bytes)
-
-	// Session expires in 24 hours
-	sm.sessions[token] = time.Now().Add(24 * time.Hour)
-	return token
-}
-
-func (sm *SessionManager) ValidateSession(token string) bool {
-	sm.mutex.RLock()
-	defer sm.mutex.RUnlock()
-
-	expiry, exists := sm.sessions[token]
-	if !exists {
-		return false
-	}
-
-	if time.Now().After(expiry) {
-		delete(sm.sessions, token)
-		return false
-	}
-
-	return true
-}
-
-func (sm *SessionManager) CleanupExpiredSessions() {
-	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
-
-	now := time.Now()
-	for token, expiry := range sm.sessions {
-		if now.After(expiry) {
-			delete(sm.sessions, token)
-		}
-	}
-}
-
 type TerminalServer struct {
 	pythonFile         string
 	verbose            bool
@@ -240,24 +177,56 @@ type TerminalServer struct {
 	workingDir         string
 	fileManagerEnabled bool
 	shellEnabled       bool
+	packagesEnabled    bool
+	wheelhouse         string // pip installs only from here when set
 	authConfig         *AuthConfig
 	sessionManager     *SessionManager
+	pendingLogins      *PendingLogins
+	oidc               *OIDCProvider   // nil unless single sign-on is configured
+	proxyAuth          *ProxyAuth      // nil unless a reverse proxy authenticates users
+	clientCertAuth     *ClientCertAuth // nil unless --client-ca is set
+	auditLog           *AuditLog       // nil unless --audit-log is set
+	recordings         *RecordingStore // nil unless --record-dir is set
+	runConfigs         *RunConfigStore
+	interpreters       *InterpreterManager
+	runLimits          ResourceLimits
+	cgroups            *CgroupManager // nil unless cgroup v2 limits are in use
+	sandbox            *Sandbox       // nil unless --sandbox is set
+	trustedProxies     TrustedProxies
+	allowedOrigins     []string // extra origins allowed to open WebSockets
+	csrfKey            []byte
 	rateLimiter        *RateLimiter
+	runRegistry        *RunRegistry
+	shellManager       *ShellManager
 	basePath           string // Added for proxy support
 }
 
 type Message struct {
-	Type    string `json:"type"`
-	Content string `json:"content,omitempty"`
-	Input   string `json:"input,omitempty"`
-	File    string `json:"file,omitempty"`
+	Type    string    `json:"type"`
+	Content string    `json:"content,omitempty"`
+	Input   string    `json:"input,omitempty"`
+	File    string    `json:"file,omitempty"`
+	Signal  string    `json:"signal,omitempty"`
+	RunID   string    `json:"runId,omitempty"`
+	Mode    string    `json:"mode,omitempty"`
+	Seq     uint64    `json:"seq,omitempty"`
+	Runs    []RunInfo `json:"runs,omitempty"`
+	Config  string    `json:"config,omitempty"` // saved run configuration to execute with
+	Limit   string    `json:"limit,omitempty"`  // resource limit that ended the run
+	RunOptions
 }
 
 type ShellMessage struct {
-	Type string  `json:"type"`
-	Data string  `json:"data,omitempty"`
-	Cols float64 `json:"cols,omitempty"`
-	Rows float64 `json:"rows,omitempty"`
+	Type        string      `json:"type"`
+	Data        string      `json:"data,omitempty"`
+	Cols        float64     `json:"cols,omitempty"`
+	Rows        float64     `json:"rows,omitempty"`
+	ID          string      `json:"id,omitempty"`
+	Name        string      `json:"name,omitempty"`
+	ReadOnly    bool        `json:"readOnly,omitempty"`
+	Interpreter string      `json:"interpreter,omitempty"` // for a new shell; the project's own when empty
+	Limit       string      `json:"limit,omitempty"`       // resource limit that ended the shell
+	Sessions    []ShellInfo `json:"sessions,omitempty"`
 }
 
 type FileInfo struct {
@@ -311,6 +280,13 @@ func (s *SafeWebSocketConn) messageSender() {
 }
 
 func (s *SafeWebSocketConn) SendMessage(msg Message) {
+	// Runs may outlive the connection briefly while they are being stopped
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
 	select {
 	case s.msgChan <- msg:
 	default:
@@ -363,22 +339,19 @@ func verifyPython3(pythonCmd string) bool {
 	return len(version) >= 8 && version[:8] == "Python 3"
 }
 
-func hashPassword(password string) string {
-	hasher := sha256.New()
-	hasher.Write([]byte(password))
-	return hex.EncodeToString(hasher.Sum(nil))
-}
-
 // Helper function to get base path from request headers or configuration
 func (ts *TerminalServer) getBasePath(r *http.Request) string {
-	// Check for forwarded path prefix (set by reverse proxy)
-	if prefix := r.Header.Get("X-Forwarded-Prefix"); prefix != "" {
-		return strings.TrimSuffix(prefix, "/")
-	}
+	// Only a trusted proxy may move us to another path; it ends up in cookie paths and <base href>
+	if ts.fromTrustedProxy(r) {
+		// Check for forwarded path prefix (set by reverse proxy)
+		if prefix := r.Header.Get("X-Forwarded-Prefix"); validForwardedPrefix(prefix) {
+			return strings.TrimSuffix(prefix, "/")
+		}
 
-	// Check for script name (another common proxy header)
-	if script := r.Header.Get("X-Script-Name"); script != "" {
-		return strings.TrimSuffix(script, "/")
+		// Check for script name (another common proxy header)
+		if script := r.Header.Get("X-Script-Name"); validForwardedPrefix(script) {
+			return strings.TrimSuffix(script, "/")
+		}
 	}
 
 	// Fall back to configured base path
@@ -404,13 +377,53 @@ func (ts *TerminalServer) buildURL(r *http.Request, path string) string {
 func (ts *TerminalServer) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !ts.authConfig.Enabled {
-			next(w, r)
+			ts.serveWithCSRF(w, r, ts.signedCSRFToken("local"), next)
+			return
+		}
+
+		// Scripts authenticate with an API token instead of a session cookie
+		if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			ts.serveWithToken(w, r, strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")), next)
 			return
 		}
 
+		// A trusted reverse proxy may already have authenticated the user
+		if ts.proxyAuth != nil {
+			if username, role, ok := ts.proxyUser(r); ok {
+				ts.serveWithProxyUser(w, r, username, role, next)
+				return
+			}
+			if ts.proxyAuthOnly() {
+				http.Error(w, "Authentication required", http.StatusUnauthorized)
+				return
+			}
+		}
+
 		// Check for session cookie
+		var session *Session
+		var valid bool
 		cookie, err := r.Cookie("snakeflex_session")
-		if err != nil || !ts.sessionManager.ValidateSession(cookie.Value) {
+		if err == nil {
+			session, valid = ts.sessionManager.ValidateSession(cookie.Value)
+			// Accounts removed from the users file lose their sessions, and
+			// single sign-on sessions end when it is turned off
+			switch {
+			case !valid:
+			case session.ClientCert != "":
+				valid = ts.certSessionValid(r, session)
+			case session.Role != "":
+				valid = ts.oidc != nil
+			default:
+				valid = ts.authConfig.Users.Exists(session.Username)
+			}
+		}
+		if !valid {
+			// Scripts presenting a client certificate need no session
+			if username, role, cert, ok := ts.certUser(r); ok && !wantsPage(r) {
+				ts.serveWithCertUser(w, r, username, role, cert, next)
+				return
+			}
+
 			// Redirect to login page using relative path
 			// Construct the path correctly based on whether we are already at the login page
 			currentRequestPath := r.URL.Path
@@ -425,8 +438,33 @@ func (ts *TerminalServer) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		next(w, r)
+		ctx := context.WithValue(r.Context(), userContextKey, session.Username)
+		if session.Role != "" {
+			ctx = context.WithValue(ctx, roleContextKey, session.Role)
+		}
+		if session.ClientCert != "" {
+			ctx = context.WithValue(ctx, externalAuthContextKey, true)
+		}
+		ts.serveWithCSRF(w, r.WithContext(ctx), sessionCSRFToken(cookie.Value), next)
+	}
+}
+
+// Username of the signed-in user, or "" when authentication is disabled
+func currentUser(r *http.Request) string {
+	username, _ := r.Context().Value(userContextKey).(string)
+	return username
+}
+
+// Identity of the user behind a request. Runs, shells and shares are owned by
+// it, so a user finds them again from any browser after reconnecting.
+func (ts *TerminalServer) clientIdentity(r *http.Request) string {
+	if !ts.authConfig.Enabled {
+		return "local"
+	}
+	if username := currentUser(r); username != "" {
+		return username
 	}
+	return "anonymous"
 }
 
 // Login handler
@@ -437,8 +475,21 @@ func (ts *TerminalServer) loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Users sign in at the proxy, there is nothing to sign in to here
+	if ts.proxyAuthOnly() {
+		http.Error(w, "Sign in through the authenticating proxy", http.StatusNotFound)
+		return
+	}
+
 	switch r.Method {
 	case "GET":
+		// A valid client certificate signs the browser in without a password
+		if username, role, cert, ok := ts.certUser(r); ok {
+			ts.audit(r, AuditEvent{Event: AuditLoginSuccess, User: username, Method: "certificate"})
+			ts.startSession(w, r, username, role, clientCertFingerprint(cert))
+			http.Redirect(w, r, ts.buildURL(r, "/"), http.StatusFound)
+			return
+		}
 		ts.serveLoginPage(w, r)
 	case "POST":
 		ts.handleLogin(w, r)
@@ -553,6 +604,17 @@ func (ts *TerminalServer) serveLoginPage(w http.ResponseWriter, r *http.Request)
             color: #7d8590;
             line-height: 1.5;
         }
+        .info-text a { color: #58a6ff; text-decoration: none; }
+        .sso-btn {
+            display: block;
+            text-decoration: none;
+            background: linear-gradient(135deg, #1f6feb, #388bfd);
+        }
+        .login-divider {
+            margin: 20px 0;
+            font-size: 12px;
+            color: #7d8590;
+        }
     </style>
 </head>
 <body>
@@ -563,22 +625,20 @@ func (ts *TerminalServer) serveLoginPage(w http.ResponseWriter, r *http.Request)
         {{ERROR_MESSAGE}}
         
         <form method="POST" action="login">
-            <div class="form-group">
-                <label class="form-label" for="password">Access Password:</label>
-                <input type="password" id="password" name="password" class="form-input" 
-                       placeholder="Enter your password..." required autofocus>
-            </div>
-            <button type="submit" class="login-btn">🔓 Access Terminal</button>
+            <input type="hidden" name="csrf_token" value="{{CSRF_TOKEN}}">
+            {{LOGIN_FIELDS}}
         </form>
         
         <div class="info-text">
-            🔒 This terminal is password protected.<br>
-            Enter the correct password to access the Python environment.
+            {{INFO_TEXT}}
         </div>
     </div>
     
     <script>
-        document.getElementById('password').focus();
+        const usernameInput = document.getElementById('username');
+        if (usernameInput) {
+            (usernameInput.value ? document.getElementById('password') : usernameInput).focus();
+        }
         document.querySelector('form').addEventListener('submit', function(e) {
             const btn = document.querySelector('.login-btn');
             btn.textContent = '🔄 Authenticating...';
@@ -588,13 +648,87 @@ func (ts *TerminalServer) serveLoginPage(w http.ResponseWriter, r *http.Request)
 </body>
 </html>`
 
+	passwordFields := `
+            <div class="form-group">
+                <label class="form-label" for="username">Username:</label>
+                <input type="text" id="username" name="username" class="form-input" 
+                       placeholder="Enter your username..." value="{{USERNAME}}" autocomplete="username" required autofocus>
+            </div>
+            <div class="form-group">
+                <label class="form-label" for="password">Password:</label>
+                <input type="password" id="password" name="password" class="form-input" 
+                       placeholder="Enter your password..." autocomplete="current-password" required>
+            </div>
+            <button type="submit" class="login-btn">🔓 Access Terminal</button>`
+	passwordInfo := `🔒 This terminal is password protected.<br>
+            Sign in with your account to access the Python environment.`
+
+	codeFields := `
+            <input type="hidden" name="step" value="totp">
+            <div class="form-group">
+                <label class="form-label" for="code">Authentication code:</label>
+                <input type="text" id="code" name="code" class="form-input" inputmode="numeric"
+                       placeholder="6-digit code or recovery code" autocomplete="one-time-code" required autofocus>
+            </div>
+            <button type="submit" class="login-btn">🔑 Verify</button>`
+	codeInfo := `📱 Enter the code from your authenticator app, or one of your recovery codes.<br>
+            <a href="login?cancel=1">Sign in as someone else</a>`
+
+	ssoButton := `
+            <a class="login-btn sso-btn" href="login/oidc">🏢 Sign in with single sign-on</a>`
+	if ts.oidc != nil {
+		if len(ts.authConfig.Users.Usernames()) == 0 {
+			passwordFields = ssoButton
+			passwordInfo = `🔒 This terminal is protected by your organization's sign-in.`
+		} else {
+			passwordFields = ssoButton + `
+            <div class="login-divider">or sign in with a password</div>` + passwordFields
+		}
+	}
+
+	// A pending login means the password was right and a code is due
+	codeStep := false
+	if cookie, err := r.Cookie(pendingLoginCookie); err == nil {
+		if r.URL.Query().Get("cancel") == "1" {
+			ts.pendingLogins.Delete(cookie.Value)
+			ts.clearCookie(w, r, pendingLoginCookie)
+		} else {
+			_, codeStep = ts.pendingLogins.Get(cookie.Value)
+		}
+	}
+
 	errorMsg := ""
-	if r.URL.Query().Get("error") == "1" {
-		errorMsg = `<div class="error-message">❌ Invalid password. Please try again.</div>`
+	switch r.URL.Query().Get("error") {
+	case "1":
+		errorMsg = `<div class="error-message">❌ Invalid username or password. Please try again.</div>`
+	case "2":
+		errorMsg = `<div class="error-message">❌ Invalid authentication code. Please try again.</div>`
+	case "3":
+		errorMsg = `<div class="error-message">⌛ Sign-in expired. Please enter your password again.</div>`
+	case "4":
+		errorMsg = `<div class="error-message">❌ Single sign-on failed or this account is not allowed.</div>`
+	case "5":
+		errorMsg = `<div class="error-message">⌛ The sign-in form expired. Please try again.</div>`
+	}
+
+	if codeStep {
+		loginHTML = strings.ReplaceAll(loginHTML, "{{LOGIN_FIELDS}}", codeFields)
+		loginHTML = strings.ReplaceAll(loginHTML, "{{INFO_TEXT}}", codeInfo)
+	} else {
+		loginHTML = strings.ReplaceAll(loginHTML, "{{LOGIN_FIELDS}}", passwordFields)
+		loginHTML = strings.ReplaceAll(loginHTML, "{{INFO_TEXT}}", passwordInfo)
+	}
+
+	// Single-password mode has only one account, so fill it in
+	username := ""
+	if users := ts.authConfig.Users.Usernames(); len(users) == 1 && users[0] == defaultUsername {
+		username = defaultUsername
 	}
 
 	loginHTML = strings.ReplaceAll(loginHTML, "{{ERROR_MESSAGE}}", errorMsg)
+	loginHTML = strings.ReplaceAll(loginHTML, "{{USERNAME}}", username)
 	loginHTML = strings.ReplaceAll(loginHTML, "{{BASE_HREF}}", baseHref)
+	loginHTML = strings.ReplaceAll(loginHTML, "{{CSRF_TOKEN}}", ts.loginCSRFToken(w, r))
 
 	w.Header().Set("Content-Type", "text/html")
 	fmt.Fprint(w, loginHTML)
@@ -613,62 +747,162 @@ func (ts *TerminalServer) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	password := r.FormValue("password")
-	hashedPassword := hashPassword(password)
+	// Another site must not be able to sign the browser in to an account of its choosing
+	if !validLoginCSRF(r) {
+		log.Printf("⛔ Rejected login form from %s without a valid CSRF token", ts.rateLimiter.getClientIP(r))
+		http.Redirect(w, r, ts.buildURL(r, "/login?error=5"), http.StatusFound)
+		return
+	}
 
-	if hashedPassword == ts.authConfig.Password {
-		// Successful login - clear any failed attempts
-		ts.rateLimiter.RecordSuccessfulLogin(r)
+	if r.FormValue("step") == "totp" {
+		ts.handleLoginCode(w, r)
+		return
+	}
 
-		// Create session
-		sessionToken := ts.sessionManager.CreateSession()
+	username := strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
 
-		// Set secure session cookie with appropriate path
-		cookiePath := ts.getBasePath(r)
-		if cookiePath == "" {
-			cookiePath = "/"
-		} else {
-			// Ensure cookie path ends with / for proper subdirectory handling
-			cookiePath = strings.TrimSuffix(cookiePath, "/") + "/"
-		}
+	user, ok := ts.authConfig.Users.Authenticate(username, password)
+	if !ok {
+		ts.audit(r, AuditEvent{Event: AuditLoginFailure, User: username, Method: "password", Reason: "invalid username or password"})
+		ts.rejectLogin(w, r, fmt.Sprintf("❌ Failed authentication attempt for %q", username), "/login?error=1")
+		return
+	}
 
-		cookie := &http.Cookie{
-			Name:     "snakeflex_session",
-			Value:    sessionToken,
-			Path:     cookiePath,
+	// Users with an authenticator still owe a code; failed attempts are only
+	// cleared once that step succeeds too
+	if ts.authConfig.TOTP != nil && ts.authConfig.TOTP.Enabled(user.Username) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     pendingLoginCookie,
+			Value:    ts.pendingLogins.Create(user.Username),
+			Path:     ts.cookiePath(r),
 			HttpOnly: true,
-			Secure:   r.TLS != nil, // Only secure if HTTPS
+			Secure:   ts.secureRequest(r),
 			SameSite: http.SameSiteStrictMode,
-			Expires:  time.Now().Add(24 * time.Hour),
+			Expires:  time.Now().Add(pendingLoginLifetime),
+		})
+		if ts.verbose {
+			log.Printf("🔑 Password accepted for %s from %s, waiting for authentication code", user.Username, ts.rateLimiter.getClientIP(r))
 		}
-		http.SetCookie(w, cookie)
+		http.Redirect(w, r, ts.buildURL(r, "/login"), http.StatusFound)
+		return
+	}
 
-		if ts.verbose {
-			clientIP := ts.rateLimiter.getClientIP(r)
-			log.Printf("✅ Successful authentication from %s (IP: %s)", r.RemoteAddr, clientIP)
+	ts.audit(r, AuditEvent{Event: AuditLoginSuccess, User: user.Username, Method: "password"})
+	ts.completeLogin(w, r, user.Username, "")
+}
+
+// handleLoginCode is the second login step: check the authenticator or
+// recovery code of a login whose password was already accepted
+func (ts *TerminalServer) handleLoginCode(w http.ResponseWriter, r *http.Request) {
+	token := ""
+	if cookie, err := r.Cookie(pendingLoginCookie); err == nil {
+		token = cookie.Value
+	}
+	username, pending := ts.pendingLogins.Get(token)
+	if !pending || ts.authConfig.TOTP == nil || !ts.authConfig.Users.Exists(username) {
+		ts.clearCookie(w, r, pendingLoginCookie)
+		http.Redirect(w, r, ts.buildURL(r, "/login?error=3"), http.StatusFound)
+		return
+	}
+
+	valid, err := ts.authConfig.TOTP.Verify(username, r.FormValue("code"))
+	if err != nil {
+		log.Printf("⚠️  Failed to save TOTP state for %s: %v", username, err)
+	}
+	if !valid {
+		ts.audit(r, AuditEvent{Event: AuditLoginFailure, User: username, Method: "totp", Reason: "invalid authentication code"})
+		if !ts.pendingLogins.Fail(token) {
+			// Too many wrong codes: start over from the password
+			ts.clearCookie(w, r, pendingLoginCookie)
+			ts.rejectLogin(w, r, fmt.Sprintf("❌ Failed authentication code for %q, login abandoned", username), "/login?error=3")
+			return
 		}
+		ts.rejectLogin(w, r, fmt.Sprintf("❌ Failed authentication code for %q", username), "/login?error=2")
+		return
+	}
 
-		homeURL := ts.buildURL(r, "/")
-		http.Redirect(w, r, homeURL, http.StatusFound)
-	} else {
-		// Failed login - record attempt and check for lockout
-		locked, lockDuration := ts.rateLimiter.RecordFailedAttempt(r)
+	ts.pendingLogins.Delete(token)
+	ts.clearCookie(w, r, pendingLoginCookie)
+	ts.audit(r, AuditEvent{Event: AuditLoginSuccess, User: username, Method: "password+totp"})
+	ts.completeLogin(w, r, username, "")
+}
+
+// completeLogin starts a session for a fully authenticated user and sends them to the terminal
+func (ts *TerminalServer) completeLogin(w http.ResponseWriter, r *http.Request, username, role string) {
+	ts.startSession(w, r, username, role, "")
+
+	homeURL := ts.buildURL(r, "/")
+	http.Redirect(w, r, homeURL, http.StatusFound)
+}
+
+// startSession sets the session cookie. role is empty for accounts from the
+// users file and carries the provider-assigned role for single sign-on users.
+// clientCert binds sessions started with a client certificate to it.
+func (ts *TerminalServer) startSession(w http.ResponseWriter, r *http.Request, username, role, clientCert string) {
+	// Successful login - clear any failed attempts
+	ts.rateLimiter.RecordSuccessfulLogin(r)
 
+	// Create session
+	sessionToken, expiry := ts.sessionManager.CreateSession(username, role, clientCert, ts.rateLimiter.getClientIP(r), r.UserAgent())
+
+	cookie := &http.Cookie{
+		Name:     "snakeflex_session",
+		Value:    sessionToken,
+		Path:     ts.cookiePath(r),
+		HttpOnly: true,
+		Secure:   ts.secureRequest(r), // Only secure if HTTPS
+		SameSite: http.SameSiteStrictMode,
+		Expires:  expiry,
+	}
+	http.SetCookie(w, cookie)
+
+	if ts.verbose {
 		clientIP := ts.rateLimiter.getClientIP(r)
-		if locked {
-			if ts.verbose {
-				log.Printf("🔒 IP %s locked for %v after failed authentication from %s",
-					clientIP, lockDuration.Round(time.Second), r.RemoteAddr)
-			}
-			ts.serveBlockedPage(w, r, lockDuration)
-		} else {
-			if ts.verbose {
-				log.Printf("❌ Failed authentication attempt from %s (IP: %s)", r.RemoteAddr, clientIP)
-			}
-			loginURL := ts.buildURL(r, "/login?error=1")
-			http.Redirect(w, r, loginURL, http.StatusFound)
+		log.Printf("✅ Successful authentication for %s from %s (IP: %s)", username, r.RemoteAddr, clientIP)
+	}
+}
+
+// rejectLogin records a failed password or code and either locks the client
+// out or sends it back to the login page
+func (ts *TerminalServer) rejectLogin(w http.ResponseWriter, r *http.Request, logMessage, retryPath string) {
+	// Failed login - record attempt and check for lockout
+	locked, lockDuration := ts.rateLimiter.RecordFailedAttempt(r)
+
+	clientIP := ts.rateLimiter.getClientIP(r)
+	if locked {
+		ts.audit(r, AuditEvent{Event: AuditLoginLockout, Reason: fmt.Sprintf("locked for %v", lockDuration.Round(time.Second))})
+		if ts.verbose {
+			log.Printf("🔒 IP %s locked for %v after failed authentication from %s",
+				clientIP, lockDuration.Round(time.Second), r.RemoteAddr)
 		}
+		ts.serveBlockedPage(w, r, lockDuration)
+		return
+	}
+
+	if ts.verbose {
+		log.Printf("%s from %s (IP: %s)", logMessage, r.RemoteAddr, clientIP)
+	}
+	http.Redirect(w, r, ts.buildURL(r, retryPath), http.StatusFound)
+}
+
+// Path for auth cookies, ending in / so they cover the whole base path
+func (ts *TerminalServer) cookiePath(r *http.Request) string {
+	cookiePath := ts.getBasePath(r)
+	if cookiePath == "" {
+		return "/"
 	}
+	return strings.TrimSuffix(cookiePath, "/") + "/"
+}
+
+func (ts *TerminalServer) clearCookie(w http.ResponseWriter, r *http.Request, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     ts.cookiePath(r),
+		HttpOnly: true,
+		Expires:  time.Unix(0, 0),
+	})
 }
 
 func (ts *TerminalServer) serveBlockedPage(w http.ResponseWriter, r *http.Request, remainingTime time.Duration) {
@@ -836,23 +1070,15 @@ func (ts *TerminalServer) serveBlockedPage(w http.ResponseWriter, r *http.Reques
 
 // Logout handler
 func (ts *TerminalServer) logoutHandler(w http.ResponseWriter, r *http.Request) {
-	// Clear session cookie with appropriate path
-	cookiePath := ts.getBasePath(r)
-	if cookiePath == "" {
-		cookiePath = "/"
-	} else {
-		// Ensure cookie path ends with / for proper subdirectory handling
-		cookiePath = strings.TrimSuffix(cookiePath, "/") + "/"
+	if cookie, err := r.Cookie("snakeflex_session"); err == nil {
+		if session, valid := ts.sessionManager.ValidateSession(cookie.Value); valid {
+			ts.audit(r, AuditEvent{Event: AuditLogout, User: session.Username})
+		}
+		ts.sessionManager.DeleteSession(cookie.Value)
 	}
 
-	cookie := &http.Cookie{
-		Name:     "snakeflex_session",
-		Value:    "",
-		Path:     cookiePath,
-		HttpOnly: true,
-		Expires:  time.Unix(0, 0),
-	}
-	http.SetCookie(w, cookie)
+	// Clear session cookie with appropriate path
+	ts.clearCookie(w, r, "snakeflex_session")
 
 	loginURL := ts.buildURL(r, "/login")
 	http.Redirect(w, r, loginURL, http.StatusFound)
@@ -975,6 +1201,13 @@ func generateMinimalHTML() string {
 }
 
 func main() {
+	// Subcommands such as hash-password run instead of the server
+	if len(os.Args) > 1 {
+		if command, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(command.run(os.Args[2:]))
+		}
+	}
+
 	// Define all command-line flags
 	pythonFile := flag.String("file", "", "Python file to execute (optional)")
 	port := flag.String("port", "8090", "Port to run server on")
@@ -982,8 +1215,58 @@ func main() {
 	htmlFile := flag.String("template", "terminal.html", "HTML template file (will use embedded if not found)")
 	disableFileManager := flag.Bool("disable-file-manager", false, "Disable file management features for security")
 	disableShell := flag.Bool("disable-shell", false, "Disable the interactive shell feature")
+	disablePackages := flag.Bool("disable-packages", false, "Disable the package manager panel")
+	wheelhouse := flag.String("wheelhouse", "", "Install packages only from this directory of wheels instead of PyPI")
 	password := flag.String("pass", "", "Set password for authentication (optional)")
+	passHash := flag.String("pass-hash", "", "argon2id or bcrypt hash of the password (see 'hash-password'; or set "+passHashEnv+")")
+	passHashFile := flag.String("pass-hash-file", "", "File containing the argon2id or bcrypt password hash")
+	usersFile := flag.String("users", "", "JSON users file for multi-user authentication (reloaded on SIGHUP)")
 	basePath := flag.String("base-path", "", "Base path when served behind reverse proxy (e.g., /snakeflex)")
+	shellIdleTimeout := flag.Duration("shell-idle-timeout", 30*time.Minute, "Terminate shell sessions left detached for this long (0 to keep them forever)")
+	runLimitsSpec := flag.String("run-limits", "", "Resource limits of every run, e.g. 'timeout=10m,cpu=60s,memory=512M,files=256,procs=64' (procs needs a --cgroup)")
+	shellLimitsSpec := flag.String("shell-limits", "", "Resource limits of every shell session, in the form of --run-limits")
+	sandbox := flag.Bool("sandbox", false, "Run scripts and shells in Linux namespaces: read-only outside the working directory, no network")
+	sandboxNetwork := flag.Bool("sandbox-network", false, "Let sandboxed scripts and shells use the network")
+	sandboxWritable := flag.String("sandbox-writable", "", "Comma-separated paths sandboxed scripts and shells may also write to")
+	sandboxHide := flag.String("sandbox-hide", "", "Comma-separated paths hidden from sandboxed scripts and shells, besides the auth files, TLS key, recordings and audit log")
+	cgroupPath := flag.String("cgroup", "auto", "cgroup v2 directory delegated for memory and process limits ('auto' for our own, 'off' for rlimits only, without procs)")
+	sessionFile := flag.String("session-file", "", "JSON file that keeps login sessions across restarts (in memory if empty)")
+	sessionLifetime := flag.Duration("session-lifetime", defaultSessionLifetime, "Absolute lifetime of a login session")
+	sessionIdleTimeout := flag.Duration("session-idle-timeout", 0, "End login sessions unused for this long (0 to disable)")
+	totpFile := flag.String("totp-file", "", "JSON file holding TOTP enrollments; enables two-factor authentication")
+	tokenFile := flag.String("token-file", "", "JSON file of API tokens accepted as 'Authorization: Bearer' (see 'token')")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect issuer URL; enables single sign-on")
+	oidcClientID := flag.String("oidc-client-id", "", "OIDC client ID")
+	oidcClientSecret := flag.String("oidc-client-secret", "", "OIDC client secret (or set "+oidcClientSecretEnv+"; omit for a public client)")
+	oidcRedirectURL := flag.String("oidc-redirect-url", "", "OIDC callback URL, ending in /login/oidc/callback (derived from the request if empty)")
+	oidcScopes := flag.String("oidc-scopes", "openid,profile,email", "Comma-separated OIDC scopes to request")
+	oidcAllowedEmails := flag.String("oidc-allowed-emails", "", "Comma-separated emails or @domains allowed to sign in ('*' for everyone)")
+	oidcAllowedGroups := flag.String("oidc-allowed-groups", "", "Comma-separated groups allowed to sign in")
+	oidcGroupsClaim := flag.String("oidc-groups-claim", "groups", "ID token claim listing the user's groups")
+	oidcUsernameClaim := flag.String("oidc-username-claim", "preferred_username", "ID token claim used as username (falls back to email, then sub)")
+	oidcGroupRoles := flag.String("oidc-group-roles", "", "Map groups to roles, e.g. 'admins=admin,devs=editor'")
+	oidcDefaultRole := flag.String("oidc-default-role", "viewer", "Role for allowed users whose groups map to none")
+	authProxyHeader := flag.String("auth-proxy-header", "", "Trust this header from --trusted-proxies to name the signed-in user (e.g. X-Forwarded-User, Remote-User)")
+	authProxyGroupsHeader := flag.String("auth-proxy-groups-header", "", "Header from the proxy listing the user's groups (e.g. X-Forwarded-Groups, Remote-Groups)")
+	authProxyGroupRoles := flag.String("auth-proxy-group-roles", "", "Map proxy groups to roles, e.g. 'admins=admin,devs=editor'")
+	authProxyDefaultRole := flag.String("auth-proxy-default-role", "viewer", "Role for proxy users not in the users file whose groups map to none")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated addresses or CIDRs of reverse proxies whose forwarding headers are trusted (none by default)")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file; serves HTTPS (reloaded on SIGHUP or when the file changes)")
+	tlsKey := flag.String("tls-key", "", "PEM private key file for --tls-cert")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "Serve HTTPS with a self-signed certificate, written to --tls-cert/--tls-key if given and missing")
+	httpRedirectPort := flag.String("http-redirect-port", "", "Also listen for plain HTTP on this port and redirect it to HTTPS")
+	clientCA := flag.String("client-ca", "", "PEM bundle of CAs whose client certificates sign users in (requires TLS)")
+	clientCertMode := flag.String("client-cert-mode", "optional", "Client certificates are 'optional' (passwords still work) or 'required'")
+	clientCertUsername := flag.String("client-cert-username", "cn", "Certificate field used as username: cn, email or dns (first SAN of that type)")
+	clientCertDefaultRole := flag.String("client-cert-default-role", "viewer", "Role for certificate users not in the users file")
+	auditLogPath := flag.String("audit-log", "", "Append a JSON-lines audit log of logins, file changes, runs and shells to this file")
+	auditLogMaxSize := flag.Int64("audit-log-max-size", 100, "Rotate the audit log when it reaches this many megabytes (0 to never rotate)")
+	auditLogMaxFiles := flag.Int("audit-log-max-files", 10, "Number of rotated audit log files to keep")
+	interpreterFile := flag.String("interpreters-file", defaultInterpreterFile, "JSON file of the Python interpreter chosen per folder (relative to the working directory)")
+	runConfigFile := flag.String("run-configs", defaultRunConfigFile, "JSON file of saved run configurations (relative to the working directory)")
+	recordDir := flag.String("record-dir", "", "Record every shell session and PTY run to asciicast v2 files in this directory")
+	allowedOrigins := flag.String("allowed-origins", "", "Comma-separated origins besides our own allowed to open WebSockets (e.g. https://ide.example.com, '*' for any)")
+	flag.Usage = usage
 	flag.Parse()
 
 	workingDir, err := os.Getwd()
@@ -1012,50 +1295,370 @@ func main() {
 	}
 
 	// Initialize authentication
+	passwordHash, err := loadPasswordHash(*passHash, *passHashFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
 	authConfig := &AuthConfig{
-		Enabled: *password != "",
+		Enabled: *password != "" || passwordHash != "" || *usersFile != "" || *oidcIssuer != "" || *authProxyHeader != "" || *clientCA != "",
 	}
 
-	if authConfig.Enabled {
-		authConfig.Password = hashPassword(*password)
-		fmt.Printf("🔒 Password authentication enabled\n")
+	switch {
+	case *password != "" && passwordHash != "":
+		fmt.Printf("Error: use either --pass or a password hash, not both\n")
+		os.Exit(1)
+	case *usersFile != "" && (*password != "" || passwordHash != ""):
+		fmt.Printf("Error: --users cannot be combined with a single password\n")
+		os.Exit(1)
+	case *usersFile != "":
+		users, err := LoadUserStore(*usersFile)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		authConfig.Users = users
+		fmt.Printf("👥 Multi-user authentication enabled (%d users from %s)\n", len(users.Usernames()), *usersFile)
+		watchReloadSignal(func() {
+			if err := users.Reload(); err != nil {
+				log.Printf("⚠️ Keeping previous users, reload failed: %v", err)
+				return
+			}
+			log.Printf("🔄 Reloaded %d users from %s", len(users.Usernames()), *usersFile)
+		})
+	case *password != "" || passwordHash != "":
+		if *password != "" {
+			fmt.Printf("⚠️ --pass is visible to other local users in the process list; prefer --pass-hash-file or %s\n", passHashEnv)
+			if passwordHash, err = generatePasswordHash(*password); err != nil {
+				fmt.Printf("Error hashing password: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		users, err := NewSingleUserStore(passwordHash)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		authConfig.Users = users
+		fmt.Printf("🔒 Password authentication enabled (username: %s)\n", defaultUsername)
 	}
 
-	// Clean and validate base path
-	cleanBasePath := strings.TrimSuffix(*basePath, "/")
-	if cleanBasePath != "" && !strings.HasPrefix(cleanBasePath, "/") {
-		cleanBasePath = "/" + cleanBasePath
-	}
+	var oidcProvider *OIDCProvider
+	if *oidcIssuer != "" {
+		groupRoles, err := parseGroupRoles(*oidcGroupRoles)
+		if err != nil {
+			fmt.Printf("Error: --oidc-group-roles: %v\n", err)
+			os.Exit(1)
+		}
+		config := OIDCConfig{
+			Issuer:        *oidcIssuer,
+			ClientID:      *oidcClientID,
+			ClientSecret:  *oidcClientSecret,
+			RedirectURL:   *oidcRedirectURL,
+			Scopes:        splitList(*oidcScopes),
+			AllowedEmails: splitList(*oidcAllowedEmails),
+			AllowedGroups: splitList(*oidcAllowedGroups),
+			GroupsClaim:   *oidcGroupsClaim,
+			UsernameClaim: *oidcUsernameClaim,
+			GroupRoles:    groupRoles,
+			DefaultRole:   *oidcDefaultRole,
+		}
+		if config.ClientSecret == "" {
+			config.ClientSecret = os.Getenv(oidcClientSecretEnv)
+		}
+		switch {
+		case config.ClientID == "":
+			fmt.Printf("Error: --oidc-issuer requires --oidc-client-id\n")
+			os.Exit(1)
+		case len(config.AllowedEmails) == 0 && len(config.AllowedGroups) == 0:
+			fmt.Printf("Error: set --oidc-allowed-emails or --oidc-allowed-groups (use '*' to allow every account at the provider)\n")
+			os.Exit(1)
+		case !validRole(config.DefaultRole):
+			fmt.Printf("Error: unknown --oidc-default-role %q (expected one of %s)\n", config.DefaultRole, strings.Join(roleNames(), ", "))
+			os.Exit(1)
+		case !containsPermission(config.Scopes, "openid"):
+			config.Scopes = append([]string{"openid"}, config.Scopes...)
+		}
 
-	server := &TerminalServer{
-		pythonFile:         *pythonFile,
-		verbose:            *verbose,
-		pythonCmd:          pythonCmd,
-		workingDir:         workingDir,
-		fileManagerEnabled: !*disableFileManager,
-		shellEnabled:       !*disableShell,
-		authConfig:         authConfig,
-		sessionManager:     NewSessionManager(),
-		rateLimiter:        NewRateLimiter(),
-		basePath:           cleanBasePath,
+		// Without a users file or password everyone signs in through the provider
+		if authConfig.Users == nil {
+			authConfig.Users = &UserStore{users: make(map[string]*User)}
+		}
+		oidcProvider = NewOIDCProvider(config)
+		if _, err := oidcProvider.Discover(); err != nil {
+			fmt.Printf("⚠️ %v (retrying on first sign-in)\n", err)
+		}
+		fmt.Printf("🏢 Single sign-on enabled with %s\n", config.Issuer)
 	}
 
-	// Setup routes with authentication and the base path prefix
-	http.HandleFunc(cleanBasePath+"/login", server.loginHandler)
-	http.HandleFunc(cleanBasePath+"/logout", server.logoutHandler)
-	http.HandleFunc(cleanBasePath+"/ws", server.requireAuth(server.websocketHandler))
-
-	if server.shellEnabled {
-		http.HandleFunc(cleanBasePath+"/ws-shell", server.requireAuth(server.shellWebsocketHandler))
+	proxies, err := parseTrustedProxies(*trustedProxies)
+	if err != nil {
+		fmt.Printf("Error: --trusted-proxies: %v\n", err)
+		os.Exit(1)
+	}
+	var proxyAuth *ProxyAuth
+	if *authProxyHeader != "" {
+		groupRoles, err := parseGroupRoles(*authProxyGroupRoles)
+		if err != nil {
+			fmt.Printf("Error: --auth-proxy-group-roles: %v\n", err)
+			os.Exit(1)
+		}
+		if !validRole(*authProxyDefaultRole) {
+			fmt.Printf("Error: unknown --auth-proxy-default-role %q (expected one of %s)\n", *authProxyDefaultRole, strings.Join(roleNames(), ", "))
+			os.Exit(1)
+		}
+		if len(proxies) == 0 {
+			fmt.Printf("Error: --auth-proxy-header requires --trusted-proxies naming the proxy's addresses\n")
+			os.Exit(1)
+		}
+		proxyAuth = &ProxyAuth{
+			Header:       http.CanonicalHeaderKey(*authProxyHeader),
+			GroupsHeader: http.CanonicalHeaderKey(*authProxyGroupsHeader),
+			GroupRoles:   groupRoles,
+			DefaultRole:  *authProxyDefaultRole,
+		}
+		if authConfig.Users == nil {
+			authConfig.Users = &UserStore{users: make(map[string]*User)}
+		}
+		fmt.Printf("🛡️ Proxy authentication enabled (%s from %s)\n", proxyAuth.Header, *trustedProxies)
+	}
+
+	var clientCertAuth *ClientCertAuth
+	var clientCAs *x509.CertPool
+	if *clientCA != "" {
+		switch {
+		case *clientCertMode != "optional" && *clientCertMode != "required":
+			fmt.Printf("Error: --client-cert-mode must be 'optional' or 'required'\n")
+			os.Exit(1)
+		case !containsPermission(clientCertSources, *clientCertUsername):
+			fmt.Printf("Error: --client-cert-username must be one of %s\n", strings.Join(clientCertSources, ", "))
+			os.Exit(1)
+		case !validRole(*clientCertDefaultRole):
+			fmt.Printf("Error: unknown --client-cert-default-role %q (expected one of %s)\n", *clientCertDefaultRole, strings.Join(roleNames(), ", "))
+			os.Exit(1)
+		}
+		if clientCAs, err = loadClientCAs(*clientCA); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		clientCertAuth = &ClientCertAuth{Source: *clientCertUsername, DefaultRole: *clientCertDefaultRole}
+		if authConfig.Users == nil {
+			authConfig.Users = &UserStore{users: make(map[string]*User)}
+		}
+		fmt.Printf("🪪 Client certificate authentication enabled (%s, username from %s)\n", *clientCertMode, *clientCertUsername)
+	}
+
+	// Two-factor codes and API tokens belong to accounts that sign in here;
+	// single sign-on, proxy and certificate users are authenticated elsewhere
+	localAccounts := *password != "" || passwordHash != "" || *usersFile != ""
+	if *totpFile != "" {
+		if !localAccounts {
+			fmt.Printf("Error: --totp-file requires local accounts (--pass, a password hash or --users)\n")
+			os.Exit(1)
+		}
+		totpStore, err := LoadTOTPStore(*totpFile)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		authConfig.TOTP = totpStore
+	}
+
+	if *tokenFile != "" {
+		if !localAccounts {
+			fmt.Printf("Error: --token-file requires local accounts for tokens to act as (--pass, a password hash or --users)\n")
+			os.Exit(1)
+		}
+		tokenStore, err := LoadTokenStore(*tokenFile)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		authConfig.Tokens = tokenStore
+	}
+
+	if *sessionLifetime <= 0 {
+		fmt.Printf("Error: --session-lifetime must be positive\n")
+		os.Exit(1)
+	}
+	var sessionStore SessionStore = NewMemorySessionStore()
+	if *sessionFile != "" {
+		fileStore, err := NewFileSessionStore(*sessionFile)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		sessionStore = fileStore
+	}
+
+	var auditLog *AuditLog
+	if *auditLogPath != "" {
+		if auditLog, err = OpenAuditLog(*auditLogPath, *auditLogMaxSize<<20, *auditLogMaxFiles); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("📜 Audit log: %s\n", *auditLogPath)
+	}
+
+	var recordings *RecordingStore
+	if *recordDir != "" {
+		if recordings, err = NewRecordingStore(*recordDir); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("🎬 Recording terminal sessions to: %s\n", *recordDir)
+	}
+
+	runConfigs, err := LoadRunConfigStore(*runConfigFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	interpreters, err := NewInterpreterManager(workingDir, pythonCmd, *interpreterFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	var wheelhouseDir string
+	if *wheelhouse != "" {
+		wheelhouseDir, err = filepath.Abs(*wheelhouse)
+		if err == nil {
+			var info os.FileInfo
+			if info, err = os.Stat(wheelhouseDir); err == nil && !info.IsDir() {
+				err = fmt.Errorf("not a directory")
+			}
+		}
+		if err != nil {
+			fmt.Printf("Error: --wheelhouse %s: %v\n", *wheelhouse, err)
+			os.Exit(1)
+		}
+	}
+
+	runLimits, err := parseResourceLimits(*runLimitsSpec)
+	if err != nil {
+		fmt.Printf("Error: --run-limits: %v\n", err)
+		os.Exit(1)
+	}
+	shellLimits, err := parseResourceLimits(*shellLimitsSpec)
+	if err != nil {
+		fmt.Printf("Error: --shell-limits: %v\n", err)
+		os.Exit(1)
+	}
+	for _, limits := range []ResourceLimits{runLimits, shellLimits} {
+		limits.Timeout = 0
+		if err := checkLimitSupport(limits); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	var cgroups *CgroupManager
+	if (runLimits.Memory > 0 || runLimits.Procs > 0 || shellLimits.Memory > 0 || shellLimits.Procs > 0) && *cgroupPath != "off" {
+		cgroups, err = setupCgroups(*cgroupPath)
+		if err != nil {
+			if *cgroupPath != "auto" {
+				fmt.Printf("Error: --cgroup %s: %v\n", *cgroupPath, err)
+				os.Exit(1)
+			}
+			fmt.Printf("ℹ️ No cgroup v2 delegation (%v); memory limits the address space\n", err)
+		}
+	}
+	if cgroups == nil && (runLimits.Procs > 0 || shellLimits.Procs > 0) {
+		// The process rlimit counts everything the server's user runs, not one run
+		fmt.Printf("Error: the %s limit needs a delegated cgroup v2 group (--cgroup)\n", LimitProcs)
+		os.Exit(1)
+	}
+
+	var sandboxed *Sandbox
+	if *sandbox {
+		// Scripts must not read the files that let someone sign in as another user,
+		// nor what other users did and typed
+		secrets := []string{*usersFile, *passHashFile, *sessionFile, *totpFile, *tokenFile, *tlsKey, *recordDir}
+		if *auditLogPath != "" {
+			secrets = append(secrets, auditLogFiles(*auditLogPath, *auditLogMaxFiles)...)
+		}
+		sandboxed, err = NewSandbox(workingDir, splitList(*sandboxWritable), splitList(*sandboxHide), secrets, *sandboxNetwork)
+		if err != nil {
+			fmt.Printf("Error: --sandbox: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Clean and validate base path
+	cleanBasePath := strings.TrimSuffix(*basePath, "/")
+	if cleanBasePath != "" && !strings.HasPrefix(cleanBasePath, "/") {
+		cleanBasePath = "/" + cleanBasePath
+	}
+
+	server := &TerminalServer{
+		pythonFile:         *pythonFile,
+		verbose:            *verbose,
+		pythonCmd:          pythonCmd,
+		workingDir:         workingDir,
+		fileManagerEnabled: !*disableFileManager,
+		shellEnabled:       !*disableShell,
+		packagesEnabled:    !*disablePackages,
+		wheelhouse:         wheelhouseDir,
+		authConfig:         authConfig,
+		sessionManager:     NewSessionManager(sessionStore, *sessionLifetime, *sessionIdleTimeout),
+		pendingLogins:      NewPendingLogins(),
+		oidc:               oidcProvider,
+		proxyAuth:          proxyAuth,
+		clientCertAuth:     clientCertAuth,
+		trustedProxies:     proxies,
+		allowedOrigins:     parseAllowedOrigins(*allowedOrigins),
+		csrfKey:            newCSRFKey(),
+		rateLimiter:        NewRateLimiter(proxies),
+		runRegistry:        NewRunRegistry(),
+		shellManager:       NewShellManager(*shellIdleTimeout, *verbose, auditLog, recordings, shellLimits, cgroups, sandboxed),
+		auditLog:           auditLog,
+		recordings:         recordings,
+		runLimits:          runLimits,
+		cgroups:            cgroups,
+		sandbox:            sandboxed,
+		runConfigs:         runConfigs,
+		interpreters:       interpreters,
+		basePath:           cleanBasePath,
+	}
+	upgrader.CheckOrigin = server.checkOrigin
+
+	// Setup routes with authentication and the base path prefix
+	http.HandleFunc(cleanBasePath+"/login", server.loginHandler)
+	http.HandleFunc(cleanBasePath+"/logout", server.logoutHandler)
+	if server.oidc != nil {
+		http.HandleFunc(cleanBasePath+"/login/oidc", server.oidcLoginHandler)
+		http.HandleFunc(cleanBasePath+"/login/oidc/callback", server.oidcCallbackHandler)
+	}
+	http.HandleFunc(cleanBasePath+"/ws", server.requireAuth(server.websocketHandler))
+	http.HandleFunc(cleanBasePath+"/api/shares", server.requireAuth(server.sharesHandler))
+	http.HandleFunc(cleanBasePath+"/api/run-configs", server.requireAuth(server.requirePermission(PermRun, server.runConfigsHandler)))
+	http.HandleFunc(cleanBasePath+"/api/interpreters", server.requireAuth(server.requirePermission(PermRun, server.interpretersHandler)))
+	http.HandleFunc(cleanBasePath+"/api/account/totp", server.requireAuth(server.accountTOTPHandler))
+	http.HandleFunc(cleanBasePath+"/api/admin/sessions", server.requireAuth(server.requirePermission(PermAdmin, server.adminSessionsHandler)))
+	http.HandleFunc(cleanBasePath+"/api/admin/tokens", server.requireAuth(server.requirePermission(PermAdmin, server.adminTokensHandler)))
+	if recordings != nil {
+		http.HandleFunc(cleanBasePath+"/api/recordings", server.requireAuth(server.recordingsHandler))
+	}
+
+	if server.shellEnabled {
+		http.HandleFunc(cleanBasePath+"/ws-shell", server.requireAuth(server.requirePermission(PermShell, server.shellWebsocketHandler)))
+		http.HandleFunc(cleanBasePath+"/api/shells", server.requireAuth(server.requirePermission(PermShell, server.shellsHandler)))
+	}
+
+	if server.packagesEnabled {
+		// Listing needs run; installs and uninstalls change the interpreter for
+		// everyone and check for shell (denyPackageChanges), requirements
+		// files for files:write
+		http.HandleFunc(cleanBasePath+"/api/packages", server.requireAuth(server.requirePermission(PermRun, server.packagesHandler)))
+		http.HandleFunc(cleanBasePath+"/api/packages/requirements", server.requireAuth(server.requirePermission(PermRun, server.requirementsHandler)))
 	}
 
 	if server.fileManagerEnabled {
-		http.HandleFunc(cleanBasePath+"/api/files", server.requireAuth(server.filesHandler))
-		http.HandleFunc(cleanBasePath+"/api/files/content", server.requireAuth(server.fileContentHandler))
-		http.HandleFunc(cleanBasePath+"/api/files/download", server.requireAuth(server.downloadHandler))
-		http.HandleFunc(cleanBasePath+"/api/files/upload", server.requireAuth(server.uploadHandler))
-		http.HandleFunc(cleanBasePath+"/api/files/create", server.requireAuth(server.createHandler))
-		http.HandleFunc(cleanBasePath+"/api/files/delete", server.requireAuth(server.deleteHandler))
+		http.HandleFunc(cleanBasePath+"/api/files", server.requireAuth(server.requirePermission(PermFilesRead, server.filesHandler)))
+		http.HandleFunc(cleanBasePath+"/api/files/content", server.requireAuth(server.requirePermission(PermFilesRead, server.fileContentHandler)))
+		http.HandleFunc(cleanBasePath+"/api/files/download", server.requireAuth(server.requirePermission(PermFilesRead, server.downloadHandler)))
+		http.HandleFunc(cleanBasePath+"/api/files/upload", server.requireAuth(server.requirePermission(PermFilesWrite, server.uploadHandler)))
+		http.HandleFunc(cleanBasePath+"/api/files/create", server.requireAuth(server.requirePermission(PermFilesWrite, server.createHandler)))
+		http.HandleFunc(cleanBasePath+"/api/files/delete", server.requireAuth(server.requirePermission(PermFilesWrite, server.deleteHandler)))
 	}
 
 	// The root handler must be last to avoid capturing other routes.
@@ -1070,12 +1673,76 @@ func main() {
 		server.terminalHandler(w, r, *htmlFile)
 	}))
 
+	// Set up TLS before announcing anything, so certificate problems stop startup
+	var tlsConfig *tls.Config
+	switch {
+	case (*tlsCert == "") != (*tlsKey == ""):
+		fmt.Printf("Error: --tls-cert and --tls-key must be given together\n")
+		os.Exit(1)
+	case *tlsSelfSigned && *tlsCert == "":
+		certPEM, keyPEM, err := generateSelfSigned()
+		if err == nil {
+			var cert tls.Certificate
+			if cert, err = tls.X509KeyPair(certPEM, keyPEM); err == nil {
+				tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+				fmt.Printf("🔏 Generated a temporary self-signed certificate (SHA-256 %s)\n", certFingerprint(&cert))
+			}
+		}
+		if err != nil {
+			fmt.Printf("Error: generating self-signed certificate: %v\n", err)
+			os.Exit(1)
+		}
+	case *tlsCert != "":
+		if *tlsSelfSigned {
+			created, err := ensureSelfSigned(*tlsCert, *tlsKey)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			if created {
+				fmt.Printf("🔏 Wrote a self-signed certificate to %s\n", *tlsCert)
+			}
+		}
+		certs, err := NewCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		watchReloadSignal(certs.reloadAndLog)
+		tlsConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+		if *tlsSelfSigned {
+			cert, _ := certs.GetCertificate(nil)
+			fmt.Printf("🔏 Self-signed certificate SHA-256 %s\n", certFingerprint(cert))
+		}
+	}
+	switch {
+	case tlsConfig != nil:
+		tlsConfig.MinVersion = tls.VersionTLS12
+		if clientCAs != nil {
+			tlsConfig.ClientCAs = clientCAs
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			if *clientCertMode == "required" {
+				tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+	case *httpRedirectPort != "":
+		fmt.Printf("Error: --http-redirect-port requires --tls-cert/--tls-key or --tls-self-signed\n")
+		os.Exit(1)
+	case *clientCA != "":
+		fmt.Printf("Error: --client-ca requires --tls-cert/--tls-key or --tls-self-signed\n")
+		os.Exit(1)
+	}
+
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
 	serverPort := ":" + *port
 	if cleanBasePath != "" {
-		fmt.Printf("🐍 Python Web Terminal started at http://localhost%s%s/\n", serverPort, cleanBasePath)
+		fmt.Printf("🐍 Python Web Terminal started at %s://localhost%s%s/\n", scheme, serverPort, cleanBasePath)
 		fmt.Printf("🔗 Base path configured: %s\n", cleanBasePath)
 	} else {
-		fmt.Printf("🐍 Python Web Terminal started at http://localhost%s/\n", serverPort)
+		fmt.Printf("🐍 Python Web Terminal started at %s://localhost%s/\n", scheme, serverPort)
 	}
 	fmt.Printf("📁 Working Directory: %s\n", workingDir)
 	if *pythonFile != "" {
@@ -1094,93 +1761,604 @@ func main() {
 
 	if server.shellEnabled {
 		fmt.Println("⌨️ Interactive shell enabled")
+		if *shellIdleTimeout > 0 {
+			fmt.Printf("⏳ Detached shell sessions are closed after %v\n", *shellIdleTimeout)
+		}
+		if !shellLimits.IsZero() {
+			fmt.Printf("⏱️ Shell sessions limited to %s\n", shellLimits)
+		}
 	} else {
 		fmt.Println("🔒 Interactive shell has been disabled via command-line flag.")
 	}
 
+	if !runLimits.IsZero() {
+		fmt.Printf("⏱️ Runs limited to %s\n", runLimits)
+	}
+	if sandboxed != nil {
+		fmt.Printf("🧪 Scripts and shells run sandboxed: %s\n", sandboxed)
+		for _, path := range sandboxed.exposed {
+			if *auditLogPath != "" && slices.Contains(auditLogFiles(*auditLogPath, *auditLogMaxFiles)[1:], path) {
+				continue // the audit log's own warning covers its rotated files
+			}
+			fmt.Printf("⚠️ %s shares its folder, so sandboxes already running may see it again once it is saved; give it a folder of its own\n", path)
+		}
+	}
+	if cgroups != nil {
+		fmt.Printf("🧱 Memory and process limits enforced with cgroups under %s\n", cgroups.base)
+	}
+
+	switch {
+	case !server.packagesEnabled:
+		fmt.Println("🔒 Package manager disabled")
+	case !server.shellEnabled:
+		fmt.Println("📦 Package manager is read-only because the shell is disabled")
+	case server.wheelhouse != "":
+		fmt.Printf("📦 Packages are installed only from %s\n", server.wheelhouse)
+	}
+
 	if authConfig.Enabled {
-		fmt.Printf("🔐 Access the terminal at: http://localhost%s%s/login\n", serverPort, cleanBasePath)
+		fmt.Printf("🔐 Access the terminal at: %s://localhost%s%s/login\n", scheme, serverPort, cleanBasePath)
 		fmt.Printf("🛡️ Rate limiting enabled: 3+ failed attempts = 1min lockout\n")
+		if *sessionFile != "" {
+			fmt.Printf("💾 Login sessions persisted to %s\n", *sessionFile)
+		}
+		if authConfig.TOTP != nil {
+			fmt.Printf("📱 Two-factor authentication available (enrollments in %s)\n", *totpFile)
+		}
+		if authConfig.Tokens != nil {
+			fmt.Printf("🔑 API tokens accepted from %s\n", *tokenFile)
+		}
+		if *sessionIdleTimeout > 0 {
+			fmt.Printf("⏳ Login sessions last %v, or %v without activity\n", *sessionLifetime, *sessionIdleTimeout)
+		} else {
+			fmt.Printf("⏳ Login sessions last %v\n", *sessionLifetime)
+		}
 	}
 
-	if err := http.ListenAndServe(serverPort, nil); err != nil {
-		log.Fatal("Error starting server:", err)
+	if tlsConfig == nil {
+		if err := http.ListenAndServe(serverPort, nil); err != nil {
+			log.Fatal("Error starting server:", err)
+		}
+		return
 	}
-}
 
-func (ts *TerminalServer) shellWebsocketHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("Shell WebSocket upgrade error: %v", err)
-		return
+	if *httpRedirectPort != "" {
+		fmt.Printf("↪️ Redirecting http://localhost:%s to HTTPS\n", *httpRedirectPort)
+		go func() {
+			if err := http.ListenAndServe(":"+*httpRedirectPort, httpsRedirectHandler(*port)); err != nil {
+				log.Fatal("Error starting HTTP redirect server:", err)
+			}
+		}()
+	}
+	httpsServer := &http.Server{Addr: serverPort, TLSConfig: tlsConfig}
+	if err := httpsServer.ListenAndServeTLS("", ""); err != nil {
+		log.Fatal("Error starting server:", err)
 	}
-	defer conn.Close()
+}
 
-	var shellCmd string
+// Build the interactive shell command for this platform, with the Python
+// environment activated
+func (ts *TerminalServer) newShellCommand(interp Interpreter) *exec.Cmd {
+	shell := []string{"bash"}
 	if runtime.GOOS == "windows" {
-		shellCmd = "powershell.exe"
-	} else {
-		shellCmd = "bash"
+		shell = []string{"powershell.exe"}
+	} else if interp.Root != "" {
+		// ~/.bashrc may put another Python first on PATH, so ours is added again after it
+		if rcFile, err := activationRCFile(); err == nil {
+			shell = append(shell, "--rcfile", rcFile)
+		} else {
+			log.Printf("⚠️ Shell startup files may hide %s: %v", interp.Name, err)
+		}
 	}
 
-	cmd := exec.Command(shellCmd)
+	cmd := exec.Command(shell[0], shell[1:]...)
 	cmd.Dir = ts.workingDir
-	cmd.Env = os.Environ()
+	cmd.Env = interp.activate(os.Environ())
+	if interp.Root != "" {
+		cmd.Env = append(cmd.Env, "SNAKEFLEX_ENV_BIN="+interp.binDir(), "SNAKEFLEX_ENV_NAME="+filepath.Base(interp.Root))
+	}
+	return cmd
+}
 
-	ptmx, err := pty.Start(cmd)
+// startShell creates a shell session with the requested interpreter, or the
+// one chosen for the project root
+func (ts *TerminalServer) startShell(owner, name, interpreter string) (*ShellSession, error) {
+	interp, err := ts.interpreters.Resolve("", interpreter)
+	if err != nil {
+		return nil, err
+	}
+	return ts.shellManager.Create(owner, name, interp.ID, ts.newShellCommand(interp))
+}
+
+// shellWebsocketHandler attaches the socket to a named shell session, creating
+// it if needed. Closing the socket only detaches; the shell keeps running.
+func (ts *TerminalServer) shellWebsocketHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("Failed to start pty: %v", err)
-		conn.WriteMessage(websocket.TextMessage, []byte("Error: Failed to start shell."))
+		log.Printf("Shell WebSocket upgrade error: %v", err)
 		return
 	}
-	defer ptmx.Close()
 
-	go func() {
-		defer conn.Close()
-		buf := make([]byte, 1024)
-		for {
-			n, err := ptmx.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("Error reading from pty: %v", err)
-				}
-				break
-			}
-			err = conn.WriteMessage(websocket.BinaryMessage, buf[:n])
+	identity := ts.clientIdentity(r)
+	client := NewShellClient(conn, identity)
+	defer client.Close()
+
+	var session *ShellSession
+	if id := r.URL.Query().Get("id"); id != "" {
+		// Attaching by ID also reaches shells other users have shared
+		session, err = ts.shellManager.Lookup(identity, id)
+		if err != nil {
+			client.SendControl(ShellMessage{Type: "error", Data: err.Error()})
+			return
+		}
+	} else {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = "default"
+		}
+		session = ts.shellManager.FindByName(identity, name)
+		if session == nil {
+			session, err = ts.startShell(identity, name, r.URL.Query().Get("interpreter"))
 			if err != nil {
-				log.Printf("Error writing to shell websocket: %v", err)
-				break
+				log.Printf("Failed to start pty: %v", err)
+				client.SendControl(ShellMessage{Type: "error", Data: "Failed to start shell: " + err.Error()})
+				return
 			}
 		}
+	}
+	session.Attach(client)
+	defer func() {
+		if session != nil {
+			session.Detach(client)
+		}
 	}()
 
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("Error reading from shell websocket: %v", err)
+			if ts.verbose {
+				log.Printf("Shell WebSocket closed: %v", err)
+			}
 			break
 		}
 
 		var msg ShellMessage
-		if err := json.Unmarshal(message, &msg); err == nil {
-			switch msg.Type {
-			case "resize":
-				if ts.verbose {
-					log.Printf("Resizing PTY to %v rows and %v cols", msg.Rows, msg.Cols)
+		if err := json.Unmarshal(message, &msg); err != nil {
+			continue
+		}
+
+		switch msg.Type {
+		case "resize":
+			if ts.verbose {
+				log.Printf("Resizing PTY to %v rows and %v cols", msg.Rows, msg.Cols)
+			}
+			if session != nil && session.CanWrite(identity) {
+				session.Resize(uint16(msg.Rows), uint16(msg.Cols))
+			}
+		case "input":
+			if session == nil || !session.CanWrite(identity) {
+				continue
+			}
+			if err := session.Write([]byte(msg.Data)); err != nil {
+				log.Printf("Error writing to pty: %v", err)
+			}
+		case "list":
+			client.SendControl(ShellMessage{Type: "sessions", Sessions: ts.shellManager.List(identity)})
+		case "attach":
+			target := ts.shellManager.FindByName(identity, msg.Name)
+			if msg.ID != "" {
+				target, _ = ts.shellManager.Lookup(identity, msg.ID)
+			}
+			if target == nil && msg.Name != "" {
+				target, err = ts.startShell(identity, msg.Name, msg.Interpreter)
+				if err != nil {
+					log.Printf("Failed to start pty: %v", err)
 				}
-				pty.Setsize(ptmx, &pty.Winsize{
-					Rows: uint16(msg.Rows),
-					Cols: uint16(msg.Cols),
+			}
+			if target == nil {
+				client.SendControl(ShellMessage{Type: "error", Data: "Shell session not found"})
+				continue
+			}
+			if session != nil {
+				session.Detach(client)
+			}
+			session = target
+			session.Attach(client)
+		case "detach":
+			if session != nil {
+				session.Detach(client)
+				client.SendControl(ShellMessage{Type: "detached", ID: session.ID, Name: session.Name})
+				session = nil
+			}
+		case "terminate":
+			target := session
+			if msg.ID != "" {
+				target, _ = ts.shellManager.Get(identity, msg.ID)
+			}
+			// Only the owner may end a shell, even if others can type into it
+			if target != nil && target.Owner == identity {
+				target.Terminate()
+			}
+		}
+	}
+}
+
+// shellsHandler lists (GET), creates (POST), renames (PATCH/PUT) and closes (DELETE ?id=) shell sessions
+func (ts *TerminalServer) shellsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ts.shellEnabled {
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Interactive shell disabled"})
+		return
+	}
+	owner := ts.clientIdentity(r)
+
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Data: ts.shellManager.List(owner)})
+	case "POST":
+		var req struct {
+			Name        string `json:"name"`
+			Interpreter string `json:"interpreter"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Invalid request body"})
+				return
+			}
+		}
+		session, err := ts.startShell(owner, strings.TrimSpace(req.Name), req.Interpreter)
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Shell created", Data: session.Info()})
+	case "PATCH", "PUT":
+		var req struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Invalid request body"})
+			return
+		}
+		session, err := ts.shellManager.Rename(owner, req.ID, strings.TrimSpace(req.Name))
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Shell renamed", Data: session.Info()})
+	case "DELETE":
+		session, err := ts.shellManager.Get(owner, r.URL.Query().Get("id"))
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		session.Terminate()
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Shell closed"})
+	default:
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Method not allowed"})
+	}
+}
+
+// sharesHandler lists (GET) the caller's shells and runs plus those shared by
+// others, and lets an owner share, unshare, grant or revoke input rights (POST)
+func (ts *TerminalServer) sharesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	identity := ts.clientIdentity(r)
+
+	switch r.Method {
+	case "GET":
+		items := []SharedItem{}
+		if ts.shellEnabled && ts.hasPermission(r, PermShell) {
+			for _, session := range ts.shellManager.Visible(identity) {
+				items = append(items, SharedItem{
+					Kind:     "shell",
+					ID:       session.ID,
+					Name:     session.Info().Name,
+					Owner:    session.Owner,
+					Shared:   session.share.Shared(),
+					Writers:  session.share.Writers(),
+					Viewers:  session.Viewers(),
+					CanWrite: session.CanWrite(identity),
 				})
-			case "input":
-				if _, err := ptmx.Write([]byte(msg.Data)); err != nil {
-					log.Printf("Error writing to pty: %v", err)
-					break
-				}
 			}
 		}
+		for _, run := range ts.runRegistry.Visible(identity) {
+			items = append(items, SharedItem{
+				Kind:     "run",
+				ID:       run.ID,
+				Name:     run.File,
+				Owner:    run.Owner,
+				Shared:   run.share.Shared(),
+				Writers:  run.share.Writers(),
+				Viewers:  run.Viewers(),
+				CanWrite: run.CanControl(identity),
+			})
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Data: map[string]interface{}{
+			"identity": identity,
+			"items":    items,
+		}})
+
+	case "POST":
+		var req struct {
+			Kind     string `json:"kind"`
+			ID       string `json:"id"`
+			Action   string `json:"action"`
+			Identity string `json:"identity"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Invalid request body"})
+			return
+		}
+		if (req.Action == "grant" || req.Action == "revoke") && req.Identity == "" {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Identity required"})
+			return
+		}
+
+		// Only the owner may change how a session is shared
+		var share *ShareState
+		var unshare, notify func()
+		switch req.Kind {
+		case "shell":
+			session, err := ts.shellManager.Get(identity, req.ID)
+			if err != nil || !ts.shellEnabled {
+				json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Shell session not found"})
+				return
+			}
+			share, unshare, notify = &session.share, session.Unshare, session.NotifyAccess
+		case "run":
+			run := ts.runRegistry.Lookup(identity, req.ID)
+			if run == nil || run.Owner != identity {
+				json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Run not found"})
+				return
+			}
+			share, unshare, notify = &run.share, run.Unshare, func() {}
+		default:
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Unknown kind"})
+			return
+		}
+
+		switch req.Action {
+		case "share":
+			share.SetShared(true)
+		case "unshare":
+			unshare()
+		case "grant":
+			share.Grant(req.Identity)
+		case "revoke":
+			share.Revoke(req.Identity)
+		default:
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Unknown action"})
+			return
+		}
+		notify()
+
+		if ts.verbose {
+			log.Printf("👥 %s %s %s %s", identity, req.Action, req.Kind, req.ID)
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Sharing updated"})
+
+	default:
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Method not allowed"})
+	}
+}
+
+// adminTokensHandler lists API tokens (GET), issues one (POST) and revokes
+// one by ?id= (DELETE). A new token's secret is only ever returned here.
+func (ts *TerminalServer) adminTokensHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	tokens := ts.authConfig.Tokens
+	if tokens == nil {
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "API tokens are not configured (start the server with --token-file)"})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		list, err := tokens.List()
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Data: list})
+
+	case "POST":
+		var req struct {
+			Name      string   `json:"name"`
+			Username  string   `json:"username"`
+			Scopes    []string `json:"scopes"`
+			ExpiresIn string   `json:"expiresIn"` // Go duration, e.g. "720h"; empty never expires
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Invalid request body"})
+			return
+		}
+		if !ts.authConfig.Users.Exists(req.Username) {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: fmt.Sprintf("Unknown user %q (tokens act as local accounts, not single sign-on or proxy users)", req.Username)})
+			return
+		}
+		scopes, err := parseScopes(strings.Join(req.Scopes, ","))
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		var ttl time.Duration
+		if req.ExpiresIn != "" {
+			if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil || ttl <= 0 {
+				json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Invalid expiresIn duration"})
+				return
+			}
+		}
+
+		secret, token, err := tokens.Create(req.Username, req.Name, scopes, ttl)
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		token.Hash = ""
+		if ts.verbose {
+			log.Printf("🔑 %s created API token %s for %s (%s)", ts.clientIdentity(r), token.ID, token.Username, strings.Join(scopes, ","))
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Token created", Data: map[string]interface{}{
+			"token": secret,
+			"info":  token,
+		}})
+
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		if err := tokens.Revoke(id); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		if ts.verbose {
+			log.Printf("🔑 %s revoked API token %s", ts.clientIdentity(r), id)
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Token revoked"})
+
+	default:
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Method not allowed"})
+	}
+}
+
+// accountTOTPHandler lets a signed-in user enroll an authenticator app
+// (POST begin, then confirm with a first code), see its status (GET) or turn
+// it off (POST disable, with a current code). Admins reset a user's
+// authenticator with DELETE ?user=.
+func (ts *TerminalServer) accountTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	username := currentUser(r)
+	totp := ts.authConfig.TOTP
+	// Only local accounts sign in with a password that a code can be added to
+	available := totp != nil && username != "" && ts.authConfig.Users.Exists(username)
+
+	if r.Method == "GET" {
+		status := map[string]interface{}{"available": available}
+		if available {
+			current := totp.Status(username)
+			status["enabled"] = current.Enabled
+			status["recoveryCodesLeft"] = current.RecoveryCodesLeft
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Data: status})
+		return
+	}
+	if totp == nil || username == "" {
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Two-factor authentication is not configured (start the server with --totp-file)"})
+		return
+	}
+	if !available {
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Two-factor authentication is only for accounts that sign in with a password here"})
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		var req struct {
+			Action string `json:"action"`
+			Code   string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Invalid request body"})
+			return
+		}
+
+		switch req.Action {
+		case "begin":
+			secret, uri, err := totp.Begin(username)
+			if err != nil {
+				json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+				return
+			}
+			json.NewEncoder(w).Encode(APIResponse{Success: true, Data: map[string]string{"secret": secret, "uri": uri}})
+		case "confirm":
+			codes, err := totp.Confirm(username, req.Code)
+			if err != nil {
+				json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+				return
+			}
+			if ts.verbose {
+				log.Printf("📱 %s enabled two-factor authentication", username)
+			}
+			json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Two-factor authentication enabled", Data: map[string][]string{"recoveryCodes": codes}})
+		case "disable":
+			// A stolen session alone must not be enough to remove the second factor
+			if valid, _ := totp.Verify(username, req.Code); !valid {
+				json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Invalid code"})
+				return
+			}
+			if err := totp.Disable(username); err != nil {
+				json.NewEncoder(w).Encode(APIResponse{Success: false, Message: fmt.Sprintf("Failed to disable: %v", err)})
+				return
+			}
+			if ts.verbose {
+				log.Printf("📱 %s disabled two-factor authentication", username)
+			}
+			json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Two-factor authentication disabled"})
+		default:
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Unknown action"})
+		}
+
+	case "DELETE":
+		if ts.denyUnlessPermitted(w, r, PermAdmin) {
+			return
+		}
+		target := r.URL.Query().Get("user")
+		if target == "" {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "User required"})
+			return
+		}
+		if err := totp.Disable(target); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: fmt.Sprintf("Failed to reset: %v", err)})
+			return
+		}
+		if ts.verbose {
+			log.Printf("📱 %s reset two-factor authentication for %s", username, target)
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: fmt.Sprintf("Two-factor authentication reset for %s", target)})
+
+	default:
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Method not allowed"})
+	}
+}
+
+// adminSessionsHandler lists active login sessions (GET) and revokes one by
+// ?id= or all of a user's by ?user= (DELETE)
+func (ts *TerminalServer) adminSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		currentToken := ""
+		if cookie, err := r.Cookie("snakeflex_session"); err == nil {
+			currentToken = cookie.Value
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Data: ts.sessionManager.List(currentToken)})
+
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		username := r.URL.Query().Get("user")
+		if id == "" && username == "" {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Session id or user required"})
+			return
+		}
+		revoked, err := ts.sessionManager.Revoke(id, username)
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: fmt.Sprintf("Failed to revoke sessions: %v", err)})
+			return
+		}
+		if revoked == 0 {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "No matching sessions"})
+			return
+		}
+
+		if ts.verbose {
+			log.Printf("🚪 %s revoked %d session(s) (id=%q user=%q)", ts.clientIdentity(r), revoked, id, username)
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: fmt.Sprintf("Revoked %d session(s)", revoked)})
+
+	default:
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Method not allowed"})
 	}
-	cmd.Wait()
 }
 
 func (ts *TerminalServer) terminalHandler(w http.ResponseWriter, r *http.Request, htmlFile string) {
@@ -1191,6 +2369,15 @@ func (ts *TerminalServer) terminalHandler(w http.ResponseWriter, r *http.Request
 	htmlStr = strings.ReplaceAll(htmlStr, "{{WORKING_DIR}}", ts.workingDir)
 	htmlStr = strings.ReplaceAll(htmlStr, "{{FILE_MANAGER_ENABLED}}", fmt.Sprintf("%t", ts.fileManagerEnabled))
 	htmlStr = strings.ReplaceAll(htmlStr, "{{SHELL_ENABLED}}", fmt.Sprintf("%t", ts.shellEnabled))
+	htmlStr = strings.ReplaceAll(htmlStr, "{{PACKAGES_ENABLED}}", fmt.Sprintf("%t", ts.packagesEnabled))
+	htmlStr = strings.ReplaceAll(htmlStr, "{{CURRENT_USER}}", currentUser(r))
+	permissions, _ := json.Marshal(ts.permissions(r))
+	htmlStr = strings.ReplaceAll(htmlStr, "{{PERMISSIONS}}", string(permissions))
+	external, _ := r.Context().Value(externalAuthContextKey).(bool)
+	htmlStr = strings.ReplaceAll(htmlStr, "{{TOTP_AVAILABLE}}", fmt.Sprintf("%t", ts.authConfig.TOTP != nil && !external && ts.authConfig.Users.Exists(currentUser(r))))
+	htmlStr = strings.ReplaceAll(htmlStr, "{{SIGN_OUT_AVAILABLE}}", fmt.Sprintf("%t", !external))
+	htmlStr = strings.ReplaceAll(htmlStr, "{{CSRF_TOKEN}}", csrfToken(r))
+	htmlStr = strings.ReplaceAll(htmlStr, "{{RECORDING_ENABLED}}", fmt.Sprintf("%t", ts.recordings != nil))
 
 	// Add base path to template
 	basePath := ts.getBasePath(r)
@@ -1281,6 +2468,10 @@ func (ts *TerminalServer) fileContentHandler(w http.ResponseWriter, r *http.Requ
 		})
 
 	case "PUT":
+		// Reading only needs files:read; saving needs write access too
+		if ts.denyUnlessPermitted(w, r, PermFilesWrite) {
+			return
+		}
 		var req struct {
 			Path    string `json:"path"`
 			Content string `json:"content"`
@@ -1308,6 +2499,7 @@ func (ts *TerminalServer) fileContentHandler(w http.ResponseWriter, r *http.Requ
 			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Failed to save file: " + err.Error()})
 			return
 		}
+		ts.audit(r, AuditEvent{Event: AuditFileSave, Path: req.Path, Size: int64(len(req.Content))})
 
 		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "File saved successfully"})
 
@@ -1399,11 +2591,12 @@ func (ts *TerminalServer) uploadHandler(w http.ResponseWriter, r *http.Request)
 			continue
 		}
 		defer targetFile.Close()
-		_, err = io.Copy(targetFile, file)
+		size, err := io.Copy(targetFile, file)
 		if err != nil {
 			os.Remove(targetPath)
 			continue
 		}
+		ts.audit(r, AuditEvent{Event: AuditFileUpload, Path: filepath.Join(uploadPath, fileHeader.Filename), Size: size})
 		uploadedFiles = append(uploadedFiles, fileHeader.Filename)
 	}
 	if len(uploadedFiles) == 0 {
@@ -1467,6 +2660,7 @@ func (ts *TerminalServer) createHandler(w http.ResponseWriter, r *http.Request)
 		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
 		return
 	}
+	ts.audit(r, AuditEvent{Event: AuditFileCreate, Path: req.Path, IsDir: req.IsDir})
 	json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Created successfully"})
 }
 
@@ -1499,6 +2693,7 @@ func (ts *TerminalServer) deleteHandler(w http.ResponseWriter, r *http.Request)
 		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
 		return
 	}
+	ts.audit(r, AuditEvent{Event: AuditFileDelete, Path: filePath})
 	json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Deleted successfully"})
 }
 
@@ -1515,8 +2710,13 @@ func (ts *TerminalServer) websocketHandler(w http.ResponseWriter, r *http.Reques
 		log.Printf("WebSocket connection established from %s", r.RemoteAddr)
 	}
 
-	var currentInputChan chan string
-	var chanMutex sync.Mutex
+	// Runs belong to the client's session, not to this connection, so they keep
+	// going after a disconnect and can be re-attached from a new connection
+	identity := ts.clientIdentity(r)
+	defer ts.runRegistry.Detach(safeConn)
+
+	// Anyone signed in may watch runs; starting or controlling them needs the run permission
+	canRun := ts.hasPermission(r, PermRun)
 
 	for {
 		var msg Message
@@ -1528,100 +2728,263 @@ func (ts *TerminalServer) websocketHandler(w http.ResponseWriter, r *http.Reques
 			break
 		}
 
+		switch msg.Type {
+		case "execute", "input", "stop", "signal":
+			if !canRun {
+				safeConn.SendMessage(Message{Type: "error", Content: "Permission denied: requires " + PermRun, RunID: msg.RunID})
+				continue
+			}
+		}
+
 		switch msg.Type {
 		case "execute":
-			newChan := make(chan string, 10)
-			chanMutex.Lock()
-			currentInputChan = newChan
-			chanMutex.Unlock()
-			go ts.executePythonScript(safeConn, newChan, msg.File)
+			options, err := ts.runOptions(r, msg)
+			if err != nil {
+				safeConn.SendMessage(Message{Type: "error", Content: err.Error()})
+				continue
+			}
+			run := NewScriptRun(identity, msg.File, msg.Mode, options)
+			run.Attach(safeConn, identity, 0)
+			ts.submitRun(run)
+
+		case "attach":
+			target := ts.runRegistry.Lookup(identity, msg.RunID)
+			if target == nil || msg.RunID == "" {
+				safeConn.SendMessage(Message{Type: "error", Content: "Run not found", RunID: msg.RunID})
+				continue
+			}
+			target.Attach(safeConn, identity, msg.Seq)
+			if ts.verbose {
+				log.Printf("Client re-attached to run %s from sequence %d", target.ID, msg.Seq)
+			}
+
+		case "detach":
+			if target := ts.runRegistry.Lookup(identity, msg.RunID); target != nil {
+				target.Detach(safeConn)
+			}
+
+		case "runs":
+			safeConn.SendMessage(Message{Type: "runs", Runs: ts.runRegistry.List(identity)})
 
 		case "input":
-			chanMutex.Lock()
-			targetChan := currentInputChan
-			chanMutex.Unlock()
-			if targetChan != nil {
+			target := ts.runRegistry.Lookup(identity, msg.RunID)
+			if target != nil && !target.CanControl(identity) {
+				safeConn.SendMessage(Message{Type: "error", Content: "You have read-only access to this run", RunID: target.ID})
+				continue
+			}
+			if target != nil {
 				if ts.verbose {
-					log.Printf("Received input: %s", msg.Input)
+					log.Printf("Received input for run %s: %s", target.ID, msg.Input)
 				}
-				// Use a select with a default case to avoid blocking if the channel is full.
-				select {
-				case targetChan <- msg.Input + "\n":
-				default:
-					log.Printf("Input channel full, dropping input for file: %s", msg.File)
+				if !target.SendInput(msg.Input + "\n") {
+					log.Printf("Input channel full or closed, dropping input for run: %s", target.ID)
 				}
 			}
+
+		case "stop", "signal":
+			target := ts.runRegistry.Lookup(identity, msg.RunID)
+			if target == nil {
+				safeConn.SendMessage(Message{Type: "error", Content: "No script is running", RunID: msg.RunID})
+				continue
+			}
+			if !target.CanControl(identity) {
+				safeConn.SendMessage(Message{Type: "error", Content: "You have read-only access to this run", RunID: target.ID})
+				continue
+			}
+
+			var err error
+			if msg.Type == "stop" {
+				err = target.Stop()
+			} else {
+				err = target.Signal(strings.ToUpper(msg.Signal))
+			}
+			if err != nil {
+				target.Send(Message{Type: "error", Content: err.Error()})
+			} else if ts.verbose {
+				log.Printf("Sent %s request (%s) to run %s", msg.Type, msg.Signal, target.ID)
+			}
 		}
 	}
 }
 
-func (ts *TerminalServer) executePythonScript(safeConn *SafeWebSocketConn, inputChan chan string, pythonFile string) {
-	if pythonFile == "" {
-		safeConn.SendMessage(Message{Type: "error", Content: "No Python file specified for execution."})
-		close(inputChan)
+// Register a run and start it now or leave it queued, according to its mode
+func (ts *TerminalServer) submitRun(run *ScriptRun) {
+	replaced, cancelled, start := ts.runRegistry.Submit(run)
+
+	for _, old := range replaced {
+		if err := old.Stop(); err != nil && ts.verbose {
+			log.Printf("Failed to stop replaced run %s: %v", old.ID, err)
+		}
+	}
+	for _, queued := range cancelled {
+		queued.finish()
+		queued.Send(Message{Type: "cancelled", File: queued.File, Content: "Removed from queue"})
+	}
+
+	if !start {
+		position := ts.runRegistry.QueuePosition(run)
+		run.Send(Message{Type: "queued", File: run.File, Mode: run.Mode, Content: fmt.Sprintf("Position %d in queue", position)})
+		if ts.verbose {
+			log.Printf("Queued run %s for %s (position %d)", run.ID, run.File, position)
+		}
 		return
 	}
 
-	// Use the new validation function
-	absPath, err := ts.validateAndResolvePath(pythonFile)
-	if err != nil {
-		safeConn.SendMessage(Message{Type: "error", Content: fmt.Sprintf("Invalid file path: %v", err)})
-		close(inputChan)
+	go ts.startRun(run)
+}
+
+// Execute a run and hand the sequential lane to the next queued run when it ends
+func (ts *TerminalServer) startRun(run *ScriptRun) {
+	ts.runRegistry.Started(run)
+	interp, err := ts.interpreters.Resolve(filepath.Dir(run.File), run.Options.Interpreter)
+	if run.stopRequested() {
+		// Replaced or stopped while the interpreter was being chosen
+		run.Send(Message{Type: "cancelled", File: run.File, Content: "Stopped before it started"})
+	} else {
+		started := Message{Type: "started", File: run.File, Mode: run.Mode}
+		if err == nil {
+			started.Content = ts.runCommandLine(interp, run)
+		}
+		run.Send(started)
+		if ts.verbose {
+			log.Printf("Starting run %s (%s mode): %s", run.ID, run.Mode, started.Content)
+		}
+
+		if err != nil {
+			run.Send(Message{Type: "error", Content: fmt.Sprintf("Cannot choose an interpreter: %v", err)})
+		} else {
+			ts.executePythonScript(run, interp)
+		}
+	}
+	run.finish()
+
+	if next := ts.runRegistry.Finish(run); next != nil {
+		go ts.startRun(next)
+	}
+}
+
+func (ts *TerminalServer) executePythonScript(run *ScriptRun, interp Interpreter) {
+	if run.File == "" {
+		run.Send(Message{Type: "error", Content: "No Python file specified for execution."})
 		return
 	}
 
-	if _, err := os.Stat(absPath); os.IsNotExist(err) {
-		safeConn.SendMessage(Message{Type: "error", Content: fmt.Sprintf("File not found: %s", pythonFile)})
-		close(inputChan)
+	target := []string{"-m", run.File}
+	if !run.Module {
+		// Use the new validation function
+		absPath, err := ts.validateAndResolvePath(run.File)
+		if err != nil {
+			run.Send(Message{Type: "error", Content: fmt.Sprintf("Invalid file path: %v", err)})
+			return
+		}
+
+		if _, err := os.Stat(absPath); os.IsNotExist(err) {
+			run.Send(Message{Type: "error", Content: fmt.Sprintf("File not found: %s", run.File)})
+			return
+		}
+		target = []string{absPath}
+	}
+
+	if err := run.Options.validate(); err != nil {
+		run.Send(Message{Type: "error", Content: fmt.Sprintf("Invalid run options: %v", err)})
+		return
+	}
+	runDir, err := ts.resolveRunDir(run.Options.Cwd)
+	if err != nil {
+		run.Send(Message{Type: "error", Content: fmt.Sprintf("Invalid working directory: %v", err)})
 		return
 	}
 
-	cmd := exec.Command(ts.pythonCmd, "-u", absPath)
-	cmd.Dir = ts.workingDir
-	cmd.Env = os.Environ()
+	cmd := exec.Command(interp.Python, append(append([]string{"-u"}, target...), run.Options.Args...)...)
+	cmd.Dir = runDir
+	cmd.Env = interp.activate(os.Environ())
 	cmd.Env = append(cmd.Env, "PYTHONIOENCODING=utf-8", "PYTHONUNBUFFERED=1")
+	cmd.Env = append(cmd.Env, run.Options.envList()...)
+
+	// Options can only make the server's limits stricter; validate has checked them
+	requested, _ := parseResourceLimits(run.Options.Limits)
+	limits := ts.runLimits.Tighten(requested)
+	cgroup := ts.cgroups.cgroupFor(cmd, "run-"+run.ID, limits)
+	defer ts.cgroups.Remove(cgroup)
+	if err := limitCommand(cmd, limits, cgroup); err != nil {
+		run.Send(Message{Type: "error", Content: fmt.Sprintf("Cannot apply resource limits: %v", err)})
+		return
+	}
+	run.setLimits(limits, cgroup)
+	if err := ts.sandbox.wrap(cmd); err != nil {
+		run.Send(Message{Type: "error", Content: fmt.Sprintf("Cannot sandbox the script: %v", err)})
+		return
+	}
 
 	// Use PTY on Unix-like systems for better interactive session handling
 	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
-		ts.executePtyScript(safeConn, inputChan, cmd)
+		ts.executePtyScript(run, cmd)
 	} else {
-		ts.executePipeScript(safeConn, inputChan, cmd)
+		ts.executePipeScript(run, cmd)
 	}
 }
 
-func (ts *TerminalServer) executePipeScript(safeConn *SafeWebSocketConn, inputChan chan string, cmd *exec.Cmd) {
+func (ts *TerminalServer) executePipeScript(run *ScriptRun, cmd *exec.Cmd) {
 	stdin, _ := cmd.StdinPipe()
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
+	setProcessGroup(cmd)
 	if err := cmd.Start(); err != nil {
-		safeConn.SendMessage(Message{Type: "error", Content: fmt.Sprintf("Failed to start command: %v", err)})
+		run.Send(Message{Type: "error", Content: fmt.Sprintf("Failed to start command: %v", err)})
 		return
 	}
-	ts.handleIO(safeConn, stdin, stdout, stderr, cmd, inputChan)
+	if run.setCommand(cmd) {
+		run.Stop()
+	}
+	ts.handleIO(run, stdin, stdout, stderr)
 }
 
-func (ts *TerminalServer) executePtyScript(safeConn *SafeWebSocketConn, inputChan chan string, cmd *exec.Cmd) {
+func (ts *TerminalServer) executePtyScript(run *ScriptRun, cmd *exec.Cmd) {
+	// pty.Start places the script in a new session, which also makes it a process group leader
 	ptmx, err := pty.Start(cmd)
 	if err != nil {
-		safeConn.SendMessage(Message{Type: "error", Content: fmt.Sprintf("Failed to start PTY: %v", err)})
+		run.Send(Message{Type: "error", Content: fmt.Sprintf("Failed to start PTY: %v", err)})
 		return
 	}
 	defer ptmx.Close()
+	if run.setCommand(cmd) {
+		run.Stop()
+	}
+
+	recorder := ts.recordings.Start(run.Owner, "run", run.ID, strings.Join(append([]string{run.File}, run.Options.Args...), " "))
+	defer recorder.Close()
 
 	// We handle IO using the single PTY file descriptor
-	ts.handleIO(safeConn, ptmx, ptmx, nil, cmd, inputChan)
+	ts.handleIO(run, ptmx, recorder.Reader(ptmx), nil)
 }
 
-func (ts *TerminalServer) handleIO(safeConn *SafeWebSocketConn, stdin io.WriteCloser, stdout, stderr io.ReadCloser, cmd *exec.Cmd, inputChan chan string) {
+func (ts *TerminalServer) handleIO(run *ScriptRun, stdin io.WriteCloser, stdout, stderr io.ReadCloser) {
 	wg := sync.WaitGroup{}
+	cmd := run.cmd
+	started := time.Now()
+	ts.auditLog.Record(AuditEvent{Event: AuditRunStart, User: run.Owner, RunID: run.ID, Path: run.File, Args: run.Options.Args})
+
+	if run.limits.Timeout > 0 {
+		timer := time.AfterFunc(run.limits.Timeout, run.timeOut)
+		defer timer.Stop()
+	}
+
+	// Counted up front so the exit goroutine cannot pass readers.Wait before they start
+	readers := sync.WaitGroup{}
+	readers.Add(1)
+	if stderr != nil {
+		readers.Add(1)
+	}
 
 	// Goroutine to handle process exit
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		defer close(inputChan)
 
+		// Wait closes the pipes, so the output is read to the end first
+		readers.Wait()
 		err := cmd.Wait()
+		run.finish()
 		exitCode := 0
 		if err != nil {
 			if exitError, ok := err.(*exec.ExitError); ok {
@@ -1630,9 +2993,31 @@ func (ts *TerminalServer) handleIO(safeConn *SafeWebSocketConn, stdin io.WriteCl
 				exitCode = -1 // Indicates an error other than a non-zero exit code
 			}
 		}
-		safeConn.SendMessage(Message{Type: "completed", Content: fmt.Sprintf("Exit code: %d", exitCode)})
+
+		sig := run.terminationSignal(cmd.ProcessState)
+		limit := run.limitReached(cmd.ProcessState)
+		ts.auditLog.Record(AuditEvent{Event: AuditRunExit, User: run.Owner, RunID: run.ID, Path: run.File,
+			DurationMs: time.Since(started).Milliseconds(), ExitCode: &exitCode, Signal: sig, Reason: limit})
+
+		if limit != "" {
+			run.Send(Message{Type: "completed", Content: fmt.Sprintf("Exit code: %d (%s reached)", exitCode, run.limits.Describe(limit)), Limit: limit, Signal: sig})
+			if ts.verbose {
+				log.Printf("Run %s stopped by its %s", run.ID, run.limits.Describe(limit))
+			}
+			return
+		}
+
+		if sig != "" {
+			run.Send(Message{Type: "killed", Content: fmt.Sprintf("Terminated by %s (exit code: %d)", sig, exitCode), Signal: sig})
+			if ts.verbose {
+				log.Printf("Run %s terminated by %s", run.ID, sig)
+			}
+			return
+		}
+
+		run.Send(Message{Type: "completed", Content: fmt.Sprintf("Exit code: %d", exitCode)})
 		if ts.verbose {
-			log.Printf("Script execution completed with exit code: %d", exitCode)
+			log.Printf("Run %s completed with exit code: %d", run.ID, exitCode)
 		}
 	}()
 
@@ -1641,29 +3026,33 @@ func (ts *TerminalServer) handleIO(safeConn *SafeWebSocketConn, stdin io.WriteCl
 	go func() {
 		defer wg.Done()
 		defer stdin.Close()
-		for input := range inputChan {
-			if ts.verbose {
-				log.Printf("Sending input to Python: %s", strings.TrimSpace(input))
-			}
-			_, err := io.WriteString(stdin, input)
-			if err != nil {
+		for {
+			select {
+			case input := <-run.inputChan:
 				if ts.verbose {
-					log.Printf("Error writing to stdin: %v", err)
+					log.Printf("Sending input to Python: %s", strings.TrimSpace(input))
 				}
+				_, err := io.WriteString(stdin, input)
+				if err != nil {
+					if ts.verbose {
+						log.Printf("Error writing to stdin: %v", err)
+					}
+					return
+				}
+			case <-run.done:
 				return
 			}
 		}
 	}()
 
 	// Goroutine for reading from stdout
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
+		defer readers.Done()
 		buffer := make([]byte, 4096)
 		for {
 			n, err := stdout.Read(buffer)
 			if n > 0 {
-				safeConn.SendMessage(Message{Type: "stdout", Content: string(buffer[:n])})
+				run.Send(Message{Type: "stdout", Content: string(buffer[:n])})
 			}
 			if err != nil {
 				break // Usually io.EOF
@@ -1673,14 +3062,13 @@ func (ts *TerminalServer) handleIO(safeConn *SafeWebSocketConn, stdin io.WriteCl
 
 	// Goroutine for reading from stderr (only if it's a separate pipe)
 	if stderr != nil {
-		wg.Add(1)
 		go func() {
-			defer wg.Done()
+			defer readers.Done()
 			buffer := make([]byte, 4096)
 			for {
 				n, err := stderr.Read(buffer)
 				if n > 0 {
-					safeConn.SendMessage(Message{Type: "stderr", Content: string(buffer[:n])})
+					run.Send(Message{Type: "stderr", Content: string(buffer[:n])})
 				}
 				if err != nil {
 					break // Usually io.EOF
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Certificate fields a username can be taken from
+var clientCertSources = []string{"cn", "email", "dns"}
+
+// ClientCertAuth signs in users by the TLS client certificate they present,
+// verified against the --client-ca bundle
+type ClientCertAuth struct {
+	Source      string // one of clientCertSources
+	DefaultRole string // for users not in the users file
+}
+
+// loadClientCAs reads a PEM bundle of CAs that may issue client certificates
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// Verified client certificate of a request, or nil
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+func clientCertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// certUser maps the request's client certificate to a username and role. As
+// for single sign-on, users-file accounts keep their role (returned as "").
+func (ts *TerminalServer) certUser(r *http.Request) (string, string, *x509.Certificate, bool) {
+	if ts.clientCertAuth == nil {
+		return "", "", nil, false
+	}
+	cert := clientCertificate(r)
+	if cert == nil {
+		return "", "", nil, false
+	}
+
+	var username string
+	switch ts.clientCertAuth.Source {
+	case "cn":
+		username = cert.Subject.CommonName
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			username = cert.EmailAddresses[0]
+		}
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			username = cert.DNSNames[0]
+		}
+	}
+	if !validUsername.MatchString(username) {
+		if ts.verbose {
+			log.Printf("⚠️  Client certificate %q has no usable %s for a username", cert.Subject.String(), ts.clientCertAuth.Source)
+		}
+		return "", "", nil, false
+	}
+
+	if ts.authConfig.Users.Exists(username) {
+		return username, "", cert, true
+	}
+	return username, ts.clientCertAuth.DefaultRole, cert, true
+}
+
+// Browsers navigating to a page get a login session; everything else that
+// presents a certificate is authenticated request by request
+func wantsPage(r *http.Request) bool {
+	return r.Method == "GET" && r.Header.Get("Upgrade") == "" && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// serveWithCertUser runs the handler as the owner of the client certificate,
+// without creating a session
+func (ts *TerminalServer) serveWithCertUser(w http.ResponseWriter, r *http.Request, username, role string, cert *x509.Certificate, next http.HandlerFunc) {
+	ctx := context.WithValue(r.Context(), userContextKey, username)
+	ctx = context.WithValue(ctx, externalAuthContextKey, true)
+	if role != "" {
+		ctx = context.WithValue(ctx, roleContextKey, role)
+	}
+	ts.serveWithCSRF(w, r.WithContext(ctx), ts.signedCSRFToken("cert:"+clientCertFingerprint(cert)), next)
+}
+
+// Sessions started with a certificate stay valid only while it is presented
+func (ts *TerminalServer) certSessionValid(r *http.Request, session *Session) bool {
+	if ts.clientCertAuth == nil {
+		return false
+	}
+	cert := clientCertificate(r)
+	if cert == nil || clientCertFingerprint(cert) != session.ClientCert {
+		return false
+	}
+	return session.Role != "" || ts.authConfig.Users.Exists(session.Username)
+}
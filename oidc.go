@@ -0,0 +1,675 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variable that can hold the OIDC client secret instead of a flag
+const oidcClientSecretEnv = "SNAKEFLEX_OIDC_CLIENT_SECRET"
+
+// Cookie tying the browser that started a single sign-on to its callback
+const oidcStateCookie = "snakeflex_oidc"
+
+const (
+	oidcLoginLifetime  = 10 * time.Minute
+	oidcClockSkew      = time.Minute
+	oidcJWKSMinRefresh = time.Minute
+	oidcHTTPTimeout    = 10 * time.Second
+)
+
+// OIDCConfig describes the identity provider and who may sign in through it
+type OIDCConfig struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string // derived from the request when empty
+	Scopes        []string
+	AllowedEmails []string // addresses, "@domain" suffixes or "*"
+	AllowedGroups []string
+	GroupsClaim   string
+	UsernameClaim string
+	GroupRoles    map[string]string
+	DefaultRole   string
+}
+
+// parseGroupRoles reads "group=role,group=role"
+func parseGroupRoles(list string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, pair := range splitList(list) {
+		group, role, ok := strings.Cut(pair, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" {
+			return nil, fmt.Errorf("invalid group mapping %q (expected group=role)", pair)
+		}
+		if !validRole(role) {
+			return nil, fmt.Errorf("unknown role %q for group %q (expected one of %s)", role, group, strings.Join(roleNames(), ", "))
+		}
+		roles[group] = role
+	}
+	return roles, nil
+}
+
+// Comma-separated flag values, trimmed and without empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// oidcDiscovery is the part of the provider metadata we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is a sign-in waiting for the provider to redirect back
+type oidcLogin struct {
+	Nonce    string
+	Verifier string
+	Expiry   time.Time
+}
+
+// OIDCProvider runs the authorization code flow (with PKCE) against an
+// OpenID Connect provider and verifies the ID tokens it returns
+type OIDCProvider struct {
+	config     OIDCConfig
+	client     *http.Client
+	discovery  *oidcDiscovery
+	keys       map[string]crypto.PublicKey
+	keysAt     time.Time
+	logins     map[string]*oidcLogin // by state
+	mutex      sync.Mutex
+	loginMutex sync.Mutex
+}
+
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+	op := &OIDCProvider{
+		config: config,
+		client: &http.Client{Timeout: oidcHTTPTimeout},
+		logins: make(map[string]*oidcLogin),
+	}
+
+	// Clean up abandoned sign-ins every 10 minutes
+	go func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			op.cleanupLogins()
+		}
+	}()
+
+	return op
+}
+
+func (op *OIDCProvider) getJSON(target string, v interface{}) error {
+	resp, err := op.client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", target, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// Discover fetches the provider metadata once; failures are retried on the next sign-in
+func (op *OIDCProvider) Discover() (*oidcDiscovery, error) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	if op.discovery != nil {
+		return op.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	wellKnown := strings.TrimSuffix(op.config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := op.getJSON(wellKnown, &discovery); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %v", err)
+	}
+	if discovery.Issuer != op.config.Issuer {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %q, expected %q", discovery.Issuer, op.config.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery document is missing endpoints")
+	}
+	op.discovery = &discovery
+	return op.discovery, nil
+}
+
+func randomURLString(size int) string {
+	bytes := make([]byte, size)
+	rand.Read(bytes)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// AuthURL starts a sign-in and returns its state and the provider URL to send the browser to
+func (op *OIDCProvider) AuthURL(redirectURL string) (string, string, error) {
+	discovery, err := op.Discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	state := randomURLString(32)
+	login := &oidcLogin{
+		Nonce:    randomURLString(32),
+		Verifier: randomURLString(48),
+		Expiry:   time.Now().Add(oidcLoginLifetime),
+	}
+	op.loginMutex.Lock()
+	op.logins[state] = login
+	op.loginMutex.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", op.config.ClientID)
+	params.Set("redirect_uri", redirectURL)
+	params.Set("scope", strings.Join(op.config.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", login.Nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return state, discovery.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Take a pending sign-in by state; each state can be used once
+func (op *OIDCProvider) takeLogin(state string) (*oidcLogin, bool) {
+	op.loginMutex.Lock()
+	defer op.loginMutex.Unlock()
+	login, exists := op.logins[state]
+	if !exists {
+		return nil, false
+	}
+	delete(op.logins, state)
+	return login, time.Now().Before(login.Expiry)
+}
+
+func (op *OIDCProvider) cleanupLogins() {
+	op.loginMutex.Lock()
+	defer op.loginMutex.Unlock()
+	now := time.Now()
+	for state, login := range op.logins {
+		if now.After(login.Expiry) {
+			delete(op.logins, state)
+		}
+	}
+}
+
+// OIDCIdentity is who the provider says signed in, already mapped to a SnakeFlex user
+type OIDCIdentity struct {
+	Username string
+	Email    string
+	Groups   []string
+	Role     string
+}
+
+// Exchange trades the authorization code for tokens, verifies the ID token
+// and decides whether and as whom the user may sign in
+func (op *OIDCProvider) Exchange(state, code, redirectURL string) (*OIDCIdentity, error) {
+	login, ok := op.takeLogin(state)
+	if !ok {
+		return nil, fmt.Errorf("unknown or expired sign-in state")
+	}
+	discovery, err := op.Discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("code_verifier", login.Verifier)
+	if op.config.ClientSecret == "" {
+		// Public client: PKCE alone proves we started this sign-in
+		form.Set("client_id", op.config.ClientID)
+	}
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if op.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(op.config.ClientID), url.QueryEscape(op.config.ClientSecret))
+	}
+
+	resp, err := op.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("token response: %s", resp.Status)
+	}
+	if tokens.Error != "" {
+		return nil, fmt.Errorf("token request rejected: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+
+	claims, err := op.verifyIDToken(tokens.IDToken, login.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	return op.identify(claims)
+}
+
+// verifyIDToken checks the signature and standard claims of an ID token
+func (op *OIDCProvider) verifyIDToken(token, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed ID token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature")
+	}
+	key, err := op.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token claims")
+	}
+
+	if iss, _ := claims["iss"].(string); iss != op.config.Issuer {
+		return nil, fmt.Errorf("ID token issuer %q does not match", iss)
+	}
+	audiences := claimStrings(claims, "aud")
+	if !containsPermission(audiences, op.config.ClientID) {
+		return nil, fmt.Errorf("ID token is not meant for this client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != op.config.ClientID {
+		return nil, fmt.Errorf("ID token authorized party %q does not match", azp)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return nil, fmt.Errorf("ID token has expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(oidcClockSkew)) {
+		return nil, fmt.Errorf("ID token is issued in the future")
+	}
+	if claimNonce, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(claimNonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+// identify applies the allow lists and role mapping to verified claims
+func (op *OIDCProvider) identify(claims map[string]interface{}) (*OIDCIdentity, error) {
+	identity := &OIDCIdentity{Groups: claimStrings(claims, op.config.GroupsClaim)}
+	// A provider that does not say the address is verified may not have checked it
+	if verified, _ := claims["email_verified"].(bool); verified {
+		identity.Email, _ = claims["email"].(string)
+	}
+
+	for _, claim := range []string{op.config.UsernameClaim, "email", "sub"} {
+		value, _ := claims[claim].(string)
+		if claim == "email" {
+			// Only an address the provider has verified
+			value = identity.Email
+		}
+		if value != "" {
+			identity.Username = value
+			break
+		}
+	}
+	if !validUsername.MatchString(identity.Username) {
+		return nil, fmt.Errorf("identity %q is not a valid username", identity.Username)
+	}
+
+	if !op.allowed(identity) {
+		return nil, fmt.Errorf("%s is not in the allowed emails or groups", identity.Username)
+	}
+
+	// The most trusted role any of the user's groups maps to
+	identity.Role = op.config.DefaultRole
+	for _, group := range identity.Groups {
+		if role, ok := op.config.GroupRoles[group]; ok && roleRank(role) > roleRank(identity.Role) {
+			identity.Role = role
+		}
+	}
+	return identity, nil
+}
+
+func (op *OIDCProvider) allowed(identity *OIDCIdentity) bool {
+	email := strings.ToLower(identity.Email)
+	for _, allowed := range op.config.AllowedEmails {
+		allowed = strings.ToLower(allowed)
+		switch {
+		case allowed == "*":
+			return true
+		case email == "":
+			continue
+		case strings.HasPrefix(allowed, "@") && strings.HasSuffix(email, allowed):
+			return true
+		case email == allowed:
+			return true
+		}
+	}
+	for _, group := range identity.Groups {
+		if containsPermission(op.config.AllowedGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the signing key with the given ID, refreshing the key set
+// when the provider has rotated keys
+func (op *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	if key, ok := op.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(op.keysAt) < oidcJWKSMinRefresh {
+		return nil, fmt.Errorf("unknown ID token signing key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := op.getJSON(op.discovery.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("fetching signing keys: %v", err)
+	}
+	op.keys = make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			op.keys[jwk.Kid] = key
+		}
+	}
+	op.keysAt = time.Now()
+
+	if key, ok := op.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown ID token signing key %q", kid)
+}
+
+// Find a key by ID; a token without one may use the only key there is
+func (op *OIDCProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if key, ok := op.keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(op.keys) == 1 {
+		for _, key := range op.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		bytes, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(bytes) == 0 {
+			return nil, fmt.Errorf("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(bytes), nil
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+// verifyJWTSignature supports the asymmetric algorithms providers use for ID
+// tokens; "none" and shared-secret algorithms are refused
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256", "PS256":
+		hash = crypto.SHA256
+	case "RS384", "ES384", "PS384":
+		hash = crypto.SHA384
+	case "RS512", "PS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported ID token algorithm %q", alg)
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		case "PS":
+			err = rsa.VerifyPSS(key, hash, digest, signature, nil)
+		default:
+			err = fmt.Errorf("key type does not match algorithm")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(signature) != 2*size {
+			return fmt.Errorf("invalid ID token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("invalid ID token signature")
+		}
+	default:
+		return fmt.Errorf("unsupported signing key")
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// A claim that may be a single string or a list of strings
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Callback URL registered with the provider
+func (ts *TerminalServer) oidcRedirectURL(r *http.Request) string {
+	if ts.oidc.config.RedirectURL != "" {
+		return ts.oidc.config.RedirectURL
+	}
+	scheme := "http"
+	if ts.secureRequest(r) {
+		scheme = "https"
+	}
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" && ts.fromTrustedProxy(r) {
+		host = forwarded
+	}
+	return scheme + "://" + host + ts.buildURL(r, "/login/oidc/callback")
+}
+
+// oidcLoginHandler sends the browser to the identity provider
+func (ts *TerminalServer) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if blocked, remainingTime := ts.rateLimiter.IsBlocked(r); blocked {
+		ts.serveBlockedPage(w, r, remainingTime)
+		return
+	}
+
+	state, authURL, err := ts.oidc.AuthURL(ts.oidcRedirectURL(r))
+	if err != nil {
+		log.Printf("⚠️  Single sign-on unavailable: %v", err)
+		http.Redirect(w, r, ts.buildURL(r, "/login?error=4"), http.StatusFound)
+		return
+	}
+
+	// Lax, not Strict: the provider's redirect back is a cross-site navigation
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     ts.cookiePath(r),
+		HttpOnly: true,
+		Secure:   ts.secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+		Expires:  time.Now().Add(oidcLoginLifetime),
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcCallbackHandler completes a sign-in when the provider redirects back
+func (ts *TerminalServer) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cookie, err := r.Cookie(oidcStateCookie)
+	ts.clearCookie(w, r, oidcStateCookie)
+
+	// The state must come back to the same browser that started the sign-in
+	state := query.Get("state")
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		if ts.verbose {
+			log.Printf("❌ Single sign-on callback with missing or mismatched state from %s", ts.rateLimiter.getClientIP(r))
+		}
+		http.Redirect(w, r, ts.buildURL(r, "/login?error=4"), http.StatusFound)
+		return
+	}
+	if providerError := query.Get("error"); providerError != "" {
+		ts.oidc.takeLogin(state)
+		if ts.verbose {
+			log.Printf("❌ Identity provider refused sign-in: %s %s", providerError, query.Get("error_description"))
+		}
+		http.Redirect(w, r, ts.buildURL(r, "/login?error=4"), http.StatusFound)
+		return
+	}
+
+	identity, err := ts.oidc.Exchange(state, query.Get("code"), ts.oidcRedirectURL(r))
+	if err == nil && ts.authConfig.Users != nil && ts.authConfig.Users.Exists(identity.Username) {
+		// Shells, runs, shares and two-factor settings belong to the local
+		// account of that name, which a provider account must not become
+		err = fmt.Errorf("%s is the name of a local account", identity.Username)
+	}
+	if err != nil {
+		ts.audit(r, AuditEvent{Event: AuditLoginFailure, Method: "oidc", Reason: err.Error()})
+		ts.rejectLogin(w, r, fmt.Sprintf("❌ Single sign-on failed: %v", err), "/login?error=4")
+		return
+	}
+
+	if ts.verbose {
+		log.Printf("🏢 %s signed in through %s as %s (groups: %s)", identity.Username, ts.oidc.config.Issuer, identity.Role, strings.Join(identity.Groups, ","))
+	}
+	ts.audit(r, AuditEvent{Event: AuditLoginSuccess, User: identity.Username, Method: "oidc"})
+	ts.startSession(w, r, identity.Username, identity.Role, "")
+
+	// The strict session cookie is not sent on redirects that began at the
+	// provider, so continue with a navigation from our own page
+	homeURL := ts.buildURL(r, "/")
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, `<!DOCTYPE html><html><head><meta http-equiv="refresh" content="0;url=%s"></head><body><a href="%s">Continue</a></body></html>`,
+		html.EscapeString(homeURL), html.EscapeString(homeURL))
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockIdP is a minimal OpenID Connect provider: discovery, a key set and a
+// token endpoint that checks PKCE and hands out the ID token it is given
+type mockIdP struct {
+	server    *httptest.Server
+	rsaKey    *rsa.PrivateKey
+	ecKey     *ecdsa.PrivateKey
+	challenge string // code_challenge of the last authorization request
+	idToken   func(nonce string) string
+	nonce     string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{rsaKey: rsaKey, ecKey: ecKey}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+			{"kty": "EC", "kid": "ec", "use": "sig", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "good-code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != idp.challenge {
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken(idp.nonce)})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) provider(config OIDCConfig) *OIDCProvider {
+	config.Issuer = idp.server.URL
+	config.ClientID = "snakeflex"
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if config.DefaultRole == "" {
+		config.DefaultRole = "viewer"
+	}
+	if config.AllowedEmails == nil && config.AllowedGroups == nil {
+		config.AllowedEmails = []string{"*"}
+	}
+	return NewOIDCProvider(config)
+}
+
+// claims returns valid ID token claims for the provider
+func (idp *mockIdP) claims(nonce string) map[string]interface{} {
+	now := time.Now().Unix()
+	return map[string]interface{}{
+		"iss":                idp.server.URL,
+		"aud":                "snakeflex",
+		"sub":                "248289761001",
+		"exp":                now + 300,
+		"iat":                now,
+		"nonce":              nonce,
+		"preferred_username": "jane",
+		"email":              "jane@example.com",
+		"email_verified":     true,
+	}
+}
+
+// sign makes a compact JWT with the given header and claims
+func (idp *mockIdP) sign(t *testing.T, header, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	alg, _ := header["alg"].(string)
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		digest := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, idp.rsaKey, crypto.SHA256, digest[:])
+	case "PS256":
+		digest := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPSS(rand.Reader, idp.rsaKey, crypto.SHA256, digest[:], nil)
+	case "ES256":
+		digest := sha256.Sum256([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, idp.ecKey, digest[:])
+		if err == nil {
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	default:
+		signature = []byte("not a signature")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	idp := newMockIdP(t)
+	op := idp.provider(OIDCConfig{Scopes: []string{"openid", "email"}})
+	idp.idToken = func(nonce string) string {
+		return idp.sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, idp.claims(nonce))
+	}
+
+	state, authURL, err := op.AuthURL("http://localhost/login/oidc/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := parsed.Query()
+	if !strings.HasPrefix(authURL, idp.server.URL+"/authorize?") {
+		t.Errorf("authorization URL %s is not at the provider", authURL)
+	}
+	if params.Get("state") != state || params.Get("code_challenge_method") != "S256" || params.Get("nonce") == "" {
+		t.Errorf("authorization URL is missing state, nonce or PKCE: %s", authURL)
+	}
+	if params.Get("scope") != "openid email" || params.Get("client_id") != "snakeflex" {
+		t.Errorf("unexpected scope or client in %s", authURL)
+	}
+	idp.challenge = params.Get("code_challenge")
+	idp.nonce = params.Get("nonce")
+
+	identity, err := op.Exchange(state, "good-code", "http://localhost/login/oidc/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "jane" || identity.Email != "jane@example.com" || identity.Role != "viewer" {
+		t.Errorf("identity = %+v", identity)
+	}
+
+	if _, err := op.Exchange(state, "good-code", "http://localhost/login/oidc/callback"); err == nil {
+		t.Error("a sign-in state could be used twice")
+	}
+}
+
+func TestOIDCExchangeRejects(t *testing.T) {
+	idp := newMockIdP(t)
+	op := idp.provider(OIDCConfig{})
+	idp.idToken = func(nonce string) string {
+		return idp.sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, idp.claims(nonce))
+	}
+
+	if _, err := op.Exchange("never-started", "good-code", "http://localhost/cb"); err == nil {
+		t.Error("unknown state accepted")
+	}
+
+	state, authURL, err := op.AuthURL("http://localhost/cb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ := url.Parse(authURL)
+	idp.nonce = parsed.Query().Get("nonce")
+	idp.challenge = "a challenge for some other verifier"
+	if _, err := op.Exchange(state, "good-code", "http://localhost/cb"); err == nil {
+		t.Error("token issued without the PKCE verifier")
+	}
+
+	state, authURL, _ = op.AuthURL("http://localhost/cb")
+	parsed, _ = url.Parse(authURL)
+	idp.challenge = parsed.Query().Get("code_challenge")
+	idp.nonce = "nonce of another sign-in"
+	if _, err := op.Exchange(state, "good-code", "http://localhost/cb"); err == nil {
+		t.Error("ID token with another sign-in's nonce accepted")
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+	op := NewOIDCProvider(OIDCConfig{Issuer: idp.server.URL + "/other", ClientID: "snakeflex"})
+	if _, err := op.Discover(); err == nil {
+		t.Error("discovery accepted a document for another issuer")
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	idp := newMockIdP(t)
+	op := idp.provider(OIDCConfig{})
+	if _, err := op.Discover(); err != nil {
+		t.Fatal(err)
+	}
+	const nonce = "the-nonce"
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "rsa"}
+	with := func(changes map[string]interface{}) map[string]interface{} {
+		claims := idp.claims(nonce)
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name   string
+		header map[string]interface{}
+		claims map[string]interface{}
+		valid  bool
+	}{
+		{"RS256", rs256, with(nil), true},
+		{"PS256", map[string]interface{}{"alg": "PS256", "kid": "rsa"}, with(nil), true},
+		{"ES256", map[string]interface{}{"alg": "ES256", "kid": "ec"}, with(nil), true},
+		{"audience list", rs256, with(map[string]interface{}{"aud": []string{"other", "snakeflex"}, "azp": "snakeflex"}), true},
+		{"slightly early clock", rs256, with(map[string]interface{}{"iat": now + 30}), true},
+		{"alg none", map[string]interface{}{"alg": "none", "kid": "rsa"}, with(nil), false},
+		{"HS256", map[string]interface{}{"alg": "HS256", "kid": "rsa"}, with(nil), false},
+		{"algorithm of another key type", map[string]interface{}{"alg": "ES256", "kid": "rsa"}, with(nil), false},
+		{"unknown key", map[string]interface{}{"alg": "RS256", "kid": "rotated-away"}, with(nil), false},
+		{"wrong issuer", rs256, with(map[string]interface{}{"iss": "https://evil.example.com"}), false},
+		{"wrong audience", rs256, with(map[string]interface{}{"aud": "another-client"}), false},
+		{"missing audience", rs256, with(map[string]interface{}{"aud": nil}), false},
+		{"other authorized party", rs256, with(map[string]interface{}{"aud": []string{"snakeflex", "other"}, "azp": "other"}), false},
+		{"expired", rs256, with(map[string]interface{}{"exp": now - 120}), false},
+		{"missing expiry", rs256, with(map[string]interface{}{"exp": nil}), false},
+		{"issued in the future", rs256, with(map[string]interface{}{"iat": now + 600}), false},
+		{"wrong nonce", rs256, with(map[string]interface{}{"nonce": "replayed"}), false},
+		{"missing nonce", rs256, with(map[string]interface{}{"nonce": nil}), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := op.verifyIDToken(idp.sign(t, test.header, test.claims), nonce)
+			if test.valid && err != nil {
+				t.Errorf("rejected: %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+
+	t.Run("tampered claims", func(t *testing.T) {
+		token := idp.sign(t, rs256, with(nil))
+		parts := strings.Split(token, ".")
+		forged, _ := json.Marshal(with(map[string]interface{}{"preferred_username": "admin"}))
+		parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+		if _, err := op.verifyIDToken(strings.Join(parts, "."), nonce); err == nil {
+			t.Error("accepted")
+		}
+	})
+	t.Run("malformed", func(t *testing.T) {
+		for _, token := range []string{"", "a.b", "a.b.c", "a.b.c.d"} {
+			if _, err := op.verifyIDToken(token, nonce); err == nil {
+				t.Errorf("%q accepted", token)
+			}
+		}
+	})
+}
+
+func TestOIDCIdentify(t *testing.T) {
+	op := NewOIDCProvider(OIDCConfig{
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		AllowedEmails: []string{"boss@example.com", "@example.org"},
+		AllowedGroups: []string{"python-devs", "platform"},
+		GroupRoles:    map[string]string{"platform": "admin", "python-devs": "editor", "auditors": "viewer"},
+		DefaultRole:   "viewer",
+	})
+
+	tests := []struct {
+		name     string
+		claims   map[string]interface{}
+		username string
+		role     string
+		allowed  bool
+	}{
+		{
+			name:     "username claim",
+			claims:   map[string]interface{}{"sub": "1", "preferred_username": "jane", "groups": []interface{}{"python-devs"}},
+			username: "jane", role: "editor", allowed: true,
+		},
+		{
+			name:     "most trusted role of all groups",
+			claims:   map[string]interface{}{"sub": "1", "preferred_username": "jane", "groups": []interface{}{"auditors", "platform", "python-devs"}},
+			username: "jane", role: "admin", allowed: true,
+		},
+		{
+			name:     "single group as a string",
+			claims:   map[string]interface{}{"sub": "1", "preferred_username": "jane", "groups": "platform"},
+			username: "jane", role: "admin", allowed: true,
+		},
+		{
+			name:     "allowed email gets the default role",
+			claims:   map[string]interface{}{"sub": "1", "preferred_username": "boss", "email": "Boss@Example.com", "email_verified": true},
+			username: "boss", role: "viewer", allowed: true,
+		},
+		{
+			name:     "allowed domain",
+			claims:   map[string]interface{}{"sub": "1", "preferred_username": "ann", "email": "ann@example.org", "email_verified": true},
+			username: "ann", role: "viewer", allowed: true,
+		},
+		{
+			name:    "allowed email without email_verified",
+			claims:  map[string]interface{}{"sub": "1", "preferred_username": "boss", "email": "boss@example.com"},
+			allowed: false,
+		},
+		{
+			name:    "email_verified that is not a boolean",
+			claims:  map[string]interface{}{"sub": "1", "preferred_username": "boss", "email": "boss@example.com", "email_verified": "true"},
+			allowed: false,
+		},
+		{
+			name:    "unverified allowed email",
+			claims:  map[string]interface{}{"sub": "1", "preferred_username": "boss", "email": "boss@example.com", "email_verified": false},
+			allowed: false,
+		},
+		{
+			name:    "domain suffix without the @",
+			claims:  map[string]interface{}{"sub": "1", "preferred_username": "mallory", "email": "mallory@evilexample.org", "email_verified": true},
+			allowed: false,
+		},
+		{
+			name:    "neither email nor group allowed",
+			claims:  map[string]interface{}{"sub": "1", "preferred_username": "jane", "groups": []interface{}{"auditors"}},
+			allowed: false,
+		},
+		{
+			name:     "verified email when the username claim is missing",
+			claims:   map[string]interface{}{"sub": "1", "email": "ann@example.org", "email_verified": true},
+			username: "ann@example.org", role: "viewer", allowed: true,
+		},
+		{
+			name:     "unverified email is not used as username",
+			claims:   map[string]interface{}{"sub": "248289761001", "email": "admin", "email_verified": false, "groups": "python-devs"},
+			username: "248289761001", role: "editor", allowed: true,
+		},
+		{
+			name:     "email without email_verified is not used as username",
+			claims:   map[string]interface{}{"sub": "248289761001", "email": "admin", "groups": "python-devs"},
+			username: "248289761001", role: "editor", allowed: true,
+		},
+		{
+			name:    "invalid username",
+			claims:  map[string]interface{}{"sub": "1", "preferred_username": "../jane", "groups": "platform"},
+			allowed: false,
+		},
+		{
+			name:    "no usable claim",
+			claims:  map[string]interface{}{"groups": "platform"},
+			allowed: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := op.identify(test.claims)
+			if !test.allowed {
+				if err == nil {
+					t.Errorf("allowed as %+v", identity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.Username != test.username || identity.Role != test.role {
+				t.Errorf("identity = %+v, want %s as %s", identity, test.username, test.role)
+			}
+		})
+	}
+}
+
+func TestParseGroupRoles(t *testing.T) {
+	roles, err := parseGroupRoles(" admins = admin, devs=editor ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 2 || roles["admins"] != "admin" || roles["devs"] != "editor" {
+		t.Errorf("roles = %v", roles)
+	}
+	for _, list := range []string{"admins", "=admin", "admins=root"} {
+		if _, err := parseGroupRoles(list); err == nil {
+			t.Errorf("parseGroupRoles(%q) succeeded", list)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Requirements file used when none is named, relative to the working directory
+const defaultRequirementsFile = "requirements.txt"
+
+// How long listing or freezing packages may take
+const pipQueryTimeout = 2 * time.Minute
+
+// Most packages one install or uninstall may name
+const maxPackagesPerRequest = 50
+
+// Most requirements one requirements file may list
+const maxRequirementsPerFile = 1000
+
+// Package actions a client may start
+const (
+	PackageInstall   = "install"
+	PackageUpgrade   = "upgrade"
+	PackageUninstall = "uninstall"
+)
+
+var (
+	validPackageName = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?$`)
+
+	// A name with optional extras and version specifiers, e.g. "requests[socks]>=2.31,<3".
+	// URLs, paths and options are refused, here and in requirements files, so
+	// nothing but the configured index or wheelhouse is used.
+	validRequirement = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?` +
+		`(\[[A-Za-z0-9._,-]+\])?` +
+		`(\s*(===|==|!=|~=|<=|>=|<|>)\s*[A-Za-z0-9.*+!_-]+(\s*,\s*(===|==|!=|~=|<=|>=|<|>)\s*[A-Za-z0-9.*+!_-]+)*)?$`)
+
+	// An environment marker after a requirement's ";", e.g. python_version < "3.11"
+	validMarker = regexp.MustCompile(`^[A-Za-z0-9_.\s'"()<>=!~*+-]+$`)
+
+	// A comment: a "#" at the start of a line or after whitespace
+	requirementsComment = regexp.MustCompile(`(^|\s)#.*$`)
+)
+
+// Package is one installed distribution, as reported by pip list
+type Package struct {
+	Name          string `json:"name"`
+	Version       string `json:"version"`
+	LatestVersion string `json:"latestVersion,omitempty"` // only when checked for updates
+}
+
+// Where pip may download from: only the wheelhouse when one is set
+func (ts *TerminalServer) pipIndexArgs() []string {
+	if ts.wheelhouse == "" {
+		return nil
+	}
+	return []string{"--no-index", "--find-links", ts.wheelhouse}
+}
+
+// pipQuery runs a pip command that only reports something and returns its output
+func (ts *TerminalServer) pipQuery(interp Interpreter, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pipQueryTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, interp.Python, append([]string{"-m", "pip"}, args...)...)
+	cmd.Dir = ts.workingDir
+	cmd.Env = append(interp.activate(os.Environ()), "PIP_DISABLE_PIP_VERSION_CHECK=1", "PYTHONIOENCODING=utf-8")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if strings.Contains(stderr.String(), "No module named pip") {
+			return nil, fmt.Errorf("pip is not installed for %s", interp.Name)
+		}
+		if lines := strings.Split(strings.TrimSpace(stderr.String()), "\n"); lines[len(lines)-1] != "" {
+			return nil, fmt.Errorf("pip %s failed: %s", args[0], lines[len(lines)-1])
+		}
+		return nil, fmt.Errorf("pip %s failed: %v", args[0], err)
+	}
+	return output, nil
+}
+
+// listPackages reports what is installed for an interpreter and, when asked,
+// the newest version available for anything out of date
+func (ts *TerminalServer) listPackages(interp Interpreter, outdated bool) ([]Package, error) {
+	output, err := ts.pipQuery(interp, "list", "--format=json")
+	if err != nil {
+		return nil, err
+	}
+	packages := []Package{}
+	if err := json.Unmarshal(output, &packages); err != nil {
+		return nil, fmt.Errorf("reading pip list: %v", err)
+	}
+
+	if outdated {
+		output, err := ts.pipQuery(interp, append([]string{"list", "--outdated", "--format=json"}, ts.pipIndexArgs()...)...)
+		if err != nil {
+			return nil, err
+		}
+		var updates []struct {
+			Name          string `json:"name"`
+			LatestVersion string `json:"latest_version"`
+		}
+		if err := json.Unmarshal(output, &updates); err != nil {
+			return nil, fmt.Errorf("reading pip list: %v", err)
+		}
+		latest := make(map[string]string)
+		for _, update := range updates {
+			latest[strings.ToLower(update.Name)] = update.LatestVersion
+		}
+		for i := range packages {
+			packages[i].LatestVersion = latest[strings.ToLower(packages[i].Name)]
+		}
+	}
+
+	sort.Slice(packages, func(i, j int) bool {
+		return strings.ToLower(packages[i].Name) < strings.ToLower(packages[j].Name)
+	})
+	return packages, nil
+}
+
+// pipArgs checks a package action and builds the pip command line for it
+func (ts *TerminalServer) pipArgs(action string, packages []string, requirements string) ([]string, error) {
+	if len(packages) > maxPackagesPerRequest {
+		return nil, fmt.Errorf("too many packages (at most %d)", maxPackagesPerRequest)
+	}
+	if requirements != "" && action == PackageUninstall {
+		return nil, fmt.Errorf("uninstall takes package names, not a requirements file")
+	}
+	if len(packages) == 0 && requirements == "" {
+		return nil, fmt.Errorf("no packages named")
+	}
+
+	switch action {
+	case PackageInstall, PackageUpgrade:
+		args := []string{"install"}
+		if action == PackageUpgrade {
+			args = append(args, "--upgrade")
+		}
+		args = append(args, ts.pipIndexArgs()...)
+		for _, pkg := range packages {
+			if !validRequirement.MatchString(pkg) {
+				return nil, fmt.Errorf("invalid package %.60q", pkg)
+			}
+		}
+		if requirements != "" {
+			// The file's lines are passed as arguments rather than with -r, so
+			// pip never reads options or URLs from it, nor a version of it
+			// changed after it was checked
+			listed, err := ts.readRequirements(requirements)
+			if err != nil {
+				return nil, err
+			}
+			if len(listed) == 0 {
+				return nil, fmt.Errorf("%s lists no packages", requirements)
+			}
+			args = append(args, listed...)
+		}
+		return append(args, packages...), nil
+
+	case PackageUninstall:
+		for _, pkg := range packages {
+			if !validPackageName.MatchString(pkg) {
+				return nil, fmt.Errorf("invalid package name %.60q", pkg)
+			}
+		}
+		return append([]string{"uninstall", "--yes"}, packages...), nil
+
+	default:
+		return nil, fmt.Errorf("unknown action %q", action)
+	}
+}
+
+// Resolve a requirements file inside the working directory
+func (ts *TerminalServer) requirementsPath(path string) (string, error) {
+	if path == "" {
+		path = defaultRequirementsFile
+	}
+	absPath, err := ts.validateAndResolvePath(path)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(absPath); err == nil && info.IsDir() {
+		return "", fmt.Errorf("not a file: %s", path)
+	}
+	return absPath, nil
+}
+
+// readRequirements returns the requirements a requirements file lists. Only
+// names, extras, versions and environment markers are accepted; options such
+// as --index-url or -e, URLs and paths are refused.
+func (ts *TerminalServer) readRequirements(requirements string) ([]string, error) {
+	path, err := ts.requirementsPath(requirements)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("requirements file not found: %s", requirements)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var listed []string
+	lines := strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		number := i + 1
+		line := lines[i]
+		// A backslash at the end joins the next line
+		for strings.HasSuffix(line, "\\") && i+1 < len(lines) {
+			i++
+			line = strings.TrimSuffix(line, "\\") + lines[i]
+		}
+		line = strings.TrimSpace(requirementsComment.ReplaceAllString(line, ""))
+		if line == "" {
+			continue
+		}
+		if !validRequirementLine(line) {
+			return nil, fmt.Errorf("%s line %d: only package names, versions and markers are allowed, not %.60q", requirements, number, line)
+		}
+		if len(listed) == maxRequirementsPerFile {
+			return nil, fmt.Errorf("%s lists too many packages (at most %d)", requirements, maxRequirementsPerFile)
+		}
+		listed = append(listed, line)
+	}
+	return listed, nil
+}
+
+// A requirement with an optional environment marker, e.g. "tomli>=2; python_version < '3.11'"
+func validRequirementLine(line string) bool {
+	requirement, marker, hasMarker := strings.Cut(line, ";")
+	if !validRequirement.MatchString(strings.TrimSpace(requirement)) {
+		return false
+	}
+	return !hasMarker || validMarker.MatchString(marker)
+}
+
+// The interpreter a package request is about: the one named, else the one
+// a script (or the project root) would run with
+func (ts *TerminalServer) packageInterpreter(interpreter, file string) (Interpreter, error) {
+	return ts.interpreters.Resolve(filepath.Dir(file), interpreter)
+}
+
+// Package changes run code from the packages being installed, so they need
+// the same trust as a shell and are off when the shell is
+func (ts *TerminalServer) denyPackageChanges(w http.ResponseWriter, r *http.Request) bool {
+	if ts.denyUnlessPermitted(w, r, PermShell) {
+		return true
+	}
+	if !ts.shellEnabled {
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Package changes are disabled along with the shell"})
+		return true
+	}
+	return false
+}
+
+// packagesHandler lists the packages of an interpreter (GET ?interpreter=&file=,
+// ?outdated=1 also checks for updates) and starts an install, upgrade or
+// uninstall (POST), whose output is streamed as a run over /ws
+func (ts *TerminalServer) packagesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		interp, err := ts.packageInterpreter(query.Get("interpreter"), query.Get("file"))
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		packages, err := ts.listPackages(interp, query.Get("outdated") != "")
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Data: map[string]interface{}{
+			"interpreter": interp,
+			"packages":    packages,
+			"canChange":   ts.shellEnabled && ts.hasPermission(r, PermShell),
+		}})
+
+	case "POST":
+		if ts.denyPackageChanges(w, r) {
+			return
+		}
+		var req struct {
+			Action       string   `json:"action"`
+			Packages     []string `json:"packages"`
+			Requirements string   `json:"requirements"` // file to install from
+			Interpreter  string   `json:"interpreter"`
+			File         string   `json:"file"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Invalid request body"})
+			return
+		}
+		args, err := ts.pipArgs(req.Action, req.Packages, req.Requirements)
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		interp, err := ts.packageInterpreter(req.Interpreter, req.File)
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+
+		identity := ts.clientIdentity(r)
+		run := NewScriptRun(identity, "pip", RunModeConcurrent, RunOptions{
+			Args:        args,
+			Env:         map[string]string{"PIP_DISABLE_PIP_VERSION_CHECK": "1"},
+			Interpreter: interp.ID,
+		})
+		run.Module = true
+		ts.submitRun(run)
+		if ts.verbose {
+			log.Printf("📦 %s started pip %s for %s (run %s)", identity, strings.Join(args, " "), interp.Name, run.ID)
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Started pip " + args[0], Data: map[string]string{"runId": run.ID}})
+
+	default:
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Method not allowed"})
+	}
+}
+
+// requirementsHandler reads a requirements file (GET ?path=), saves it (PUT
+// {"path", "content"}) and writes pip freeze of an interpreter into it (POST
+// {"path", "interpreter", "file"})
+func (ts *TerminalServer) requirementsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		path := r.URL.Query().Get("path")
+		absPath, err := ts.requirementsPath(path)
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		content, err := os.ReadFile(absPath)
+		if err != nil && !os.IsNotExist(err) {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Failed to read file: " + err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Data: map[string]interface{}{
+			"content": string(content),
+			"exists":  err == nil,
+		}})
+
+	case "PUT", "POST":
+		if ts.denyUnlessPermitted(w, r, PermFilesWrite) {
+			return
+		}
+		if !ts.fileManagerEnabled {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "File management disabled"})
+			return
+		}
+		var req struct {
+			Path        string `json:"path"`
+			Content     string `json:"content"`
+			Interpreter string `json:"interpreter"`
+			File        string `json:"file"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Invalid request body"})
+			return
+		}
+		if req.Path == "" {
+			req.Path = defaultRequirementsFile
+		}
+		absPath, err := ts.requirementsPath(req.Path)
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+
+		content := req.Content
+		if r.Method == "POST" {
+			interp, err := ts.packageInterpreter(req.Interpreter, req.File)
+			if err != nil {
+				json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+				return
+			}
+			output, err := ts.pipQuery(interp, "freeze")
+			if err != nil {
+				json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+				return
+			}
+			content = string(output)
+		}
+
+		if err := os.WriteFile(absPath, []byte(content), 0644); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Failed to save file: " + err.Error()})
+			return
+		}
+		ts.audit(r, AuditEvent{Event: AuditFileSave, Path: req.Path, Size: int64(len(content))})
+		if ts.verbose {
+			log.Printf("📦 %s wrote %s", ts.clientIdentity(r), req.Path)
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Requirements saved", Data: map[string]string{"content": content}})
+
+	default:
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Method not allowed"})
+	}
+}
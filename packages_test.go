@@ -0,0 +1,292 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidRequirement(t *testing.T) {
+	tests := []struct {
+		requirement string
+		valid       bool
+	}{
+		{"requests", true},
+		{"requests==2.31.0", true},
+		{"requests[socks]>=2.31,<3", true},
+		{"requests [socks] >= 2.31", false},
+		{"zope.interface", true},
+		{"typing_extensions~=4.8", true},
+		{"torch==2.1.0+cpu", true},
+		{"numpy!=1.25.*", true},
+		{"pip===23.3", true},
+		{"a", true},
+		{"", false},
+		{"-e .", false},
+		{"--index-url=https://evil.example.com/simple", false},
+		{"-r other.txt", false},
+		{"requests @ https://evil.example.com/requests.whl", false},
+		{"https://evil.example.com/requests.whl", false},
+		{"./local-package", false},
+		{"../wheels/requests-2.31.0-py3-none-any.whl", false},
+		{"git+https://github.com/psf/requests", false},
+		{"requests==2.31; rm -rf /", false},
+		{"requests\n--extra-index-url=https://evil.example.com", false},
+		{"-requests", false},
+		{"requests-", false},
+	}
+	for _, test := range tests {
+		if got := validRequirement.MatchString(test.requirement); got != test.valid {
+			t.Errorf("validRequirement(%q) = %t, want %t", test.requirement, got, test.valid)
+		}
+	}
+}
+
+func TestValidRequirementLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		valid bool
+	}{
+		{"tomli>=2; python_version < '3.11'", true},
+		{`pywin32==306 ; sys_platform == "win32"`, true},
+		{`uvloop; platform_python_implementation != "PyPy" and sys_platform != "win32"`, true},
+		{"requests; extra == 'socks'", true},
+		{"requests; python_version < '3.11' https://evil.example.com", false},
+		{"requests @ file:///tmp/x.whl; python_version > '3'", false},
+		{"; python_version > '3'", false},
+	}
+	for _, test := range tests {
+		if got := validRequirementLine(test.line); got != test.valid {
+			t.Errorf("validRequirementLine(%q) = %t, want %t", test.line, got, test.valid)
+		}
+	}
+}
+
+func TestPipArgs(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("requirements.txt", "# Pinned by pip freeze\nrequests==2.31.0\n\nnumpy>=1.26 # for arrays\r\n"+
+		"tomli>=2; python_version < '3.11'\nflask\\\n==3.0.0\n")
+	writeFile("index.txt", "requests\n--index-url https://evil.example.com/simple\n")
+	writeFile("extra-index.txt", "--extra-index-url=https://evil.example.com/simple\nrequests\n")
+	writeFile("editable.txt", "-e git+https://github.com/psf/requests#egg=requests\n")
+	writeFile("nested.txt", "-r requirements.txt\n")
+	writeFile("direct.txt", "requests @ https://evil.example.com/requests.whl\n")
+	writeFile("comments.txt", "# nothing to install\n\n")
+	os.Mkdir(filepath.Join(dir, "folder"), 0755)
+	freeze := "pkg0==1.0\n"
+	for i := 1; i <= maxRequirementsPerFile; i++ {
+		freeze += "pkg" + strings.Repeat("x", i%5) + "==1.0\n"
+	}
+	writeFile("huge.txt", freeze)
+
+	tooMany := make([]string, maxPackagesPerRequest+1)
+	for i := range tooMany {
+		tooMany[i] = "requests"
+	}
+
+	tests := []struct {
+		name         string
+		wheelhouse   string
+		action       string
+		packages     []string
+		requirements string
+		want         []string // nil when the request must be refused
+	}{
+		{"install", "", PackageInstall, []string{"requests>=2.31", "numpy"}, "", []string{"install", "requests>=2.31", "numpy"}},
+		{"upgrade", "", PackageUpgrade, []string{"requests"}, "", []string{"install", "--upgrade", "requests"}},
+		{"uninstall", "", PackageUninstall, []string{"requests", "numpy"}, "", []string{"uninstall", "--yes", "requests", "numpy"}},
+		{"wheelhouse only", "/srv/wheels", PackageInstall, []string{"requests"}, "", []string{"install", "--no-index", "--find-links", "/srv/wheels", "requests"}},
+		{"uninstall ignores the wheelhouse", "/srv/wheels", PackageUninstall, []string{"requests"}, "", []string{"uninstall", "--yes", "requests"}},
+		{
+			"requirements file", "/srv/wheels", PackageInstall, []string{"pandas"}, "requirements.txt",
+			[]string{"install", "--no-index", "--find-links", "/srv/wheels", "requests==2.31.0", "numpy>=1.26", "tomli>=2; python_version < '3.11'", "flask==3.0.0", "pandas"},
+		},
+		{"version specifier on uninstall", "", PackageUninstall, []string{"requests==2.31"}, "", nil},
+		{"requirements file on uninstall", "", PackageUninstall, nil, "requirements.txt", nil},
+		{"nothing named", "", PackageInstall, nil, "", nil},
+		{"too many packages", "", PackageInstall, tooMany, "", nil},
+		{"unknown action", "", "download", []string{"requests"}, "", nil},
+		{"option as package", "", PackageInstall, []string{"--index-url=https://evil.example.com/simple"}, "", nil},
+		{"URL as package", "", PackageInstall, []string{"https://evil.example.com/requests.whl"}, "", nil},
+		{"index URL in requirements", "/srv/wheels", PackageInstall, nil, "index.txt", nil},
+		{"extra index URL in requirements", "/srv/wheels", PackageInstall, nil, "extra-index.txt", nil},
+		{"editable requirement", "", PackageInstall, nil, "editable.txt", nil},
+		{"nested requirements file", "", PackageInstall, nil, "nested.txt", nil},
+		{"direct URL in requirements", "/srv/wheels", PackageInstall, nil, "direct.txt", nil},
+		{"empty requirements file", "", PackageInstall, nil, "comments.txt", nil},
+		{"too long requirements file", "", PackageInstall, nil, "huge.txt", nil},
+		{"missing requirements file", "", PackageInstall, nil, "missing.txt", nil},
+		{"requirements folder", "", PackageInstall, nil, "folder", nil},
+		{"requirements outside the working directory", "", PackageInstall, nil, "../requirements.txt", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := &TerminalServer{workingDir: dir, wheelhouse: test.wheelhouse}
+			args, err := ts.pipArgs(test.action, test.packages, test.requirements)
+			if test.want == nil {
+				if err == nil {
+					t.Errorf("allowed: %q", args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(args, test.want) {
+				t.Errorf("pipArgs = %q, want %q", args, test.want)
+			}
+		})
+	}
+}
+
+func TestPackageChangesNeedShell(t *testing.T) {
+	ts := &TerminalServer{authConfig: &AuthConfig{Enabled: true}, workingDir: t.TempDir(), shellEnabled: true}
+	handler := ts.requirePermission(PermRun, ts.packagesHandler)
+
+	for _, role := range []string{"viewer", "runner"} {
+		r := httptest.NewRequest("POST", "/api/packages", strings.NewReader(`{"action": "install", "packages": ["requests"]}`))
+		r = r.WithContext(context.WithValue(r.Context(), roleContextKey, role))
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s installing packages: status %d, want %d", role, w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+// writeWheel builds a pure-Python wheel of an empty package in dir
+func writeWheel(t *testing.T, dir, name, version string) {
+	t.Helper()
+	distInfo := fmt.Sprintf("%s-%s.dist-info", name, version)
+	files := map[string]string{
+		name + "/__init__.py":  fmt.Sprintf("VERSION = %q\n", version),
+		distInfo + "/METADATA": fmt.Sprintf("Metadata-Version: 2.1\nName: %s\nVersion: %s\n", strings.ReplaceAll(name, "_", "-"), version),
+		distInfo + "/WHEEL":    "Wheel-Version: 1.0\nGenerator: snakeflex-test\nRoot-Is-Purelib: true\nTag: py3-none-any\n",
+	}
+	names := make([]string, 0, len(files))
+	for path := range files {
+		names = append(names, path)
+	}
+	sort.Strings(names)
+
+	var record strings.Builder
+	for _, path := range names {
+		sum := sha256.Sum256([]byte(files[path]))
+		fmt.Fprintf(&record, "%s,sha256=%s,%d\n", path, base64.RawURLEncoding.EncodeToString(sum[:]), len(files[path]))
+	}
+	fmt.Fprintf(&record, "%s/RECORD,,\n", distInfo)
+	files[distInfo+"/RECORD"] = record.String()
+	names = append(names, distInfo+"/RECORD")
+
+	file, err := os.Create(filepath.Join(dir, fmt.Sprintf("%s-%s-py3-none-any.whl", name, version)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	archive := zip.NewWriter(file)
+	for _, path := range names {
+		writer, err := archive.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte(files[path]))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// An install goes through the packages API and a run of pip, and finds the
+// package in the wheelhouse without an index
+func TestInstallFromWheelhouse(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creates a virtual environment")
+	}
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("no python3")
+	}
+	project := t.TempDir()
+	if output, err := exec.Command(python, "-m", "venv", filepath.Join(project, ".venv")).CombinedOutput(); err != nil {
+		t.Skipf("cannot create a virtual environment: %v\n%s", err, output)
+	}
+	wheelhouse := t.TempDir()
+	writeWheel(t, wheelhouse, "snakeflex_demo", "1.0")
+
+	interpreters, err := NewInterpreterManager(project, python, filepath.Join(project, defaultInterpreterFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &TerminalServer{
+		authConfig:   &AuthConfig{},
+		workingDir:   project,
+		shellEnabled: true,
+		wheelhouse:   wheelhouse,
+		interpreters: interpreters,
+		runRegistry:  NewRunRegistry(),
+	}
+
+	w := httptest.NewRecorder()
+	ts.packagesHandler(w, httptest.NewRequest("POST", "/api/packages", strings.NewReader(`{"action": "install", "packages": ["snakeflex-demo==1.0"]}`)))
+	var response struct {
+		Success bool
+		Message string
+		Data    struct{ RunID string }
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || !response.Success {
+		t.Fatalf("starting the install: %s", w.Body)
+	}
+	run := ts.runRegistry.Lookup("local", response.Data.RunID)
+	if run == nil {
+		t.Fatalf("no run %q", response.Data.RunID)
+	}
+	select {
+	case <-run.done:
+	case <-time.After(2 * time.Minute):
+		run.Stop()
+		t.Fatal("pip did not finish")
+	}
+
+	run.mutex.Lock()
+	messages, _ := run.output.Since(0)
+	run.mutex.Unlock()
+	var output strings.Builder
+	for _, msg := range messages {
+		fmt.Fprintf(&output, "%s: %s\n", msg.Type, msg.Content)
+	}
+	if !strings.Contains(output.String(), "completed: Exit code: 0") {
+		t.Fatalf("pip failed:\n%s", output.String())
+	}
+
+	interp, err := ts.packageInterpreter("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packages, err := ts.listPackages(interp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(packages, Package{Name: "snakeflex-demo", Version: "1.0"}) {
+		t.Errorf("snakeflex-demo 1.0 is not installed in %s: %v", interp.Name, packages)
+	}
+}
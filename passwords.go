@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2id parameters for new hashes; the time=1, 64 MB setting recommended by
+// the argon2 package. Existing hashes carry their own parameters.
+const (
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+var legacySHA256Hash = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// Unsalted SHA-256, kept only so users files written before argon2id and
+// bcrypt support keep working
+func hashPassword(password string) string {
+	hasher := sha256.New()
+	hasher.Write([]byte(password))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// generatePasswordHash returns an argon2id hash in the PHC string format:
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>
+func generatePasswordHash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func generateBcryptHash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// normalizePasswordHash trims a configured hash and rejects formats we cannot verify
+func normalizePasswordHash(encoded string) (string, error) {
+	encoded = strings.TrimSpace(encoded)
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		if _, _, _, err := parseArgon2Hash(encoded); err != nil {
+			return "", err
+		}
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(encoded)); err != nil {
+			return "", fmt.Errorf("invalid bcrypt hash: %v", err)
+		}
+	case legacySHA256Hash.MatchString(encoded):
+		encoded = strings.ToLower(encoded)
+	default:
+		return "", fmt.Errorf("unsupported password hash format (expected argon2id, bcrypt or hex SHA-256)")
+	}
+	return encoded, nil
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+func parseArgon2Hash(encoded string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters")
+	}
+	if params.time == 0 || params.threads == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id key")
+	}
+	return params, salt, key, nil
+}
+
+// verifyPassword checks a password against an argon2id, bcrypt or legacy
+// SHA-256 hash, comparing in constant time
+func verifyPassword(encoded, password string) bool {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := parseArgon2Hash(encoded)
+		if err != nil {
+			return false
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(candidate, key) == 1
+	case strings.HasPrefix(encoded, "$2"):
+		// bcrypt compares in constant time itself
+		return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+	default:
+		return subtle.ConstantTimeCompare([]byte(hashPassword(password)), []byte(encoded)) == 1
+	}
+}
+
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// Verify against a throwaway hash so unknown usernames cost as much as wrong passwords
+func burnPasswordCheck(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = generatePasswordHash("snakeflex-dummy-password")
+	})
+	verifyPassword(dummyHash, password)
+}
+
+// Environment variable that can hold the password hash instead of a flag
+const passHashEnv = "SNAKEFLEX_PASS_HASH"
+
+// loadPasswordHash picks the single-user password hash from --pass-hash,
+// --pass-hash-file or the environment, in that order
+func loadPasswordHash(flagHash, hashFile string) (string, error) {
+	if flagHash != "" && hashFile != "" {
+		return "", fmt.Errorf("use either --pass-hash or --pass-hash-file, not both")
+	}
+	switch {
+	case flagHash != "":
+		return flagHash, nil
+	case hashFile != "":
+		data, err := os.ReadFile(hashFile)
+		if err != nil {
+			return "", fmt.Errorf("reading password hash file: %v", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	default:
+		return os.Getenv(passHashEnv), nil
+	}
+}
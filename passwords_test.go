@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	argon2Hash, err := generatePasswordHash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyHash := hashPassword("correct horse")
+	// Same parameters and salt, different key
+	otherKey := argon2Hash[:strings.LastIndex(argon2Hash, "$")+1] + "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		{"argon2id", argon2Hash, "correct horse", true},
+		{"argon2id, wrong password", argon2Hash, "correct horse ", false},
+		{"argon2id, other key", otherKey, "correct horse", false},
+		{"argon2id, truncated", argon2Hash[:strings.LastIndex(argon2Hash, "$")], "correct horse", false},
+		{"argon2id, no key", argon2Hash[:strings.LastIndex(argon2Hash, "$")+1], "correct horse", false},
+		{"argon2id, known vector", "$argon2id$v=19$m=65536,t=1,p=4$bg71PQ3hJKdDVMk2Cugl8A$rTOioGxqLeoIxJ+rnPzFQ2dhLe7nTb1PGLLkKxLtxDE", "pw", true},
+		{"bcrypt", string(bcryptHash), "correct horse", true},
+		{"bcrypt, wrong password", string(bcryptHash), "Correct horse", false},
+		{"legacy SHA-256", legacyHash, "correct horse", true},
+		{"legacy SHA-256, wrong password", legacyHash, "battery staple", false},
+		{"empty hash", "", "", false},
+		{"empty hash and password", "", "correct horse", false},
+		{"the hash as password", legacyHash, legacyHash, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := verifyPassword(test.hash, test.password); got != test.want {
+				t.Errorf("verifyPassword(%q, %q) = %t, want %t", test.hash, test.password, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizePasswordHash(t *testing.T) {
+	argon2Hash, err := generatePasswordHash("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyHash := hashPassword("pw")
+
+	tests := []struct {
+		hash  string
+		want  string
+		valid bool
+	}{
+		{argon2Hash, argon2Hash, true},
+		{"  " + argon2Hash + "\n", argon2Hash, true},
+		{"$2a$04$6BR6ZoRqgPM8ncBJnyI6NOBM0uWbp4ejP/Lj3KNimkrJ9Iq7WjSXi", "$2a$04$6BR6ZoRqgPM8ncBJnyI6NOBM0uWbp4ejP/Lj3KNimkrJ9Iq7WjSXi", true},
+		{strings.ToUpper(legacyHash), legacyHash, true},
+		{"$argon2id$v=16$m=65536,t=1,p=4$c2FsdA$a2V5", "", false},
+		{"$argon2id$v=19$m=65536,t=0,p=4$c2FsdA$a2V5", "", false},
+		{"$argon2id$v=19$m=65536,t=1,p=0$c2FsdA$a2V5", "", false},
+		{"$argon2id$v=19$m=65536,t=1,p=4$not base64!$a2V5", "", false},
+		{"$argon2id$v=19$m=65536,t=1,p=4$c2FsdA", "", false},
+		{"$argon2i$v=19$m=65536,t=1,p=4$c2FsdA$a2V5", "", false},
+		{"$2a$04$short", "", false},
+		{"$1$saltsalt$md5cryptIsNotSupported", "", false},
+		{legacyHash[:63], "", false},
+		{"pw", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		got, err := normalizePasswordHash(test.hash)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("normalizePasswordHash(%q) = %q, want an error", test.hash, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("normalizePasswordHash(%q) = %q, %v, want %q", test.hash, got, err, test.want)
+		}
+	}
+}
+
+func TestLoadPasswordHash(t *testing.T) {
+	dir := t.TempDir()
+	hashFile := filepath.Join(dir, "pass.hash")
+	if err := os.WriteFile(hashFile, []byte("$2a$04$fromthefile\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(passHashEnv, "$2a$04$fromtheenvironment")
+
+	tests := []struct {
+		name     string
+		flagHash string
+		hashFile string
+		want     string
+		valid    bool
+	}{
+		{"flag", "$2a$04$fromtheflag", "", "$2a$04$fromtheflag", true},
+		{"file", "", hashFile, "$2a$04$fromthefile", true},
+		{"environment", "", "", "$2a$04$fromtheenvironment", true},
+		{"flag and file", "$2a$04$fromtheflag", hashFile, "", false},
+		{"missing file", "", filepath.Join(dir, "missing.hash"), "", false},
+	}
+	for _, test := range tests {
+		got, err := loadPasswordHash(test.flagHash, test.hashFile)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: loadPasswordHash = %q, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s: loadPasswordHash = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// Put pipe-based scripts into their own process group so that a stop request
+// reaches any children they spawned. PTY scripts already get a new session
+// (and therefore a new group) from pty.Start.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// Deliver a signal to the whole process group led by the given process
+func signalProcessGroup(process *os.Process, sig syscall.Signal) error {
+	if err := syscall.Kill(-process.Pid, sig); err != nil {
+		// Fall back to the leader alone if the group is already gone
+		return process.Signal(sig)
+	}
+	return nil
+}
+
+// Name of the signal that terminated the process, or "" if it exited normally
+func exitSignal(state *os.ProcessState) string {
+	if state == nil {
+		return ""
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return ""
+	}
+	return signalName(status.Signal())
+}
+
+// Run reload whenever the server receives SIGHUP
+func watchReloadSignal(reload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			reload()
+		}
+	}()
+}
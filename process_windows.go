@@ -0,0 +1,29 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// Windows has no process groups in the POSIX sense; taskkill /T walks the tree instead
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// Windows cannot deliver POSIX signals, so every signal terminates the process tree
+func signalProcessGroup(process *os.Process, sig syscall.Signal) error {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(process.Pid)).Run(); err != nil {
+		return process.Kill()
+	}
+	return nil
+}
+
+// Signal information is not available from Windows exit statuses
+func exitSignal(state *os.ProcessState) string {
+	return ""
+}
+
+// Windows has no SIGHUP; configuration is only read at startup
+func watchReloadSignal(reload func()) {}
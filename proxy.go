@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies are the addresses whose forwarding headers are believed
+type TrustedProxies []*net.IPNet
+
+// parseTrustedProxies reads comma-separated CIDRs or single addresses
+func parseTrustedProxies(list string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, entry := range splitList(list) {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (tp TrustedProxies) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range tp {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Address of the direct peer of a request
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP finds the real client of a request. X-Forwarded-For is read from
+// the right, where our own proxies appended, up to the first address that is
+// not a trusted proxy; entries further left are whatever the client claimed.
+func clientIP(r *http.Request, proxies TrustedProxies) string {
+	peer := remoteIP(r)
+	if peer == nil {
+		return r.RemoteAddr
+	}
+	if !proxies.Contains(peer) {
+		return peer.String()
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := forwardedIP(hops[i])
+		if ip == nil {
+			// Garbage was appended by the client, not by a proxy we trust
+			break
+		}
+		client = ip.String()
+		if !proxies.Contains(ip) {
+			return client
+		}
+	}
+	if client != "" {
+		return client
+	}
+
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP.String()
+	}
+	return peer.String()
+}
+
+// An X-Forwarded-For entry is an address, which some proxies write with a port
+func forwardedIP(entry string) net.IP {
+	entry = strings.TrimSpace(entry)
+	if host, _, err := net.SplitHostPort(entry); err == nil {
+		entry = host
+	}
+	return net.ParseIP(entry)
+}
+
+// Whether the request came straight from one of the trusted proxies
+func (ts *TerminalServer) fromTrustedProxy(r *http.Request) bool {
+	return ts.trustedProxies.Contains(remoteIP(r))
+}
+
+// A forwarded path prefix must look like a plain absolute path
+func validForwardedPrefix(prefix string) bool {
+	if !strings.HasPrefix(prefix, "/") || strings.HasPrefix(prefix, "//") {
+		return false
+	}
+	return !strings.ContainsAny(prefix, "\"'<>\\ ?#;\t\r\n")
+}
+
+// ProxyAuth accepts users already authenticated by a reverse proxy such as
+// oauth2-proxy or Authelia, identified by a request header
+type ProxyAuth struct {
+	Header       string
+	GroupsHeader string
+	GroupRoles   map[string]string
+	DefaultRole  string
+}
+
+// proxyUser returns the user a trusted proxy vouches for. Accounts from the
+// users file keep their role (returned as ""); others get one from their groups.
+func (ts *TerminalServer) proxyUser(r *http.Request) (string, string, bool) {
+	username := strings.TrimSpace(r.Header.Get(ts.proxyAuth.Header))
+	if username == "" {
+		return "", "", false
+	}
+	if !ts.fromTrustedProxy(r) {
+		if ts.verbose {
+			log.Printf("⚠️  Ignoring %s header from untrusted address %s", ts.proxyAuth.Header, r.RemoteAddr)
+		}
+		return "", "", false
+	}
+	if !validUsername.MatchString(username) {
+		if ts.verbose {
+			log.Printf("⚠️  Proxy sent invalid username %q", username)
+		}
+		return "", "", false
+	}
+	if ts.authConfig.Users.Exists(username) {
+		return username, "", true
+	}
+
+	role := ts.proxyAuth.DefaultRole
+	if ts.proxyAuth.GroupsHeader != "" {
+		for _, group := range splitList(r.Header.Get(ts.proxyAuth.GroupsHeader)) {
+			if mapped, ok := ts.proxyAuth.GroupRoles[group]; ok && roleRank(mapped) > roleRank(role) {
+				role = mapped
+			}
+		}
+	}
+	return username, role, true
+}
+
+// serveWithProxyUser runs the handler as the user a trusted proxy identified
+func (ts *TerminalServer) serveWithProxyUser(w http.ResponseWriter, r *http.Request, username, role string, next http.HandlerFunc) {
+	ctx := context.WithValue(r.Context(), userContextKey, username)
+	ctx = context.WithValue(ctx, externalAuthContextKey, true)
+	if role != "" {
+		ctx = context.WithValue(ctx, roleContextKey, role)
+	}
+	ts.serveWithCSRF(w, r.WithContext(ctx), ts.signedCSRFToken("proxy:"+username), next)
+}
+
+// With only proxy authentication there is no login page to send people to
+func (ts *TerminalServer) proxyAuthOnly() bool {
+	return ts.proxyAuth != nil && ts.oidc == nil && ts.clientCertAuth == nil && len(ts.authConfig.Users.Usernames()) == 0
+}
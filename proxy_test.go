@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.5, 172.18.0.0/16,::1/128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		trusted bool
+	}{
+		{"10.0.0.5", true},
+		{"10.0.0.6", false},
+		{"172.18.3.4", true},
+		{"172.19.0.1", false},
+		{"::1", true},
+		{"::2", false},
+		{"::ffff:10.0.0.5", true},
+	}
+	for _, test := range tests {
+		if got := proxies.Contains(forwardedIP(test.ip)); got != test.trusted {
+			t.Errorf("Contains(%s) = %t, want %t", test.ip, got, test.trusted)
+		}
+	}
+	if proxies.Contains(nil) {
+		t.Error("Contains(nil) = true")
+	}
+
+	for _, list := range []string{"10.0.0", "10.0.0.0/33", "proxy.example.com", "::1/129"} {
+		if _, err := parseTrustedProxies(list); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded", list)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("127.0.0.1/8,::1/128,10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:5000", nil, "", "203.0.113.7"},
+		{"untrusted peer's headers are ignored", "203.0.113.7:5000", []string{"198.51.100.1"}, "198.51.100.2", "203.0.113.7"},
+		{"one trusted proxy", "127.0.0.1:5000", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"spoofed entries left of the real client", "127.0.0.1:5000", []string{"1.1.1.1, 198.51.100.1"}, "", "198.51.100.1"},
+		{"chain of trusted proxies", "127.0.0.1:5000", []string{"198.51.100.1, 10.0.0.2, 10.0.0.3"}, "", "198.51.100.1"},
+		{"repeated headers", "127.0.0.1:5000", []string{"1.1.1.1", "198.51.100.1, 10.0.0.2"}, "", "198.51.100.1"},
+		{"only trusted hops", "127.0.0.1:5000", []string{"10.0.0.2, 10.0.0.3"}, "", "10.0.0.2"},
+		{"malformed entry stops the walk", "127.0.0.1:5000", []string{"198.51.100.1, not-an-ip, 10.0.0.2"}, "", "10.0.0.2"},
+		{"malformed last entry", "127.0.0.1:5000", []string{"198.51.100.1, not-an-ip"}, "198.51.100.9", "198.51.100.9"},
+		{"empty entries", "127.0.0.1:5000", []string{" , "}, "", "127.0.0.1"},
+		{"IPv4 with port", "127.0.0.1:5000", []string{"198.51.100.1:4711"}, "", "198.51.100.1"},
+		{"IPv6", "[::1]:5000", []string{"2001:db8::1"}, "", "2001:db8::1"},
+		{"IPv6 with port", "[::1]:5000", []string{"[2001:db8::1]:4711"}, "", "2001:db8::1"},
+		{"X-Real-IP without X-Forwarded-For", "127.0.0.1:5000", nil, " 198.51.100.1 ", "198.51.100.1"},
+		{"invalid X-Real-IP", "127.0.0.1:5000", nil, "<script>", "127.0.0.1"},
+		{"trusted peer without headers", "[::1]:5000", nil, "", "::1"},
+		{"unparsable remote address", "@", []string{"198.51.100.1"}, "", "@"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, forwarded := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", forwarded)
+			}
+			if test.realIP != "" {
+				r.Header.Set("X-Real-IP", test.realIP)
+			}
+			if got := clientIP(r, proxies); got != test.want {
+				t.Errorf("clientIP = %q, want %q", got, test.want)
+			}
+
+			// By default no proxy is trusted, not even one on this host
+			if got, want := clientIP(r, nil), remoteHost(test.remoteAddr); got != want {
+				t.Errorf("clientIP without trusted proxies = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// Host part of a RemoteAddr, or all of it when it has no port
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func TestValidForwardedPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		valid  bool
+	}{
+		{"/snakeflex", true},
+		{"/snakeflex/", true},
+		{"/a/b-c_d.e", true},
+		{"/", true},
+		{"", false},
+		{"snakeflex", false},
+		{"//evil.example.com", false},
+		{"https://evil.example.com", false},
+		{"/a\"><script>", false},
+		{"/a'b", false},
+		{"/a\\b", false},
+		{"/a b", false},
+		{"/a?b", false},
+		{"/a#b", false},
+		{"/a;b", false},
+		{"/a\r\nSet-Cookie: x", false},
+		{"/a\tb", false},
+	}
+	for _, test := range tests {
+		if got := validForwardedPrefix(test.prefix); got != test.valid {
+			t.Errorf("validForwardedPrefix(%q) = %t, want %t", test.prefix, got, test.valid)
+		}
+	}
+}
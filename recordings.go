@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Terminal size assumed until a client reports its own
+const (
+	defaultRecordingCols = 80
+	defaultRecordingRows = 24
+)
+
+// How much of the end of a recording is read to find its duration
+const recordingTailSize = 64 << 10
+
+// Recorder writes one terminal session as an asciicast v2 file: a JSON
+// header line, then one [seconds, code, data] event per line. Output is
+// recorded, keyboard input is not. A nil *Recorder records nothing.
+type Recorder struct {
+	file    *os.File
+	writer  *bufio.Writer
+	started time.Time
+	pending []byte // start of a UTF-8 sequence split across reads
+	mutex   sync.Mutex
+}
+
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+func (rec *Recorder) event(code, data string) {
+	elapsed := json.Number(strconv.FormatFloat(time.Since(rec.started).Seconds(), 'f', 6, 64))
+	line, _ := json.Marshal([]interface{}{elapsed, code, data})
+	rec.writer.Write(line)
+	rec.writer.WriteByte('\n')
+	rec.writer.Flush()
+}
+
+// Output records bytes written to the terminal
+func (rec *Recorder) Output(data []byte) {
+	if rec == nil {
+		return
+	}
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.file == nil {
+		return
+	}
+
+	// Hold back an incomplete trailing character so it is not mangled in JSON
+	data = append(rec.pending, data...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	rec.pending = append([]byte(nil), data[cut:]...)
+	if cut > 0 {
+		rec.event("o", string(data[:cut]))
+	}
+}
+
+func (rec *Recorder) Resize(cols, rows int) {
+	if rec == nil {
+		return
+	}
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.file != nil {
+		rec.event("r", fmt.Sprintf("%dx%d", cols, rows))
+	}
+}
+
+func (rec *Recorder) Close() {
+	if rec == nil {
+		return
+	}
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.file == nil {
+		return
+	}
+	if len(rec.pending) > 0 {
+		rec.event("o", string(rec.pending))
+	}
+	rec.writer.Flush()
+	rec.file.Close()
+	rec.file = nil
+}
+
+// recordingReader copies everything read from a terminal into a recording
+type recordingReader struct {
+	io.ReadCloser
+	rec *Recorder
+}
+
+func (rr recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.ReadCloser.Read(p)
+	if n > 0 {
+		rr.rec.Output(p[:n])
+	}
+	return n, err
+}
+
+// Reader wraps a terminal's output so it is recorded as it is read
+func (rec *Recorder) Reader(r io.ReadCloser) io.ReadCloser {
+	if rec == nil {
+		return r
+	}
+	return recordingReader{ReadCloser: r, rec: rec}
+}
+
+// RecordingInfo describes a finished or ongoing recording
+type RecordingInfo struct {
+	ID        string    `json:"id"` // owner/file name
+	Owner     string    `json:"owner"`
+	Kind      string    `json:"kind"` // "shell" or "run"
+	Title     string    `json:"title"`
+	StartedAt time.Time `json:"startedAt"`
+	Duration  float64   `json:"duration"` // seconds
+	Size      int64     `json:"size"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+}
+
+// RecordingStore keeps recordings in one directory per owner
+type RecordingStore struct {
+	dir string
+}
+
+// Owners become directory names, so "." and ".." are refused even though
+// they are valid usernames
+func validRecordingOwner(owner string) bool {
+	return validUsername.MatchString(owner) && strings.Trim(owner, ".") != ""
+}
+
+func NewRecordingStore(dir string) (*RecordingStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating recording directory: %v", err)
+	}
+	return &RecordingStore{dir: dir}, nil
+}
+
+// Start begins recording a session. Failures are logged and leave the
+// session unrecorded rather than stopping it.
+func (rs *RecordingStore) Start(owner, kind, id, title string) *Recorder {
+	if rs == nil {
+		return nil
+	}
+	if !validRecordingOwner(owner) {
+		log.Printf("⚠️ Not recording %s %s: unusable owner %q", kind, id, owner)
+		return nil
+	}
+	ownerDir := filepath.Join(rs.dir, owner)
+	if err := os.MkdirAll(ownerDir, 0700); err != nil {
+		log.Printf("⚠️ Not recording %s %s: %v", kind, id, err)
+		return nil
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s-%s.cast", kind, now.Format("20060102-150405"), id)
+	file, err := os.OpenFile(filepath.Join(ownerDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Printf("⚠️ Not recording %s %s: %v", kind, id, err)
+		return nil
+	}
+
+	rec := &Recorder{file: file, writer: bufio.NewWriter(file), started: now}
+	header, _ := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     defaultRecordingCols,
+		Height:    defaultRecordingRows,
+		Timestamp: now.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": "xterm-256color", "SHELL": os.Getenv("SHELL")},
+	})
+	rec.writer.Write(header)
+	rec.writer.WriteByte('\n')
+	rec.writer.Flush()
+	return rec
+}
+
+// Resolve a recording ID to its file, refusing anything outside the store
+func (rs *RecordingStore) path(id string) (string, string, error) {
+	owner, name, ok := strings.Cut(id, "/")
+	if !ok || !validRecordingOwner(owner) || name != filepath.Base(name) || !strings.HasSuffix(name, ".cast") || strings.HasPrefix(name, ".") {
+		return "", "", fmt.Errorf("invalid recording id")
+	}
+	return filepath.Join(rs.dir, owner, name), owner, nil
+}
+
+// List returns the recordings of one owner, or of everyone when owner is
+// empty, newest first
+func (rs *RecordingStore) List(owner string) ([]RecordingInfo, error) {
+	var owners []string
+	if owner != "" {
+		owners = []string{owner}
+	} else {
+		entries, err := os.ReadDir(rs.dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && validRecordingOwner(entry.Name()) {
+				owners = append(owners, entry.Name())
+			}
+		}
+	}
+
+	list := []RecordingInfo{}
+	for _, o := range owners {
+		entries, err := os.ReadDir(filepath.Join(rs.dir, o))
+		if err != nil {
+			continue // nothing recorded yet
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".cast") {
+				continue
+			}
+			if info, err := readRecordingInfo(filepath.Join(rs.dir, o, entry.Name())); err == nil {
+				info.ID = o + "/" + entry.Name()
+				info.Owner = o
+				list = append(list, info)
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+	return list, nil
+}
+
+// Read a recording's header, and its duration from the time of its last event
+func readRecordingInfo(path string) (RecordingInfo, error) {
+	var info RecordingInfo
+	file, err := os.Open(path)
+	if err != nil {
+		return info, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return info, err
+	}
+
+	headerLine, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return info, err
+	}
+	var header asciicastHeader
+	if err := json.Unmarshal(headerLine, &header); err != nil || header.Version != 2 {
+		return info, fmt.Errorf("not an asciicast v2 file")
+	}
+	info.Kind, _, _ = strings.Cut(filepath.Base(path), "-")
+	info.Title = header.Title
+	info.StartedAt = time.Unix(header.Timestamp, 0)
+	info.Width = header.Width
+	info.Height = header.Height
+	info.Size = stat.Size()
+
+	offset := stat.Size() - recordingTailSize
+	if offset < int64(len(headerLine)) {
+		offset = int64(len(headerLine))
+	}
+	tail := make([]byte, stat.Size()-offset)
+	if n, _ := file.ReadAt(tail, offset); n > 0 {
+		lines := bytes.Split(bytes.TrimRight(tail[:n], "\n"), []byte("\n"))
+		var last []json.RawMessage
+		if json.Unmarshal(lines[len(lines)-1], &last) == nil && len(last) > 0 {
+			json.Unmarshal(last[0], &info.Duration)
+		}
+	}
+	return info, nil
+}
+
+func (rs *RecordingStore) Delete(id string) error {
+	path, _, err := rs.path(id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// recordingsHandler lists recordings (GET), downloads one (GET ?id=) and
+// deletes one (DELETE ?id=). Users see their own, admins everyone's; only
+// admins delete, so nobody can remove the record of what they did.
+func (ts *TerminalServer) recordingsHandler(w http.ResponseWriter, r *http.Request) {
+	identity := ts.clientIdentity(r)
+	isAdmin := ts.hasPermission(r, PermAdmin)
+	id := r.URL.Query().Get("id")
+
+	var path string
+	if id != "" {
+		var owner string
+		var err error
+		path, owner, err = ts.recordings.path(id)
+		if err == nil && owner != identity && !isAdmin {
+			err = fmt.Errorf("recording not found")
+		}
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+	}
+
+	switch {
+	case r.Method == "GET" && id != "":
+		w.Header().Set("Content-Type", "application/x-asciicast")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", filepath.Base(path)))
+		http.ServeFile(w, r, path)
+
+	case r.Method == "GET":
+		owner := identity
+		if isAdmin {
+			owner = ""
+		}
+		w.Header().Set("Content-Type", "application/json")
+		list, err := ts.recordings.List(owner)
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: fmt.Sprintf("Failed to list recordings: %v", err)})
+			return
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Data: list})
+
+	case r.Method == "DELETE" && id != "":
+		if ts.denyUnlessPermitted(w, r, PermAdmin) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := ts.recordings.Delete(id); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: fmt.Sprintf("Failed to delete recording: %v", err)})
+			return
+		}
+		if ts.verbose {
+			log.Printf("🎬 %s deleted recording %s", identity, id)
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Recording deleted"})
+
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Method not allowed"})
+	}
+}
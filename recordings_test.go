@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordingPath(t *testing.T) {
+	rs := &RecordingStore{dir: "/var/lib/snakeflex/recordings"}
+	tests := []struct {
+		id        string
+		wantPath  string
+		wantOwner string
+		wantErr   bool
+	}{
+		{"alice/shell-20260101-120000-abc.cast", "/var/lib/snakeflex/recordings/alice/shell-20260101-120000-abc.cast", "alice", false},
+		{"alice.smith@example.com/run-1.cast", "/var/lib/snakeflex/recordings/alice.smith@example.com/run-1.cast", "alice.smith@example.com", false},
+		{"alice", "", "", true},
+		{"/alice/run-1.cast", "", "", true},
+		{"../run-1.cast", "", "", true},
+		{"./run-1.cast", "", "", true},
+		{"alice/../bob/run-1.cast", "", "", true},
+		{"alice/sub/run-1.cast", "", "", true},
+		{"alice/..", "", "", true},
+		{"alice/.cast", "", "", true},
+		{"alice/run-1.txt", "", "", true},
+		{"bad owner/run-1.cast", "", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.id, func(t *testing.T) {
+			path, owner, err := rs.path(test.id)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("path(%q) = %q, want an error", test.id, path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path != test.wantPath || owner != test.wantOwner {
+				t.Errorf("path(%q) = %q, %q, want %q, %q", test.id, path, owner, test.wantPath, test.wantOwner)
+			}
+		})
+	}
+}
+
+func TestRecordingsHandler(t *testing.T) {
+	const (
+		alices = "alice/run-20260101-120000-a.cast"
+		bobs   = "bob/shell-20260101-120000-b.cast"
+	)
+	tests := []struct {
+		name       string
+		user, role string
+		method, id string
+		wantStatus int
+		wantListed int  // recordings in a listing
+		wantGone   bool // the requested recording was deleted
+	}{
+		{"list own", "alice", "runner", "GET", "", http.StatusOK, 1, false},
+		{"admin lists everyone's", "carol", "admin", "GET", "", http.StatusOK, 2, false},
+		{"download own", "alice", "runner", "GET", alices, http.StatusOK, 0, false},
+		{"download another user's", "alice", "runner", "GET", bobs, http.StatusNotFound, 0, false},
+		{"admin downloads another user's", "carol", "admin", "GET", bobs, http.StatusOK, 0, false},
+		{"invalid id", "alice", "runner", "GET", "alice/../bob/x.cast", http.StatusNotFound, 0, false},
+		{"delete own", "alice", "editor", "DELETE", alices, http.StatusForbidden, 0, false},
+		{"delete another user's", "alice", "editor", "DELETE", bobs, http.StatusNotFound, 0, false},
+		{"admin deletes another user's", "carol", "admin", "DELETE", bobs, http.StatusOK, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, id := range []string{alices, bobs} {
+				os.MkdirAll(filepath.Join(dir, filepath.Dir(id)), 0700)
+				os.WriteFile(filepath.Join(dir, id), []byte(`{"version": 2, "width": 80, "height": 24, "timestamp": 1767268800}`+"\n"), 0600)
+			}
+			ts := &TerminalServer{authConfig: &AuthConfig{Enabled: true}, recordings: &RecordingStore{dir: dir}}
+
+			r := httptest.NewRequest(test.method, "/api/recordings", nil)
+			if test.id != "" {
+				r.URL.RawQuery = "id=" + test.id
+			}
+			ctx := context.WithValue(r.Context(), userContextKey, test.user)
+			r = r.WithContext(context.WithValue(ctx, roleContextKey, test.role))
+			w := httptest.NewRecorder()
+			ts.recordingsHandler(w, r)
+
+			if w.Code != test.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.wantStatus, w.Body)
+			}
+			if test.method == "GET" && test.id == "" {
+				var response struct{ Data []RecordingInfo }
+				json.Unmarshal(w.Body.Bytes(), &response)
+				if len(response.Data) != test.wantListed {
+					t.Errorf("listed %d recordings, want %d", len(response.Data), test.wantListed)
+				}
+			}
+			for _, id := range []string{alices, bobs} {
+				_, err := os.Stat(filepath.Join(dir, id))
+				if gone := os.IsNotExist(err); gone != (test.wantGone && id == test.id) {
+					t.Errorf("%s gone = %v", id, gone)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// Permissions guard groups of handlers. The same names are used wherever a
+// narrower set of rights has to be expressed.
+const (
+	PermFilesRead  = "files:read"
+	PermFilesWrite = "files:write"
+	PermRun        = "run"
+	PermShell      = "shell"
+	PermAdmin      = "admin"
+)
+
+// Role given to users whose entry in the users file has none
+const defaultRole = "editor"
+
+// What each role may do, from least to most trusted
+var rolePermissions = map[string][]string{
+	"viewer": {PermFilesRead},
+	"runner": {PermFilesRead, PermRun},
+	"editor": {PermFilesRead, PermFilesWrite, PermRun, PermShell},
+	"admin":  {PermFilesRead, PermFilesWrite, PermRun, PermShell, PermAdmin},
+}
+
+// Roles ordered by trust, for picking the strongest of several
+var roleOrder = []string{"viewer", "runner", "editor", "admin"}
+
+func roleRank(role string) int {
+	for rank, name := range roleOrder {
+		if name == role {
+			return rank
+		}
+	}
+	return -1
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func roleNames() []string {
+	names := make([]string, 0, len(rolePermissions))
+	for name := range rolePermissions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func containsPermission(permissions []string, permission string) bool {
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions of the user behind a request; everything when authentication is
+// disabled. API tokens only get the part of the role their scopes name.
+func (ts *TerminalServer) permissions(r *http.Request) []string {
+	if !ts.authConfig.Enabled {
+		return rolePermissions["admin"]
+	}
+	role, ok := r.Context().Value(roleContextKey).(string)
+	if !ok {
+		role = ts.authConfig.Users.Role(currentUser(r))
+	}
+	permissions := rolePermissions[role]
+	if token, ok := r.Context().Value(tokenContextKey).(*APIToken); ok {
+		var scoped []string
+		for _, permission := range permissions {
+			if containsPermission(token.Scopes, permission) {
+				scoped = append(scoped, permission)
+			}
+		}
+		return scoped
+	}
+	return permissions
+}
+
+func (ts *TerminalServer) hasPermission(r *http.Request, permission string) bool {
+	return containsPermission(ts.permissions(r), permission)
+}
+
+// Reject a request whose user lacks the permission with a JSON 403
+func (ts *TerminalServer) denyUnlessPermitted(w http.ResponseWriter, r *http.Request, permission string) bool {
+	if ts.hasPermission(r, permission) {
+		return false
+	}
+	if ts.verbose {
+		log.Printf("⛔ %s denied %s %s (requires %s)", ts.clientIdentity(r), r.Method, r.URL.Path, permission)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(APIResponse{Success: false, Message: fmt.Sprintf("Permission denied: requires %s", permission)})
+	return true
+}
+
+// requirePermission wraps a handler (already behind requireAuth) so only users
+// whose role grants the permission reach it
+func (ts *TerminalServer) requirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ts.denyUnlessPermitted(w, r, permission) {
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default location of saved run configurations, relative to the working directory
+const defaultRunConfigFile = ".snakeflex/run-configs.json"
+
+// Limits on what a run may be given
+const (
+	maxRunArgs   = 256
+	maxRunEnv    = 100
+	maxRunOption = 32 << 10 // bytes per argument or variable
+)
+
+var validEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// RunOptions change how a script is started: arguments after the script
+// name, variables added to the server's environment, a directory to run in,
+// relative to the working directory, the interpreter to use instead of the
+// one chosen for the script's folder, and resource limits stricter than the
+// server's (see parseResourceLimits)
+type RunOptions struct {
+	Args        []string          `json:"args,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	Cwd         string            `json:"cwd,omitempty"`
+	Interpreter string            `json:"interpreter,omitempty"`
+	Limits      string            `json:"limits,omitempty"`
+}
+
+func (opts RunOptions) validate() error {
+	if len(opts.Args) > maxRunArgs {
+		return fmt.Errorf("too many arguments (at most %d)", maxRunArgs)
+	}
+	for _, arg := range opts.Args {
+		if len(arg) > maxRunOption || strings.ContainsRune(arg, 0) {
+			return fmt.Errorf("invalid argument %.40q", arg)
+		}
+	}
+	if len(opts.Env) > maxRunEnv {
+		return fmt.Errorf("too many environment variables (at most %d)", maxRunEnv)
+	}
+	for name, value := range opts.Env {
+		if !validEnvName.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name %.40q", name)
+		}
+		if len(value) > maxRunOption || strings.ContainsRune(value, 0) {
+			return fmt.Errorf("invalid value for environment variable %s", name)
+		}
+	}
+	if _, err := parseResourceLimits(opts.Limits); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Env entries in a stable order, as appended to the command's environment
+func (opts RunOptions) envList() []string {
+	names := make([]string, 0, len(opts.Env))
+	for name := range opts.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]string, 0, len(names))
+	for _, name := range names {
+		list = append(list, name+"="+opts.Env[name])
+	}
+	return list
+}
+
+// resolveRunDir checks a run's directory and returns its absolute path
+func (ts *TerminalServer) resolveRunDir(cwd string) (string, error) {
+	dir, err := ts.validateAndResolvePath(cwd)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", fmt.Errorf("working directory not found: %s", cwd)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("not a directory: %s", cwd)
+	}
+	return dir, nil
+}
+
+// runOptions picks the options an execute message asks for: those of a saved
+// configuration, or its own. Variables such as PYTHONINSPECT or LD_PRELOAD
+// run code of the sender's choosing, so only users who may open a shell can
+// send them; saved configurations already need files:write.
+func (ts *TerminalServer) runOptions(r *http.Request, msg Message) (RunOptions, error) {
+	options := msg.RunOptions
+	if len(options.Env) > 0 && !ts.hasPermission(r, PermShell) {
+		return RunOptions{}, fmt.Errorf("Permission denied: setting environment variables requires %s", PermShell)
+	}
+	if msg.Config != "" {
+		config, found, err := ts.runConfigs.Get(msg.File, msg.Config)
+		if err == nil && !found {
+			err = fmt.Errorf("no run configuration %q for %s", msg.Config, msg.File)
+		}
+		if err != nil {
+			return RunOptions{}, err
+		}
+		options = config.RunOptions
+	}
+	if msg.Interpreter != "" {
+		options.Interpreter = msg.Interpreter
+	}
+	return options, nil
+}
+
+// RunConfig is a named set of options saved for one script
+type RunConfig struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	RunOptions
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// RunConfigStore keeps run configurations in a JSON file that belongs to the
+// project, so it can be committed with it and edited by hand. Changes on disk
+// are picked up on the next access.
+type RunConfigStore struct {
+	path    string
+	configs []RunConfig
+	modTime time.Time
+	mutex   sync.Mutex
+}
+
+func LoadRunConfigStore(path string) (*RunConfigStore, error) {
+	store := &RunConfigStore{path: path}
+	if err := store.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Re-read the file if it changed on disk; the caller holds the lock
+func (store *RunConfigStore) reloadIfChanged() error {
+	info, err := os.Stat(store.path)
+	if os.IsNotExist(err) {
+		store.configs = nil
+		store.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading run configurations: %v", err)
+	}
+	if info.ModTime().Equal(store.modTime) {
+		return nil
+	}
+
+	// Remember this version even if it is broken, so it is reported once
+	store.modTime = info.ModTime()
+	data, err := os.ReadFile(store.path)
+	if err != nil {
+		return fmt.Errorf("reading run configurations: %v", err)
+	}
+	var configs []RunConfig
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &configs); err != nil {
+			return fmt.Errorf("parsing run configurations %s: %v", store.path, err)
+		}
+	}
+	store.configs = configs
+	return nil
+}
+
+// Write the configurations to a temporary file and rename it into place; the caller holds the lock
+func (store *RunConfigStore) save() error {
+	data, err := json.MarshalIndent(store.configs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(store.path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(store.path), ".run-configs-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), store.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(store.path); err == nil {
+		store.modTime = info.ModTime()
+	}
+	return nil
+}
+
+func (store *RunConfigStore) find(file, name string) int {
+	for i, config := range store.configs {
+		if config.File == file && config.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// List returns the configurations of one script, or of all scripts when file is empty
+func (store *RunConfigStore) List(file string) ([]RunConfig, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	list := []RunConfig{}
+	for _, config := range store.configs {
+		if file == "" || config.File == file {
+			list = append(list, config)
+		}
+	}
+	return list, nil
+}
+
+func (store *RunConfigStore) Get(file, name string) (RunConfig, bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.reloadIfChanged(); err != nil {
+		return RunConfig{}, false, err
+	}
+	if i := store.find(file, name); i >= 0 {
+		return store.configs[i], true, nil
+	}
+	return RunConfig{}, false, nil
+}
+
+// Save adds a configuration or replaces the one with the same script and name
+func (store *RunConfigStore) Save(config RunConfig) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.reloadIfChanged(); err != nil {
+		return err
+	}
+	config.UpdatedAt = time.Now()
+	if i := store.find(config.File, config.Name); i >= 0 {
+		store.configs[i] = config
+	} else {
+		store.configs = append(store.configs, config)
+	}
+	if err := store.save(); err != nil {
+		return fmt.Errorf("saving run configurations: %v", err)
+	}
+	return nil
+}
+
+func (store *RunConfigStore) Delete(file, name string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.reloadIfChanged(); err != nil {
+		return err
+	}
+	i := store.find(file, name)
+	if i < 0 {
+		return fmt.Errorf("no run configuration %q for %s", name, file)
+	}
+	store.configs = append(store.configs[:i], store.configs[i+1:]...)
+	if err := store.save(); err != nil {
+		return fmt.Errorf("saving run configurations: %v", err)
+	}
+	return nil
+}
+
+// runConfigsHandler lists a script's saved run configurations (GET ?file=),
+// saves one (POST) and deletes one (DELETE ?file=&name=)
+func (ts *TerminalServer) runConfigsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		list, err := ts.runConfigs.List(r.URL.Query().Get("file"))
+		if err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Data: list})
+
+	case "POST":
+		// Saved configurations are part of the project, shared with everyone
+		if ts.denyUnlessPermitted(w, r, PermFilesWrite) {
+			return
+		}
+		var config RunConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Invalid request body"})
+			return
+		}
+		config.Name = strings.TrimSpace(config.Name)
+		if config.Name == "" || len(config.Name) > 100 {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "A name of up to 100 characters is required"})
+			return
+		}
+		if _, err := ts.validateAndResolvePath(config.File); err != nil || config.File == "" {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Invalid script path"})
+			return
+		}
+		if err := config.validate(); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		if _, err := ts.resolveRunDir(config.Cwd); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		if config.Interpreter != "" {
+			if _, err := ts.interpreters.Resolve("", config.Interpreter); err != nil {
+				json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+				return
+			}
+		}
+		if err := ts.runConfigs.Save(config); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		if ts.verbose {
+			log.Printf("⚙️ %s saved run configuration %q for %s", ts.clientIdentity(r), config.Name, config.File)
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Run configuration saved"})
+
+	case "DELETE":
+		if ts.denyUnlessPermitted(w, r, PermFilesWrite) {
+			return
+		}
+		file, name := r.URL.Query().Get("file"), r.URL.Query().Get("name")
+		if _, err := ts.validateAndResolvePath(file); err != nil || file == "" {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Invalid script path"})
+			return
+		}
+		if err := ts.runConfigs.Delete(file, name); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{Success: false, Message: err.Error()})
+			return
+		}
+		if ts.verbose {
+			log.Printf("⚙️ %s deleted run configuration %q for %s", ts.clientIdentity(r), name, file)
+		}
+		json.NewEncoder(w).Encode(APIResponse{Success: true, Message: "Run configuration deleted"})
+
+	default:
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Method not allowed"})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRunConfigChangesNeedFilesWrite(t *testing.T) {
+	ts := &TerminalServer{authConfig: &AuthConfig{Enabled: true}, workingDir: t.TempDir()}
+	handler := ts.requirePermission(PermRun, ts.runConfigsHandler)
+
+	requests := []*http.Request{
+		httptest.NewRequest("POST", "/api/run-configs", strings.NewReader(`{"name": "fast", "file": "train.py", "env": {"DEBUG": "1"}}`)),
+		httptest.NewRequest("DELETE", "/api/run-configs?file=train.py&name=fast", nil),
+	}
+	for _, r := range requests {
+		r = r.WithContext(context.WithValue(r.Context(), roleContextKey, "runner"))
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("runner %s: status %d, want %d", r.Method, w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestRunOptionsEnvNeedsShell(t *testing.T) {
+	ts := &TerminalServer{authConfig: &AuthConfig{Enabled: true}}
+	tests := []struct {
+		role  string
+		msg   Message
+		valid bool
+	}{
+		{"runner", Message{File: "main.py", RunOptions: RunOptions{Args: []string{"--epochs", "3"}}}, true},
+		{"runner", Message{File: "main.py", RunOptions: RunOptions{Env: map[string]string{"PYTHONINSPECT": "1"}}}, false},
+		{"runner", Message{File: "main.py", RunOptions: RunOptions{Env: map[string]string{"LD_PRELOAD": "/tmp/evil.so"}}}, false},
+		{"runner", Message{File: "main.py", RunOptions: RunOptions{Env: map[string]string{"DEBUG": "1"}}}, false},
+		{"viewer", Message{File: "main.py", RunOptions: RunOptions{Env: map[string]string{"PYTHONINSPECT": "1"}}}, false},
+		{"editor", Message{File: "main.py", RunOptions: RunOptions{Env: map[string]string{"PYTHONINSPECT": "1"}}}, true},
+		{"admin", Message{File: "main.py", RunOptions: RunOptions{Env: map[string]string{"PYTHONPATH": "lib"}}}, true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r = r.WithContext(context.WithValue(r.Context(), roleContextKey, test.role))
+		options, err := ts.runOptions(r, test.msg)
+		if test.valid && (err != nil || len(options.Env) != len(test.msg.Env)) {
+			t.Errorf("%s running with %v: %v", test.role, test.msg.RunOptions, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s allowed to run with environment %v", test.role, test.msg.Env)
+		}
+	}
+}
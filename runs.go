@@ -0,0 +1,590 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Signals that the client may send to a running script
+var signalNames = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+// Grace period between SIGTERM and SIGKILL for a stop request
+const stopGracePeriod = 5 * time.Second
+
+// Amount of output kept per run for clients that re-attach
+const runOutputBufferSize = 1 << 20 // 1 MB
+
+// Largest merged output chunk sent while replaying
+const replayChunkSize = 64 << 10 // 64 KB
+
+// How long a finished run stays available for re-attaching
+const finishedRunRetention = 30 * time.Minute
+
+// How a new execution interacts with the runs already started by the same client
+const (
+	RunModeReplace    = "replace"    // Kill the current run and start immediately
+	RunModeQueue      = "queue"      // Start once the current run has finished
+	RunModeConcurrent = "concurrent" // Start immediately alongside the current run
+)
+
+const (
+	RunStateQueued   = "queued"
+	RunStateRunning  = "running"
+	RunStateFinished = "finished"
+)
+
+func signalName(sig syscall.Signal) string {
+	for name, value := range signalNames {
+		if value == sig {
+			return name
+		}
+	}
+	return fmt.Sprintf("signal %d", int(sig))
+}
+
+func generateID(size int) string {
+	bytes := make([]byte, size)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// OutputBuffer is a ring of the most recent messages of a run, bounded by content size
+type OutputBuffer struct {
+	messages []Message
+	size     int
+	limit    int
+}
+
+func (b *OutputBuffer) Append(msg Message) {
+	b.messages = append(b.messages, msg)
+	b.size += len(msg.Content)
+	for b.size > b.limit && len(b.messages) > 1 {
+		b.size -= len(b.messages[0].Content)
+		b.messages = b.messages[1:]
+	}
+}
+
+// Since returns the buffered messages after the given sequence number and
+// whether some of the requested output has already been discarded. Consecutive
+// output chunks are merged so that a replay fits in the connection's send queue.
+func (b *OutputBuffer) Since(seq uint64) ([]Message, bool) {
+	if len(b.messages) == 0 {
+		return nil, false
+	}
+	truncated := b.messages[0].Seq > seq+1
+
+	var replay []Message
+	for _, msg := range b.messages {
+		if msg.Seq <= seq {
+			continue
+		}
+		if last := len(replay) - 1; last >= 0 && isOutputMessage(msg) && replay[last].Type == msg.Type &&
+			len(replay[last].Content)+len(msg.Content) <= replayChunkSize {
+			replay[last].Content += msg.Content
+			replay[last].Seq = msg.Seq
+			continue
+		}
+		replay = append(replay, msg)
+	}
+	return replay, truncated
+}
+
+func isOutputMessage(msg Message) bool {
+	return msg.Type == "stdout" || msg.Type == "stderr"
+}
+
+// RunInfo describes a run for clients listing what they can attach to
+type RunInfo struct {
+	ID         string     `json:"id"`
+	File       string     `json:"file"`
+	Args       []string   `json:"args,omitempty"`
+	Mode       string     `json:"mode"`
+	State      string     `json:"state"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	LastSeq    uint64     `json:"lastSeq"`
+}
+
+// ScriptRun is a single execution of a Python script, tracked by the run registry.
+// Output is buffered and fanned out to every attached connection, so the run
+// keeps going when its client disconnects.
+type ScriptRun struct {
+	ID        string
+	File      string
+	Module    bool // File names a module run with python -m, such as pip
+	Options   RunOptions
+	Mode      string
+	Owner     string // Identity of the client that started the run
+	CreatedAt time.Time
+
+	subscribers map[*SafeWebSocketConn]string // Connection -> identity of the client behind it
+	share       ShareState
+	output      OutputBuffer
+	seq         uint64
+	finishedAt  time.Time
+	cmd         *exec.Cmd
+	inputChan   chan string
+	done        chan struct{}
+	doneOnce    sync.Once
+	state       string
+	signal      string // Last signal requested by the client
+	limits      ResourceLimits
+	cgroup      string // the run's own cgroup, if it has one
+	timedOut    bool
+	stopped     bool // Stop was called before the command started
+	allocation  allocationWatch
+	mutex       sync.Mutex
+}
+
+func NewScriptRun(owner, file, mode string, options RunOptions) *ScriptRun {
+	switch mode {
+	case RunModeQueue, RunModeConcurrent:
+	default:
+		mode = RunModeReplace
+	}
+
+	return &ScriptRun{
+		ID:        generateID(6),
+		File:      file,
+		Options:   options,
+		Mode:      mode,
+		Owner:     owner,
+		CreatedAt: time.Now(),
+
+		subscribers: make(map[*SafeWebSocketConn]string),
+		output:      OutputBuffer{limit: runOutputBufferSize},
+		inputChan:   make(chan string, 10),
+		done:        make(chan struct{}),
+		state:       RunStateQueued,
+	}
+}
+
+// Send records a message in the run's buffer and delivers it to every attached client
+func (run *ScriptRun) Send(msg Message) {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+
+	run.seq++
+	msg.RunID = run.ID
+	msg.Seq = run.seq
+	run.output.Append(msg)
+	if isOutputMessage(msg) {
+		run.allocation.Write(msg.Content)
+	}
+
+	for conn := range run.subscribers {
+		conn.SendMessage(msg)
+	}
+}
+
+// Attach replays the output after the given sequence number to a connection
+// and then subscribes it to live output
+func (run *ScriptRun) Attach(conn *SafeWebSocketConn, identity string, since uint64) {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+
+	missed, truncated := run.output.Since(since)
+	if truncated {
+		conn.SendMessage(Message{Type: "truncated", RunID: run.ID, Content: "Earlier output was discarded from the replay buffer"})
+	}
+	for _, msg := range missed {
+		conn.SendMessage(msg)
+	}
+	conn.SendMessage(Message{Type: "attached", RunID: run.ID, File: run.File, Mode: run.Mode, Content: run.state,
+		RunOptions: RunOptions{Args: run.Options.Args}})
+
+	run.subscribers[conn] = identity
+}
+
+func (run *ScriptRun) Detach(conn *SafeWebSocketConn) {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	delete(run.subscribers, conn)
+}
+
+// CanView reports whether an identity may watch the run's output
+func (run *ScriptRun) CanView(identity string) bool {
+	return run.share.CanView(run.Owner, identity)
+}
+
+// CanControl reports whether an identity may send input or signals to the run
+func (run *ScriptRun) CanControl(identity string) bool {
+	return run.share.CanWrite(run.Owner, identity)
+}
+
+// Viewers lists the other identities currently watching the run
+func (run *ScriptRun) Viewers() []string {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	var identities []string
+	for _, identity := range run.subscribers {
+		identities = append(identities, identity)
+	}
+	return viewerIdentities(run.Owner, identities)
+}
+
+// Unshare stops sharing the run and disconnects everyone but the owner from it
+func (run *ScriptRun) Unshare() {
+	run.share.SetShared(false)
+
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	for conn, identity := range run.subscribers {
+		if identity != run.Owner {
+			conn.SendMessage(Message{Type: "error", RunID: run.ID, Content: "The owner stopped sharing this run"})
+			delete(run.subscribers, conn)
+		}
+	}
+}
+
+func (run *ScriptRun) Info() RunInfo {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	info := RunInfo{
+		ID:        run.ID,
+		File:      run.File,
+		Args:      run.Options.Args,
+		Mode:      run.Mode,
+		State:     run.state,
+		CreatedAt: run.CreatedAt,
+		LastSeq:   run.seq,
+	}
+	if !run.finishedAt.IsZero() {
+		finishedAt := run.finishedAt
+		info.FinishedAt = &finishedAt
+	}
+	return info
+}
+
+func (run *ScriptRun) setState(state string) {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	run.state = state
+}
+
+// Record the started command so that it can be signalled, reporting whether
+// the run was stopped while it was starting
+func (run *ScriptRun) setCommand(cmd *exec.Cmd) bool {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	run.cmd = cmd
+	return run.stopped
+}
+
+// Whether the run was stopped before its command started
+func (run *ScriptRun) stopRequested() bool {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	return run.stopped
+}
+
+// Record the limits the started command runs under
+func (run *ScriptRun) setLimits(limits ResourceLimits, cgroup string) {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	run.limits = limits
+	run.cgroup = cgroup
+}
+
+// Stop the run because it has used up its wall-clock time
+func (run *ScriptRun) timeOut() {
+	run.mutex.Lock()
+	run.timedOut = true
+	run.mutex.Unlock()
+	run.Stop()
+}
+
+// Limit that ended the run, or "" if it ended for another reason
+func (run *ScriptRun) limitReached(state *os.ProcessState) string {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	return limitReached(run.limits, state, run.cgroup, run.timedOut, run.signal != "", run.allocation.failed)
+}
+
+// Mark the run as finished; safe to call more than once
+func (run *ScriptRun) finish() {
+	run.doneOnce.Do(func() {
+		run.mutex.Lock()
+		run.state = RunStateFinished
+		run.finishedAt = time.Now()
+		run.mutex.Unlock()
+		close(run.done)
+	})
+}
+
+// SendInput queues a line for the script's stdin, reporting whether it was accepted
+func (run *ScriptRun) SendInput(input string) bool {
+	select {
+	case <-run.done:
+		return false
+	default:
+	}
+
+	select {
+	case run.inputChan <- input:
+		return true
+	default:
+		return false
+	}
+}
+
+func (run *ScriptRun) Signal(name string) error {
+	sig, ok := signalNames[name]
+	if !ok {
+		return fmt.Errorf("unsupported signal: %s", name)
+	}
+
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+
+	if run.cmd == nil || run.cmd.Process == nil {
+		return fmt.Errorf("no script is running")
+	}
+	select {
+	case <-run.done:
+		return fmt.Errorf("script has already exited")
+	default:
+	}
+
+	run.signal = name
+	return signalProcessGroup(run.cmd.Process, sig)
+}
+
+// Stop asks the script to terminate and kills it if it is still alive after
+// the grace period. A run that is still starting is stopped as soon as its
+// command has started.
+func (run *ScriptRun) Stop() error {
+	run.mutex.Lock()
+	if run.cmd == nil {
+		run.stopped = true
+		run.mutex.Unlock()
+		return nil
+	}
+	run.mutex.Unlock()
+
+	if err := run.Signal("SIGTERM"); err != nil {
+		return err
+	}
+	go func() {
+		select {
+		case <-run.done:
+		case <-time.After(stopGracePeriod):
+			run.Signal("SIGKILL")
+		}
+	}()
+	return nil
+}
+
+// Signal that ended the script: the one reported by the OS, otherwise the one we sent
+func (run *ScriptRun) terminationSignal(state *os.ProcessState) string {
+	if sig := exitSignal(state); sig != "" {
+		return sig
+	}
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	return run.signal
+}
+
+// RunRegistry keeps track of every script run on the server. Runs started in
+// replace or queue mode share a single sequential lane per owner, while
+// concurrent runs are independent of it.
+type RunRegistry struct {
+	runs   map[string]*ScriptRun
+	lanes  map[string]*ScriptRun   // Owner -> run currently occupying the sequential lane
+	queues map[string][]*ScriptRun // Owner -> runs waiting for the lane
+	order  []*ScriptRun            // Runs in the order they started, for default targeting
+	mutex  sync.Mutex
+}
+
+func NewRunRegistry() *RunRegistry {
+	rr := &RunRegistry{
+		runs:   make(map[string]*ScriptRun),
+		lanes:  make(map[string]*ScriptRun),
+		queues: make(map[string][]*ScriptRun),
+	}
+
+	// Forget finished runs once nobody is likely to re-attach to them
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			rr.CleanupFinishedRuns()
+		}
+	}()
+
+	return rr
+}
+
+// Submit registers a new run. It returns the runs that must be stopped to make
+// way for it, the queued runs that were cancelled, and whether it may start now.
+func (rr *RunRegistry) Submit(run *ScriptRun) (replaced, cancelled []*ScriptRun, start bool) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	rr.runs[run.ID] = run
+
+	switch run.Mode {
+	case RunModeConcurrent:
+		return nil, nil, true
+
+	case RunModeQueue:
+		if rr.lanes[run.Owner] != nil {
+			rr.queues[run.Owner] = append(rr.queues[run.Owner], run)
+			return nil, nil, false
+		}
+
+	default:
+		if current := rr.lanes[run.Owner]; current != nil {
+			replaced = append(replaced, current)
+		}
+		cancelled = rr.queues[run.Owner]
+		delete(rr.queues, run.Owner)
+		for _, queued := range cancelled {
+			delete(rr.runs, queued.ID)
+		}
+	}
+
+	rr.lanes[run.Owner] = run
+	return replaced, cancelled, true
+}
+
+// Started records that a run has begun executing
+func (rr *RunRegistry) Started(run *ScriptRun) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	run.setState(RunStateRunning)
+	rr.order = append(rr.order, run)
+}
+
+// Finish releases the lane held by a finished run and returns the next queued
+// run for its owner, if any. The run itself stays available for re-attaching.
+func (rr *RunRegistry) Finish(run *ScriptRun) *ScriptRun {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	for i, existing := range rr.order {
+		if existing == run {
+			rr.order = append(rr.order[:i], rr.order[i+1:]...)
+			break
+		}
+	}
+
+	if rr.lanes[run.Owner] != run {
+		return nil
+	}
+	delete(rr.lanes, run.Owner)
+
+	queue := rr.queues[run.Owner]
+	if len(queue) == 0 {
+		return nil
+	}
+	next := queue[0]
+	if len(queue) == 1 {
+		delete(rr.queues, run.Owner)
+	} else {
+		rr.queues[run.Owner] = queue[1:]
+	}
+	rr.lanes[run.Owner] = next
+	return next
+}
+
+// QueuePosition reports how many runs are ahead of a queued run
+func (rr *RunRegistry) QueuePosition(run *ScriptRun) int {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	for i, queued := range rr.queues[run.Owner] {
+		if queued == run {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Lookup finds a run the identity may watch: its own, or one shared with it.
+// An empty ID selects the identity's most recently started run that is still executing.
+func (rr *RunRegistry) Lookup(identity, runID string) *ScriptRun {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if runID != "" {
+		run := rr.runs[runID]
+		if run == nil || !run.CanView(identity) {
+			return nil
+		}
+		return run
+	}
+
+	for i := len(rr.order) - 1; i >= 0; i-- {
+		if rr.order[i].Owner == identity {
+			return rr.order[i]
+		}
+	}
+	return nil
+}
+
+// List describes every run belonging to an owner, oldest first
+func (rr *RunRegistry) List(owner string) []RunInfo {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	runs := []RunInfo{}
+	for _, run := range rr.runs {
+		if run.Owner == owner {
+			runs = append(runs, run.Info())
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].CreatedAt.Before(runs[j].CreatedAt)
+	})
+	return runs
+}
+
+// Visible returns the identity's own runs and every run shared by others, oldest first
+func (rr *RunRegistry) Visible(identity string) []*ScriptRun {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	var runs []*ScriptRun
+	for _, run := range rr.runs {
+		if run.CanView(identity) {
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].CreatedAt.Before(runs[j].CreatedAt)
+	})
+	return runs
+}
+
+// Detach unsubscribes a closed connection from every run
+func (rr *RunRegistry) Detach(conn *SafeWebSocketConn) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	for _, run := range rr.runs {
+		run.Detach(conn)
+	}
+}
+
+func (rr *RunRegistry) CleanupFinishedRuns() {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	now := time.Now()
+	for id, run := range rr.runs {
+		info := run.Info()
+		if info.FinishedAt != nil && now.Sub(*info.FinishedAt) > finishedRunRetention {
+			delete(rr.runs, id)
+		}
+	}
+}
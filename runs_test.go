@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunRegistrySubmit(t *testing.T) {
+	type submission struct {
+		name, owner, mode string
+		replaced          []string
+		cancelled         []string
+		start             bool
+	}
+	tests := []struct {
+		name  string
+		steps []submission
+	}{
+		{"replace with nothing running", []submission{
+			{"a", "alice", RunModeReplace, nil, nil, true},
+		}},
+		{"replace the running script", []submission{
+			{"a", "alice", RunModeReplace, nil, nil, true},
+			{"b", "alice", RunModeReplace, []string{"a"}, nil, true},
+			{"c", "alice", RunModeReplace, []string{"b"}, nil, true},
+		}},
+		{"queue behind the running script", []submission{
+			{"a", "alice", RunModeReplace, nil, nil, true},
+			{"b", "alice", RunModeQueue, nil, nil, false},
+			{"c", "alice", RunModeQueue, nil, nil, false},
+		}},
+		{"queue with nothing running", []submission{
+			{"a", "alice", RunModeQueue, nil, nil, true},
+		}},
+		{"replace clears the queue", []submission{
+			{"a", "alice", RunModeReplace, nil, nil, true},
+			{"b", "alice", RunModeQueue, nil, nil, false},
+			{"c", "alice", RunModeQueue, nil, nil, false},
+			{"d", "alice", RunModeReplace, []string{"a"}, []string{"b", "c"}, true},
+		}},
+		{"concurrent runs stay out of the lane", []submission{
+			{"a", "alice", RunModeReplace, nil, nil, true},
+			{"b", "alice", RunModeConcurrent, nil, nil, true},
+			{"c", "alice", RunModeConcurrent, nil, nil, true},
+			{"d", "alice", RunModeReplace, []string{"a"}, nil, true},
+		}},
+		{"every owner has a lane", []submission{
+			{"a", "alice", RunModeReplace, nil, nil, true},
+			{"b", "bob", RunModeReplace, nil, nil, true},
+			{"c", "bob", RunModeQueue, nil, nil, false},
+			{"d", "alice", RunModeReplace, []string{"a"}, nil, true},
+		}},
+		{"unknown mode replaces", []submission{
+			{"a", "alice", RunModeReplace, nil, nil, true},
+			{"b", "alice", "parallel", []string{"a"}, nil, true},
+		}},
+	}
+	names := func(runs []*ScriptRun) []string {
+		var names []string
+		for _, run := range runs {
+			names = append(names, run.File)
+		}
+		return names
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rr := &RunRegistry{runs: map[string]*ScriptRun{}, lanes: map[string]*ScriptRun{}, queues: map[string][]*ScriptRun{}}
+			for _, step := range test.steps {
+				replaced, cancelled, start := rr.Submit(NewScriptRun(step.owner, step.name, step.mode, RunOptions{}))
+				if !reflect.DeepEqual(names(replaced), step.replaced) || !reflect.DeepEqual(names(cancelled), step.cancelled) || start != step.start {
+					t.Errorf("submitting %s: replaced %v, cancelled %v, start %t; want %v, %v, %t",
+						step.name, names(replaced), names(cancelled), start, step.replaced, step.cancelled, step.start)
+				}
+			}
+		})
+	}
+}
+
+func TestRunRegistryQueue(t *testing.T) {
+	rr := &RunRegistry{runs: map[string]*ScriptRun{}, lanes: map[string]*ScriptRun{}, queues: map[string][]*ScriptRun{}}
+	first := NewScriptRun("alice", "first.py", RunModeReplace, RunOptions{})
+	second := NewScriptRun("alice", "second.py", RunModeQueue, RunOptions{})
+	third := NewScriptRun("alice", "third.py", RunModeQueue, RunOptions{})
+	side := NewScriptRun("alice", "side.py", RunModeConcurrent, RunOptions{})
+	for _, run := range []*ScriptRun{first, second, third, side} {
+		rr.Submit(run)
+	}
+	rr.Started(first)
+	rr.Started(side)
+
+	if got := []int{rr.QueuePosition(second), rr.QueuePosition(third), rr.QueuePosition(first)}; !reflect.DeepEqual(got, []int{1, 2, 0}) {
+		t.Errorf("queue positions = %v, want [1 2 0]", got)
+	}
+	if got := rr.Lookup("alice", ""); got != side {
+		t.Errorf("default run is %s, want the last one started", got.File)
+	}
+	if got := rr.Lookup("bob", first.ID); got != nil {
+		t.Error("another user looked up an unshared run")
+	}
+	if next := rr.Finish(side); next != nil {
+		t.Errorf("finishing a concurrent run started %s", next.File)
+	}
+	if next := rr.Finish(first); next != second {
+		t.Errorf("after the first run, %v started, want second.py", next)
+	}
+	if next := rr.Finish(second); next != third {
+		t.Errorf("after the second run, %v started, want third.py", next)
+	}
+	if next := rr.Finish(third); next != nil {
+		t.Errorf("after the last run, %s started", next.File)
+	}
+	if len(rr.List("alice")) != 4 {
+		t.Errorf("finished runs are not kept for re-attaching: %v", rr.List("alice"))
+	}
+}
+
+// A run replaced while it is still choosing its interpreter must not go on
+// to start alongside the run that replaced it
+func TestReplaceBeforeStart(t *testing.T) {
+	rr := &RunRegistry{runs: map[string]*ScriptRun{}, lanes: map[string]*ScriptRun{}, queues: map[string][]*ScriptRun{}}
+	old := NewScriptRun("alice", "train.py", RunModeReplace, RunOptions{})
+	rr.Submit(old)
+	rr.Started(old)
+
+	replaced, _, _ := rr.Submit(NewScriptRun("alice", "train.py", RunModeReplace, RunOptions{}))
+	if len(replaced) != 1 || replaced[0] != old {
+		t.Fatalf("replaced %v", replaced)
+	}
+	if err := old.Stop(); err != nil {
+		t.Fatalf("stopping a run that has not started: %v", err)
+	}
+	if !old.stopRequested() {
+		t.Fatal("stop before the start was forgotten")
+	}
+
+	// A command that starts anyway is stopped as soon as it is recorded
+	sleep, err := exec.LookPath("sleep")
+	if err != nil || runtime.GOOS == "windows" {
+		t.Skip("no sleep command")
+	}
+	cmd := exec.Command(sleep, "30")
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if old.setCommand(cmd) {
+		old.Stop()
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case <-exited:
+		if sig := exitSignal(cmd.ProcessState); sig != "SIGTERM" {
+			t.Errorf("command ended with %q, want SIGTERM", sig)
+		}
+	case <-time.After(stopGracePeriod / 2):
+		cmd.Process.Kill()
+		t.Fatal("replaced command kept running")
+	}
+	old.finish()
+}
+
+// replayed flattens messages to what a replay test compares
+func replayed(messages []Message) []string {
+	var out []string
+	for _, msg := range messages {
+		out = append(out, fmt.Sprintf("%d %s %q", msg.Seq, msg.Type, msg.Content))
+	}
+	return out
+}
+
+func TestOutputBufferSince(t *testing.T) {
+	big := strings.Repeat("x", replayChunkSize-1)
+	tests := []struct {
+		name      string
+		limit     int
+		sent      []Message
+		since     uint64
+		want      []string
+		truncated bool
+	}{
+		{"empty buffer", 100, nil, 0, nil, false},
+		{"consecutive output is merged", 100,
+			[]Message{{Type: "stdout", Content: "a"}, {Type: "stdout", Content: "b"}, {Type: "stdout", Content: "c"}},
+			0, []string{`3 stdout "abc"`}, false},
+		{"streams are not merged", 100,
+			[]Message{{Type: "stdout", Content: "a"}, {Type: "stderr", Content: "b"}, {Type: "stdout", Content: "c"}},
+			0, []string{`1 stdout "a"`, `2 stderr "b"`, `3 stdout "c"`}, false},
+		{"other messages are not merged", 100,
+			[]Message{{Type: "started"}, {Type: "started"}, {Type: "stdout", Content: "a"}, {Type: "completed", Content: "Exit code: 0"}},
+			0, []string{`1 started ""`, `2 started ""`, `3 stdout "a"`, `4 completed "Exit code: 0"`}, false},
+		{"only messages after the sequence", 100,
+			[]Message{{Type: "stdout", Content: "a"}, {Type: "stdout", Content: "b"}, {Type: "stdout", Content: "c"}},
+			1, []string{`3 stdout "bc"`}, false},
+		{"nothing after the last sequence", 100,
+			[]Message{{Type: "stdout", Content: "a"}, {Type: "stdout", Content: "b"}},
+			2, nil, false},
+		{"merging stops at the chunk size", 2 * replayChunkSize,
+			[]Message{{Type: "stdout", Content: big}, {Type: "stdout", Content: "ab"}, {Type: "stdout", Content: "c"}},
+			0, []string{fmt.Sprintf("1 stdout %q", big), `3 stdout "abc"`}, false},
+		{"discarded output is reported", 3,
+			[]Message{{Type: "stdout", Content: "ab"}, {Type: "stdout", Content: "cd"}, {Type: "stdout", Content: "e"}},
+			0, []string{`3 stdout "cde"`}, true},
+		{"discarded output before the sequence is not", 3,
+			[]Message{{Type: "stdout", Content: "ab"}, {Type: "stdout", Content: "cd"}, {Type: "stdout", Content: "e"}},
+			1, []string{`3 stdout "cde"`}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buffer := OutputBuffer{limit: test.limit}
+			for i, msg := range test.sent {
+				msg.Seq = uint64(i + 1)
+				buffer.Append(msg)
+			}
+			got, truncated := buffer.Since(test.since)
+			if !reflect.DeepEqual(replayed(got), test.want) {
+				t.Errorf("Since(%d) = %v, want %v", test.since, replayed(got), test.want)
+			}
+			if truncated != test.truncated {
+				t.Errorf("truncated = %v, want %v", truncated, test.truncated)
+			}
+		})
+	}
+}
+
+func TestAttachReplay(t *testing.T) {
+	run := NewScriptRun("alice", "train.py", RunModeReplace, RunOptions{})
+	run.output.limit = 4
+	run.Send(Message{Type: "started"})
+	run.Send(Message{Type: "stdout", Content: "ab"})
+	run.Send(Message{Type: "stdout", Content: "cd"})
+	run.Send(Message{Type: "stderr", Content: "e"})
+
+	conn := &SafeWebSocketConn{msgChan: make(chan Message, 100), done: make(chan bool)}
+	run.Attach(conn, "alice", 0)
+	run.Send(Message{Type: "stdout", Content: "f"})
+
+	var got []string
+	for len(conn.msgChan) > 0 {
+		msg := <-conn.msgChan
+		got = append(got, msg.Type+" "+msg.Content)
+	}
+	want := []string{
+		"truncated Earlier output was discarded from the replay buffer",
+		"stdout cd",
+		"stderr e",
+		"attached " + RunStateQueued,
+		"stdout f",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("attached connection got %q, want %q", got, want)
+	}
+}
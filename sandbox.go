@@ -0,0 +1,248 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Sandbox starts runs and shells in fresh Linux user, mount, PID and network
+// namespaces. Inside, the file system is read-only apart from the working
+// directory and any extra writable paths, hidden paths are covered up, and
+// there is no network unless it is allowed. A nil *Sandbox starts commands as
+// they are.
+type Sandbox struct {
+	writable []string // bind-mounted writable, the working directory first
+	hidden   []string // covered by an empty read-only file system
+	network  bool     // keep the host's network instead of a loopback of its own
+	exposed  []string // secret files hidden without their folder
+}
+
+// NewSandbox checks the paths and tries the sandbox once, so a kernel that
+// does not allow user namespaces is reported at startup rather than on the
+// first run. Secrets are the server's own files, like the users file, which
+// are hidden along with the paths the caller lists.
+func NewSandbox(workingDir string, writable, hidden, secrets []string, network bool) (*Sandbox, error) {
+	sb := &Sandbox{network: network}
+	for _, path := range append([]string{workingDir}, writable...) {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(abs); err != nil {
+			return nil, fmt.Errorf("writable path %s: %v", path, err)
+		}
+		sb.writable = append(sb.writable, abs)
+	}
+	for _, path := range hidden {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		sb.hidden = append(sb.hidden, abs)
+	}
+	exposed, err := sb.hideSecrets(secrets)
+	if err != nil {
+		return nil, err
+	}
+	sb.exposed = exposed
+
+	cmd := exec.Command(selfExecutable, append(append([]string{"exec-sandboxed"}, sb.args()...), "--check")...)
+	if err := isolateCommand(cmd, network); err != nil {
+		return nil, err
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			return nil, fmt.Errorf("%s", message)
+		}
+		return nil, err
+	}
+	return sb, nil
+}
+
+// hideSecrets hides secret files, and the folder they are in when it holds
+// nothing else: a file saved by replacing it comes back into view in sandboxes
+// already running. A secret folder is hidden whole. It returns the files that
+// had to be hidden one by one.
+func (sb *Sandbox) hideSecrets(paths []string) ([]string, error) {
+	var dirs []string
+	files := map[string][]string{} // secret files by folder
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(abs); err == nil && info.IsDir() {
+			for _, writable := range sb.writable {
+				if underAny(writable, []string{abs}) {
+					return nil, fmt.Errorf("%s holds the writable path %s, so it cannot be hidden", abs, writable)
+				}
+			}
+			sb.hide(abs)
+			continue
+		}
+		dir := filepath.Dir(abs)
+		if files[dir] == nil {
+			dirs = append(dirs, dir)
+		}
+		files[dir] = append(files[dir], abs)
+	}
+
+	var exposed []string
+	for _, dir := range dirs {
+		if sb.ownFolder(dir, files[dir]) {
+			sb.hide(dir)
+			continue
+		}
+		for _, path := range files[dir] {
+			if !underAny(path, sb.hidden) {
+				sb.hide(path)
+				exposed = append(exposed, path)
+			}
+		}
+	}
+	return exposed, nil
+}
+
+// Whether dir holds nothing but the given files, their saves in progress and
+// none of the writable paths
+func (sb *Sandbox) ownFolder(dir string, files []string) bool {
+	for _, path := range sb.writable {
+		if underAny(path, []string{dir}) {
+			return false
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !slices.Contains(files, path) && !strings.HasSuffix(path, ".tmp") {
+			return false
+		}
+	}
+	return true
+}
+
+// Hide a path unless it is already inside a hidden one
+func (sb *Sandbox) hide(path string) {
+	if !underAny(path, sb.hidden) {
+		sb.hidden = append(sb.hidden, path)
+	}
+}
+
+// Whether path is one of dirs or inside one
+func underAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if rel, err := filepath.Rel(dir, path); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
+}
+
+// Flags that tell exec-sandboxed how to set up the file system and network
+func (sb *Sandbox) args() []string {
+	var args []string
+	for _, path := range sb.writable {
+		args = append(args, "--writable", path)
+	}
+	for _, path := range sb.hidden {
+		args = append(args, "--hide", path)
+	}
+	if sb.network {
+		args = append(args, "--network")
+	}
+	return args
+}
+
+// wrap makes a command start through exec-sandboxed in new namespaces. It
+// comes after limitCommand, so that rlimits apply to the command rather than
+// to the sandbox's init process.
+func (sb *Sandbox) wrap(cmd *exec.Cmd) error {
+	if sb == nil {
+		return nil
+	}
+	target, err := absoluteCommandPath(cmd)
+	if err != nil {
+		return err
+	}
+	args := append(append([]string{selfExecutable, "exec-sandboxed"}, sb.args()...), "--", target)
+	cmd.Path = selfExecutable
+	cmd.Args = append(args, cmd.Args[1:]...)
+	return isolateCommand(cmd, sb.network)
+}
+
+// String sums the sandbox up for the startup message
+func (sb *Sandbox) String() string {
+	network := "no network"
+	if sb.network {
+		network = "the host's network"
+	}
+	description := fmt.Sprintf("only %s writable, %s", strings.Join(sb.writable, ", "), network)
+	if len(sb.hidden) > 0 {
+		description += ", hiding " + strings.Join(sb.hidden, ", ")
+	}
+	return description
+}
+
+// pathList collects a flag given several times
+type pathList []string
+
+func (list *pathList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *pathList) Set(path string) error {
+	*list = append(*list, path)
+	return nil
+}
+
+const execSandboxedUsage = "Run a command in a namespace sandbox (used by the server for runs and shells)"
+
+func execSandboxedCommand(args []string) int {
+	fs := flag.NewFlagSet("exec-sandboxed", flag.ExitOnError)
+	var writable, hidden pathList
+	fs.Var(&writable, "writable", "Path that stays writable (repeatable)")
+	fs.Var(&hidden, "hide", "Path covered by an empty read-only file system (repeatable)")
+	network := fs.Bool("network", false, "Keep the host's network")
+	check := fs.Bool("check", false, "Set the sandbox up and exit without running anything")
+	asInit := fs.Bool("init", false, "Run as the sandbox's init process (started by exec-sandboxed itself)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: snakeflex exec-sandboxed [flags] -- COMMAND [ARGS...]\n\n%s\n\n", execSandboxedUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 && !*check {
+		fs.Usage()
+		return 2
+	}
+
+	if *asInit {
+		if err := mountProc(); err != nil {
+			fmt.Fprintf(os.Stderr, "snakeflex: setting up the sandbox: %v\n", err)
+			return 126
+		}
+		if *check {
+			return 0
+		}
+		return runSandboxed(fs.Args())
+	}
+	if err := enterSandbox(writable, hidden, *network); err != nil {
+		fmt.Fprintf(os.Stderr, "snakeflex: setting up the sandbox: %v\n", err)
+		return 126
+	}
+	initArgs := []string{"exec-sandboxed", "--init"}
+	if *check {
+		initArgs = append(initArgs, "--check")
+	}
+	return superviseSandbox(append(append(initArgs, "--"), fs.Args()...))
+}
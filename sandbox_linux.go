@@ -0,0 +1,344 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// isolateCommand starts a command as root of new user, mount and, unless the
+// network is kept, network namespaces. Root there is the server's own user
+// outside, so it can set the sandbox up but gains nothing on the host. The
+// PID namespace comes later, from superviseSandbox.
+func isolateCommand(cmd *exec.Cmd, network bool) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS
+	if !network {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	return nil
+}
+
+// enterSandbox turns the new mount namespace into the sandbox: writable paths
+// are bind-mounted onto themselves, every other mount is made read-only, and
+// /dev/shm and the hidden paths get file systems of their own. /proc is left
+// to mountProc in the sandbox's init.
+func enterSandbox(writable, hidden []string, network bool) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+	for _, path := range writable {
+		if err := unix.Mount(path, path, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("binding %s: %v", path, err)
+		}
+	}
+
+	mounts, err := readMounts()
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		if underAny(mount.path, writable) {
+			continue
+		}
+		// Flags a less privileged namespace may not change have to be kept
+		flags := unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY | mount.flags
+		err := unix.Mount("", mount.path, "", uintptr(flags), "")
+		if err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.EACCES) {
+			return fmt.Errorf("making %s read-only: %v", mount.path, err)
+		}
+	}
+
+	// Shared memory for multiprocessing, private to the sandbox
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		if err := unix.Mount("tmpfs", "/dev/shm", "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("mounting /dev/shm: %v", err)
+		}
+	}
+	for _, path := range hidden {
+		if err := hidePath(path); err != nil {
+			return err
+		}
+	}
+
+	if !network {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("bringing up the loopback interface: %v", err)
+		}
+	}
+	// The old working directory is on the mount underneath the writable bind
+	return os.Chdir(wd)
+}
+
+// mountProc gives the sandbox a /proc showing only its own processes. It has
+// to be mounted from inside the new PID namespace. Where /proc is partly
+// masked, as in some containers, the kernel refuses a new one and the host's
+// is hidden instead.
+func mountProc() error {
+	if err := unix.Mount("proc", "/proc", "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return hidePath("/proc")
+	}
+	return nil
+}
+
+type mountPoint struct {
+	path  string
+	flags int // per-mount flags to keep when remounting
+}
+
+// Mount points from /proc/self/mountinfo, parents before their children
+func readMounts() ([]mountPoint, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mounts []mountPoint
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		mount := mountPoint{path: unescapeMountPath(fields[4]), flags: unix.MS_STRICTATIME}
+		for _, option := range strings.Split(fields[5], ",") {
+			switch option {
+			case "nosuid":
+				mount.flags |= unix.MS_NOSUID
+			case "nodev":
+				mount.flags |= unix.MS_NODEV
+			case "noexec":
+				mount.flags |= unix.MS_NOEXEC
+			case "noatime":
+				mount.flags = mount.flags&^unix.MS_STRICTATIME | unix.MS_NOATIME
+			case "relatime":
+				mount.flags = mount.flags&^unix.MS_STRICTATIME | unix.MS_RELATIME
+			case "nodiratime":
+				mount.flags |= unix.MS_NODIRATIME
+			}
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, scanner.Err()
+}
+
+// mountinfo writes spaces, tabs, newlines and backslashes in paths as octal escapes
+func unescapeMountPath(path string) string {
+	var unescaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				unescaped.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(path[i])
+	}
+	return unescaped.String()
+}
+
+// Cover a folder with an empty read-only tmpfs and a file with /dev/null
+func hidePath(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = unix.Mount("tmpfs", path, "tmpfs", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=0755")
+	} else {
+		err = unix.Mount("/dev/null", path, "", unix.MS_BIND, "")
+	}
+	if err != nil {
+		return fmt.Errorf("hiding %s: %v", path, err)
+	}
+	return nil
+}
+
+// A new network namespace has only a loopback interface, and it is down
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
+
+// The sandbox's init process reports the signal that ended the command on this
+// file descriptor
+const initReportFd = 3
+
+// superviseSandbox starts the sandbox's init process in a new PID namespace
+// and ends the way the command did. Init cannot die of a signal it sends
+// itself, so it reports the signal that killed the command and we die of it
+// instead, for the server to see.
+func superviseSandbox(initArgs []string) int {
+	// Signals sent to the whole process group also reach init and the
+	// command; we outlive them to learn how the command ended
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for range signals {
+		}
+	}()
+
+	report, reportWriter, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snakeflex: starting the sandbox: %v\n", err)
+		return 126
+	}
+	// Init is killed with us; the death signal belongs to the starting thread
+	runtime.LockOSThread()
+	initProcess := exec.Command("/proc/self/exe", initArgs...)
+	initProcess.Stdin, initProcess.Stdout, initProcess.Stderr = os.Stdin, os.Stdout, os.Stderr
+	initProcess.ExtraFiles = []*os.File{reportWriter}
+	initProcess.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWPID, Pdeathsig: syscall.SIGKILL}
+	if err := initProcess.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "snakeflex: starting the sandbox: %v\n", err)
+		return 126
+	}
+	reportWriter.Close()
+	reported, _ := io.ReadAll(report)
+	initProcess.Wait()
+
+	if len(reported) == 1 {
+		return dieOfSignal(syscall.Signal(reported[0]))
+	}
+	if status, ok := initProcess.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return dieOfSignal(status.Signal())
+	}
+	return initProcess.ProcessState.ExitCode()
+}
+
+// dieOfSignal ends this process with the signal's default action, bypassing
+// the Go runtime's handlers, and without a core dump. It only returns if the
+// signal does not end processes.
+func dieOfSignal(sig syscall.Signal) int {
+	unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{})
+	signal.Reset(sig)
+	var action [8]uint64 // a zeroed struct sigaction is SIG_DFL on every architecture
+	unix.RawSyscall6(unix.SYS_RT_SIGACTION, uintptr(sig), uintptr(unsafe.Pointer(&action)), 0, 8, 0, 0)
+	// To this thread, so that it is handled before the call returns
+	runtime.LockOSThread()
+	unix.Tgkill(unix.Getpid(), unix.Gettid(), sig)
+	return 128 + int(sig)
+}
+
+// runSandboxed runs the command as the init process of the sandbox's PID
+// namespace would: it reaps orphans, and it exits with the command, taking
+// every process left in the sandbox with it. The command gets a user
+// namespace of its own in which it is the server's user again, so it has no
+// privileges over the mounts set up for it.
+func runSandboxed(args []string) int {
+	report := os.NewFile(initReportFd, "report")
+	syscall.CloseOnExec(initReportFd)
+
+	// Signals sent to the whole process group reach the command directly. As
+	// init we only receive those we handle, and pass them on to a command
+	// that moved to a group of its own, like an interactive bash.
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	process, err := startSandboxed(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snakeflex: %s: %v\n", args[0], err)
+		return 127
+	}
+	go func() {
+		for sig := range signals {
+			if pgid, err := syscall.Getpgid(process.Pid); err == nil && pgid != syscall.Getpgrp() {
+				process.Signal(sig)
+			}
+		}
+	}()
+
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "snakeflex: waiting for %s: %v\n", args[0], err)
+			return 127
+		}
+		if pid != process.Pid {
+			continue
+		}
+		if status.Signaled() {
+			// Init cannot die of a signal it sends itself; superviseSandbox can
+			report.Write([]byte{byte(status.Signal())})
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	}
+}
+
+// Start the command in a user namespace that maps the server's user back
+func startSandboxed(args []string) (*os.Process, error) {
+	uid, err := outsideID("/proc/self/uid_map")
+	if err != nil {
+		return nil, err
+	}
+	gid, err := outsideID("/proc/self/gid_map")
+	if err != nil {
+		return nil, err
+	}
+	return os.StartProcess(args[0], args, &os.ProcAttr{
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys: &syscall.SysProcAttr{
+			Cloneflags:                 syscall.CLONE_NEWUSER,
+			UidMappings:                []syscall.SysProcIDMap{{ContainerID: uid, HostID: 0, Size: 1}},
+			GidMappings:                []syscall.SysProcIDMap{{ContainerID: gid, HostID: 0, Size: 1}},
+			GidMappingsEnableSetgroups: false,
+		},
+	})
+}
+
+// The user or group the sandbox's root stands for outside, from a "0 <id> 1" map
+func outsideID(mapFile string) (int, error) {
+	data, err := os.ReadFile(mapFile)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 || fields[0] != "0" {
+		return 0, fmt.Errorf("unexpected %s: %q", mapFile, data)
+	}
+	return strconv.Atoi(fields[1])
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// Namespaces only exist on Linux
+func isolateCommand(cmd *exec.Cmd, network bool) error {
+	return fmt.Errorf("the sandbox needs Linux namespaces")
+}
+
+func enterSandbox(writable, hidden []string, network bool) error {
+	return fmt.Errorf("the sandbox needs Linux namespaces")
+}
+
+func mountProc() error {
+	return fmt.Errorf("the sandbox needs Linux namespaces")
+}
+
+func superviseSandbox(initArgs []string) int {
+	return 126
+}
+
+func runSandboxed(args []string) int {
+	return 127
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHideSecrets(t *testing.T) {
+	root := t.TempDir()
+	for _, path := range []string{
+		"etc/snakeflex/users.json", "etc/snakeflex/sessions.json", "etc/snakeflex/.sessions-1.tmp",
+		"home/users.json", "home/notes.txt",
+		"project/tokens.json", "project/main.py", "project/recordings/alice/1.cast",
+		"var/log/snakeflex/audit.log", "var/log/snakeflex/audit.log.1",
+	} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(path)), 0755)
+		os.WriteFile(filepath.Join(root, path), nil, 0600)
+	}
+	at := func(paths ...string) []string {
+		var abs []string
+		for _, path := range paths {
+			abs = append(abs, filepath.Join(root, path))
+		}
+		return abs
+	}
+
+	tests := []struct {
+		name        string
+		secrets     []string
+		hidden      []string
+		wantHidden  []string
+		wantExposed []string
+	}{
+		{"none", []string{"", ""}, nil, nil, nil},
+		{"folder of their own", at("etc/snakeflex/users.json", "etc/snakeflex/sessions.json"), nil, at("etc/snakeflex"), nil},
+		{"not yet created", at("etc/snakeflex/totp.json", "etc/snakeflex/users.json", "etc/snakeflex/sessions.json"), nil, at("etc/snakeflex"), nil},
+		{"shared folder", at("home/users.json"), nil, at("home/users.json"), at("home/users.json")},
+		{"in the working directory", at("project/tokens.json"), nil, at("project/tokens.json"), at("project/tokens.json")},
+		{"already hidden", at("home/users.json"), at("home"), at("home"), nil},
+		{"only some of the folder", at("etc/snakeflex/users.json"), nil, at("etc/snakeflex/users.json"), at("etc/snakeflex/users.json")},
+		{"audit log and its rotated files", at(auditLogFiles("var/log/snakeflex/audit.log", 3)...), nil, at("var/log/snakeflex"), nil},
+		{"audit log without its rotated files", at("var/log/snakeflex/audit.log"), nil,
+			at("var/log/snakeflex/audit.log"), at("var/log/snakeflex/audit.log")},
+		{"secret folder", at("etc/snakeflex"), nil, at("etc/snakeflex"), nil},
+		{"secret folder in the working directory", at("project/recordings"), nil, at("project/recordings"), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sb := &Sandbox{writable: at("project"), hidden: test.hidden}
+			exposed, err := sb.hideSecrets(test.secrets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sb.hidden, test.wantHidden) {
+				t.Errorf("hidden = %q, want %q", sb.hidden, test.wantHidden)
+			}
+			if !reflect.DeepEqual(exposed, test.wantExposed) {
+				t.Errorf("exposed = %q, want %q", exposed, test.wantExposed)
+			}
+		})
+	}
+
+	sb := &Sandbox{writable: at("project")}
+	if _, err := sb.hideSecrets(at(".")); err == nil {
+		t.Errorf("hid a folder holding the working directory: %q", sb.hidden)
+	}
+}
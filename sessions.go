@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Default absolute lifetime of a session
+const defaultSessionLifetime = 24 * time.Hour
+
+// How stale LastSeen may get before a request writes it back to the store.
+// Keeps a file-backed store from being rewritten on every request.
+const sessionTouchInterval = time.Minute
+
+// Session is a signed-in browser, tied to the user who logged in
+type Session struct {
+	Username   string    `json:"username"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeen   time.Time `json:"lastSeen"`
+	Expiry     time.Time `json:"expiry"`               // absolute expiry, never extended
+	Role       string    `json:"role,omitempty"`       // set for single sign-on users, who are not in the users file
+	ClientCert string    `json:"clientCert,omitempty"` // SHA-256 of the client certificate the session was started with
+	ClientIP   string    `json:"clientIP,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+}
+
+// SessionStore persists sessions. Keys are SHA-256 hashes of the session
+// tokens, so a leaked store cannot be replayed as cookies.
+type SessionStore interface {
+	Get(key string) (*Session, bool)
+	Put(key string, session *Session) error
+	Delete(key string) error
+	All() map[string]*Session
+}
+
+// MemorySessionStore keeps sessions for the lifetime of the process
+type MemorySessionStore struct {
+	sessions map[string]*Session
+	mutex    sync.RWMutex
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]*Session)}
+}
+
+func (ms *MemorySessionStore) Get(key string) (*Session, bool) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	session, exists := ms.sessions[key]
+	if !exists {
+		return nil, false
+	}
+	snapshot := *session
+	return &snapshot, true
+}
+
+func (ms *MemorySessionStore) Put(key string, session *Session) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	snapshot := *session
+	ms.sessions[key] = &snapshot
+	return nil
+}
+
+func (ms *MemorySessionStore) Delete(key string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	delete(ms.sessions, key)
+	return nil
+}
+
+func (ms *MemorySessionStore) All() map[string]*Session {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	all := make(map[string]*Session, len(ms.sessions))
+	for key, session := range ms.sessions {
+		snapshot := *session
+		all[key] = &snapshot
+	}
+	return all
+}
+
+// FileSessionStore keeps sessions in memory and writes them to a JSON file on
+// every change, so signed-in users survive restarts and upgrades
+type FileSessionStore struct {
+	*MemorySessionStore
+	path      string
+	fileMutex sync.Mutex
+}
+
+func NewFileSessionStore(path string) (*FileSessionStore, error) {
+	fs := &FileSessionStore{
+		MemorySessionStore: NewMemorySessionStore(),
+		path:               path,
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return fs, nil
+	case err != nil:
+		return nil, fmt.Errorf("reading session file: %v", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &fs.sessions); err != nil {
+			return nil, fmt.Errorf("parsing session file %s: %v", path, err)
+		}
+	}
+	return fs, nil
+}
+
+func (fs *FileSessionStore) Put(key string, session *Session) error {
+	fs.MemorySessionStore.Put(key, session)
+	return fs.save()
+}
+
+func (fs *FileSessionStore) Delete(key string) error {
+	fs.MemorySessionStore.Delete(key)
+	return fs.save()
+}
+
+// Write the whole store to a temporary file and rename it into place
+func (fs *FileSessionStore) save() error {
+	fs.fileMutex.Lock()
+	defer fs.fileMutex.Unlock()
+
+	data, err := json.MarshalIndent(fs.All(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), ".sessions-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.path)
+}
+
+// SessionInfo describes a session to administrators without exposing its token
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	ClientIP  string    `json:"clientIP,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Current   bool      `json:"current"`
+}
+
+// SessionManager issues and validates session tokens. Sessions end at their
+// absolute lifetime, or earlier when idle for longer than idleTimeout; every
+// validated request slides the idle deadline forward.
+type SessionManager struct {
+	store       SessionStore
+	lifetime    time.Duration
+	idleTimeout time.Duration // 0 disables the idle timeout
+	mutex       sync.Mutex
+}
+
+func NewSessionManager(store SessionStore, lifetime, idleTimeout time.Duration) *SessionManager {
+	sm := &SessionManager{
+		store:       store,
+		lifetime:    lifetime,
+		idleTimeout: idleTimeout,
+	}
+
+	// Clean up expired sessions every hour
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			sm.CleanupExpiredSessions()
+		}
+	}()
+
+	return sm
+}
+
+// Tokens are only ever stored hashed
+func sessionKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Short public identifier for a session, derived from its key
+func sessionID(key string) string {
+	return key[:16]
+}
+
+// CreateSession returns a new token and the time its session expires at the latest
+func (sm *SessionManager) CreateSession(username, role, clientCert, clientIP, userAgent string) (string, time.Time) {
+	// Generate secure random token
+	bytes := make([]byte, 32)
+	rand.Read(bytes)
+	token := base64.URLEncoding.EncodeToString(bytes)
+
+	now := time.Now()
+	session := &Session{
+		Username:   username,
+		CreatedAt:  now,
+		LastSeen:   now,
+		Expiry:     now.Add(sm.lifetime),
+		Role:       role,
+		ClientCert: clientCert,
+		ClientIP:   clientIP,
+		UserAgent:  userAgent,
+	}
+	if err := sm.store.Put(sessionKey(token), session); err != nil {
+		log.Printf("⚠️  Failed to save session for %s: %v", username, err)
+	}
+	return token, session.Expiry
+}
+
+// When a session ends: its absolute expiry or its idle deadline, whichever is first
+func (sm *SessionManager) expiresAt(session *Session) time.Time {
+	if sm.idleTimeout > 0 {
+		if idle := session.LastSeen.Add(sm.idleTimeout); idle.Before(session.Expiry) {
+			return idle
+		}
+	}
+	return session.Expiry
+}
+
+// ValidateSession returns the session a valid token belongs to and renews
+// its idle deadline
+func (sm *SessionManager) ValidateSession(token string) (*Session, bool) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	key := sessionKey(token)
+	session, exists := sm.store.Get(key)
+	if !exists {
+		return nil, false
+	}
+
+	now := time.Now()
+	if now.After(sm.expiresAt(session)) {
+		sm.store.Delete(key)
+		return nil, false
+	}
+
+	// Short idle timeouts need fresher timestamps than the usual interval
+	if since := now.Sub(session.LastSeen); since >= sessionTouchInterval || (sm.idleTimeout > 0 && since >= sm.idleTimeout/2) {
+		session.LastSeen = now
+		if err := sm.store.Put(key, session); err != nil {
+			log.Printf("⚠️  Failed to renew session for %s: %v", session.Username, err)
+		}
+	}
+
+	return session, true
+}
+
+func (sm *SessionManager) DeleteSession(token string) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if err := sm.store.Delete(sessionKey(token)); err != nil {
+		log.Printf("⚠️  Failed to delete session: %v", err)
+	}
+}
+
+// List returns active sessions, newest first; currentToken marks the caller's own
+func (sm *SessionManager) List(currentToken string) []SessionInfo {
+	current := ""
+	if currentToken != "" {
+		current = sessionKey(currentToken)
+	}
+
+	now := time.Now()
+	infos := []SessionInfo{}
+	for key, session := range sm.store.All() {
+		expiresAt := sm.expiresAt(session)
+		if now.After(expiresAt) {
+			continue
+		}
+		infos = append(infos, SessionInfo{
+			ID:        sessionID(key),
+			Username:  session.Username,
+			CreatedAt: session.CreatedAt,
+			LastSeen:  session.LastSeen,
+			ExpiresAt: expiresAt,
+			ClientIP:  session.ClientIP,
+			UserAgent: session.UserAgent,
+			Current:   key == current,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].CreatedAt.After(infos[j].CreatedAt)
+	})
+	return infos
+}
+
+// Revoke ends the sessions matching an ID or, when id is empty, all sessions
+// of a user. It returns how many were ended.
+func (sm *SessionManager) Revoke(id, username string) (int, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	revoked := 0
+	for key, session := range sm.store.All() {
+		switch {
+		case id != "" && sessionID(key) != id:
+			continue
+		case id == "" && session.Username != username:
+			continue
+		}
+		if err := sm.store.Delete(key); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+func (sm *SessionManager) CleanupExpiredSessions() {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	now := time.Now()
+	for key, session := range sm.store.All() {
+		if now.After(sm.expiresAt(session)) {
+			sm.store.Delete(key)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// ShareState records whether a shell or run has been shared by its owner and
+// which other identities may type into it. Everyone else watching a shared
+// session is a read-only viewer.
+type ShareState struct {
+	shared  bool
+	writers map[string]bool
+	mutex   sync.Mutex
+}
+
+// SetShared turns sharing on or off; unsharing also drops every granted writer
+func (s *ShareState) SetShared(shared bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.shared = shared
+	if !shared {
+		s.writers = nil
+	}
+}
+
+func (s *ShareState) Shared() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.shared
+}
+
+func (s *ShareState) Grant(identity string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.writers == nil {
+		s.writers = make(map[string]bool)
+	}
+	s.writers[identity] = true
+}
+
+func (s *ShareState) Revoke(identity string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.writers, identity)
+}
+
+// CanView reports whether an identity may watch a session owned by owner
+func (s *ShareState) CanView(owner, identity string) bool {
+	if identity == owner {
+		return true
+	}
+	return s.Shared()
+}
+
+// CanWrite reports whether an identity may send input to a session owned by owner
+func (s *ShareState) CanWrite(owner, identity string) bool {
+	if identity == owner {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.shared && s.writers[identity]
+}
+
+func (s *ShareState) Writers() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	writers := []string{}
+	for identity := range s.writers {
+		writers = append(writers, identity)
+	}
+	sort.Strings(writers)
+	return writers
+}
+
+// SharedItem describes a shared shell or run to anyone with a valid session
+type SharedItem struct {
+	Kind     string   `json:"kind"` // "shell" or "run"
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Owner    string   `json:"owner"`
+	Shared   bool     `json:"shared"`
+	Writers  []string `json:"writers"`
+	Viewers  []string `json:"viewers"`
+	CanWrite bool     `json:"canWrite"`
+}
+
+// Distinct identities other than the owner among those attached
+func viewerIdentities(owner string, identities []string) []string {
+	seen := make(map[string]bool)
+	viewers := []string{}
+	for _, identity := range identities {
+		if identity != owner && !seen[identity] {
+			seen[identity] = true
+			viewers = append(viewers, identity)
+		}
+	}
+	sort.Strings(viewers)
+	return viewers
+}
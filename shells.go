@@ -0,0 +1,585 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/gorilla/websocket"
+)
+
+// Terminal output retained per shell session and replayed when a client attaches
+const shellScrollbackSize = 256 << 10 // 256 KB
+
+// Frames buffered per attached client before it is considered too slow and dropped
+const shellClientQueueSize = 256
+
+// How long a single frame write may block before the client is dropped
+const shellWriteTimeout = 10 * time.Second
+
+// How long the last output of an exited shell may take to drain; a background
+// process it left behind can keep the terminal open indefinitely
+const shellDrainTimeout = 2 * time.Second
+
+// ShellInfo describes a shell session for clients listing what they can attach to
+type ShellInfo struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Interpreter  string    `json:"interpreter,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	LastActivity time.Time `json:"lastActivity"`
+	Clients      int       `json:"clients"`
+}
+
+type shellFrame struct {
+	messageType int
+	data        []byte
+}
+
+// ShellClient is one WebSocket attached to a shell session. Frames are written
+// from a dedicated goroutine so that a slow browser cannot stall the PTY.
+type ShellClient struct {
+	Identity  string
+	conn      *websocket.Conn
+	frames    chan shellFrame
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewShellClient(conn *websocket.Conn, identity string) *ShellClient {
+	client := &ShellClient{
+		Identity: identity,
+		conn:     conn,
+		frames:   make(chan shellFrame, shellClientQueueSize),
+		done:     make(chan struct{}),
+	}
+	go client.writer()
+	return client
+}
+
+func (c *ShellClient) writer() {
+	defer c.conn.Close()
+	for {
+		select {
+		case frame := <-c.frames:
+			if err := c.write(frame); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.done:
+			// Flush whatever was queued (such as an exit notice) before hanging up
+			for {
+				select {
+				case frame := <-c.frames:
+					if c.write(frame) != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *ShellClient) write(frame shellFrame) error {
+	c.conn.SetWriteDeadline(time.Now().Add(shellWriteTimeout))
+	return c.conn.WriteMessage(frame.messageType, frame.data)
+}
+
+func (c *ShellClient) send(messageType int, data []byte) {
+	select {
+	case <-c.done:
+	case c.frames <- shellFrame{messageType, data}:
+	default:
+		log.Printf("Shell client too slow, disconnecting")
+		c.Close()
+	}
+}
+
+func (c *ShellClient) SendOutput(data []byte) {
+	c.send(websocket.BinaryMessage, data)
+}
+
+// SendControl delivers a JSON control message as a text frame; terminal output uses binary frames
+func (c *ShellClient) SendControl(msg ShellMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	c.send(websocket.TextMessage, data)
+}
+
+// Close stops accepting frames; the writer flushes the queue and closes the socket
+func (c *ShellClient) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// ShellSession is a shell process owned by the server rather than by a
+// WebSocket, so clients can detach and re-attach without losing it
+type ShellSession struct {
+	ID          string
+	Name        string
+	Owner       string
+	Interpreter string // ID of the Python environment activated in it
+	CreatedAt   time.Time
+
+	cmd          *exec.Cmd
+	ptmx         *os.File
+	scrollback   []byte
+	clients      map[*ShellClient]bool
+	lastActivity time.Time
+	share        ShareState
+	recorder     *Recorder // nil unless --record-dir is set
+	timedOut     bool
+	hungUp       bool // the server sent the shell a signal
+	done         chan struct{}
+	pumpDone     chan struct{} // closed once all PTY output has been delivered
+	mutex        sync.Mutex
+}
+
+func (s *ShellSession) Info() ShellInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return ShellInfo{
+		ID:           s.ID,
+		Name:         s.Name,
+		Interpreter:  s.Interpreter,
+		CreatedAt:    s.CreatedAt,
+		LastActivity: s.lastActivity,
+		Clients:      len(s.clients),
+	}
+}
+
+// Attach replays the scrollback to a client and subscribes it to live output
+func (s *ShellSession) Attach(client *ShellClient) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	client.SendControl(ShellMessage{Type: "attached", ID: s.ID, Name: s.Name, ReadOnly: !s.CanWrite(client.Identity)})
+	if len(s.scrollback) > 0 {
+		client.SendOutput(append([]byte(nil), s.scrollback...))
+	}
+	s.clients[client] = true
+	s.lastActivity = time.Now()
+}
+
+func (s *ShellSession) Detach(client *ShellClient) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.clients, client)
+	s.lastActivity = time.Now()
+}
+
+// CanView reports whether an identity may watch the shell
+func (s *ShellSession) CanView(identity string) bool {
+	return s.share.CanView(s.Owner, identity)
+}
+
+// CanWrite reports whether an identity may type into or resize the shell
+func (s *ShellSession) CanWrite(identity string) bool {
+	return s.share.CanWrite(s.Owner, identity)
+}
+
+// Viewers lists the other identities currently attached to the shell
+func (s *ShellSession) Viewers() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var identities []string
+	for client := range s.clients {
+		identities = append(identities, client.Identity)
+	}
+	return viewerIdentities(s.Owner, identities)
+}
+
+// NotifyAccess tells every attached client whether it may currently type
+func (s *ShellSession) NotifyAccess() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for client := range s.clients {
+		client.SendControl(ShellMessage{Type: "access", ID: s.ID, ReadOnly: !s.CanWrite(client.Identity)})
+	}
+}
+
+// Unshare stops sharing the shell and disconnects everyone but the owner from it
+func (s *ShellSession) Unshare() {
+	s.share.SetShared(false)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for client := range s.clients {
+		if client.Identity != s.Owner {
+			client.SendControl(ShellMessage{Type: "error", ID: s.ID, Data: "The owner stopped sharing this shell"})
+			client.Close()
+			delete(s.clients, client)
+		}
+	}
+}
+
+func (s *ShellSession) Write(data []byte) error {
+	s.mutex.Lock()
+	s.lastActivity = time.Now()
+	s.mutex.Unlock()
+
+	_, err := s.ptmx.Write(data)
+	return err
+}
+
+func (s *ShellSession) Resize(rows, cols uint16) error {
+	s.recorder.Resize(int(cols), int(rows))
+	return pty.Setsize(s.ptmx, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+// Terminate hangs up the shell, killing it if it does not exit in time
+func (s *ShellSession) Terminate() {
+	if s.cmd.Process == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.hungUp = true
+	s.mutex.Unlock()
+	signalProcessGroup(s.cmd.Process, syscall.SIGHUP)
+	go func() {
+		select {
+		case <-s.done:
+		case <-time.After(stopGracePeriod):
+			signalProcessGroup(s.cmd.Process, syscall.SIGKILL)
+		}
+	}()
+}
+
+// Hang up the shell because it has used up its wall-clock time
+func (s *ShellSession) timeOut() {
+	s.mutex.Lock()
+	s.timedOut = true
+	s.mutex.Unlock()
+	s.Terminate()
+}
+
+// Whether the shell ran out of time, and whether it was sent a signal at all
+func (s *ShellSession) endedByServer() (bool, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.timedOut, s.hungUp
+}
+
+// Fan PTY output out to every attached client, keeping a bounded scrollback
+func (s *ShellSession) pump() {
+	defer close(s.pumpDone)
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.ptmx.Read(buf)
+		if n > 0 {
+			chunk := append([]byte(nil), buf[:n]...)
+			s.recorder.Output(chunk)
+
+			s.mutex.Lock()
+			s.scrollback = append(s.scrollback, chunk...)
+			if overflow := len(s.scrollback) - shellScrollbackSize; overflow > 0 {
+				s.scrollback = append([]byte(nil), s.scrollback[overflow:]...)
+			}
+			for client := range s.clients {
+				client.SendOutput(chunk)
+			}
+			s.mutex.Unlock()
+		}
+		if err != nil {
+			// Linux reports EIO once the shell and everything it started have
+			// closed the terminal, which is the end of its output like EOF
+			if err != io.EOF && !errors.Is(err, syscall.EIO) && !errors.Is(err, os.ErrClosed) {
+				log.Printf("Error reading from pty: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// ShellManager owns every shell session on the server
+type ShellManager struct {
+	sessions    map[string]*ShellSession
+	idleTimeout time.Duration
+	verbose     bool
+	auditLog    *AuditLog
+	recordings  *RecordingStore
+	limits      ResourceLimits
+	cgroups     *CgroupManager
+	sandbox     *Sandbox
+	mutex       sync.Mutex
+}
+
+func NewShellManager(idleTimeout time.Duration, verbose bool, auditLog *AuditLog, recordings *RecordingStore, limits ResourceLimits, cgroups *CgroupManager, sandbox *Sandbox) *ShellManager {
+	sm := &ShellManager{
+		sessions:    make(map[string]*ShellSession),
+		idleTimeout: idleTimeout,
+		verbose:     verbose,
+		auditLog:    auditLog,
+		recordings:  recordings,
+		limits:      limits,
+		cgroups:     cgroups,
+		sandbox:     sandbox,
+	}
+
+	// Reclaim abandoned sessions every minute
+	if idleTimeout > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			for range ticker.C {
+				sm.CleanupIdleSessions()
+			}
+		}()
+	}
+
+	return sm
+}
+
+// Create starts a shell command in a new PTY and registers it as a session.
+// An empty name picks the next free "shell-N".
+func (sm *ShellManager) Create(owner, name, interpreter string, cmd *exec.Cmd) (*ShellSession, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if name == "" {
+		name = sm.nextName(owner)
+	} else if sm.nameTaken(owner, name, "") {
+		return nil, fmt.Errorf("a shell named %q already exists", name)
+	}
+
+	id := generateID(6)
+	cgroup := sm.cgroups.cgroupFor(cmd, "shell-"+id, sm.limits)
+	if err := limitCommand(cmd, sm.limits, cgroup); err != nil {
+		sm.cgroups.Remove(cgroup)
+		return nil, fmt.Errorf("cannot apply resource limits: %v", err)
+	}
+	if err := sm.sandbox.wrap(cmd); err != nil {
+		sm.cgroups.Remove(cgroup)
+		return nil, fmt.Errorf("cannot sandbox the shell: %v", err)
+	}
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		sm.cgroups.Remove(cgroup)
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &ShellSession{
+		ID:           id,
+		Name:         name,
+		Owner:        owner,
+		Interpreter:  interpreter,
+		CreatedAt:    now,
+		cmd:          cmd,
+		ptmx:         ptmx,
+		clients:      make(map[*ShellClient]bool),
+		lastActivity: now,
+		done:         make(chan struct{}),
+		pumpDone:     make(chan struct{}),
+	}
+	session.recorder = sm.recordings.Start(owner, "shell", session.ID, name)
+	sm.sessions[session.ID] = session
+
+	sm.auditLog.Record(AuditEvent{Event: AuditShellOpen, User: owner, ShellID: session.ID, Name: name})
+	go session.pump()
+	var timer *time.Timer
+	if sm.limits.Timeout > 0 {
+		timer = time.AfterFunc(sm.limits.Timeout, session.timeOut)
+	}
+	go func() {
+		cmd.Wait()
+		if timer != nil {
+			timer.Stop()
+		}
+		timedOut, hungUp := session.endedByServer()
+		limit := limitReached(sm.limits, cmd.ProcessState, cgroup, timedOut, hungUp, false)
+		sm.cgroups.Remove(cgroup)
+		close(session.done)
+
+		// Deliver the shell's last output before closing the terminal and
+		// telling clients it exited
+		select {
+		case <-session.pumpDone:
+		case <-time.After(shellDrainTimeout):
+		}
+		ptmx.Close()
+		sm.remove(session, limit)
+	}()
+
+	if sm.verbose {
+		log.Printf("⌨️ Started shell session %s (%s) for %s", session.ID, name, owner)
+	}
+	return session, nil
+}
+
+// Drop a session whose shell has exited and tell its clients, and which
+// resource limit ended it, if one did
+func (sm *ShellManager) remove(session *ShellSession, limit string) {
+	sm.mutex.Lock()
+	delete(sm.sessions, session.ID)
+	sm.mutex.Unlock()
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	exited := ShellMessage{Type: "exited", ID: session.ID, Name: session.Name, Limit: limit}
+	if limit != "" {
+		exited.Data = fmt.Sprintf("Stopped by its %s", sm.limits.Describe(limit))
+	}
+	for client := range session.clients {
+		client.SendControl(exited)
+		client.Close()
+	}
+	session.clients = make(map[*ShellClient]bool)
+	session.recorder.Close()
+
+	sm.auditLog.Record(AuditEvent{Event: AuditShellClose, User: session.Owner, ShellID: session.ID, Name: session.Name,
+		DurationMs: time.Since(session.CreatedAt).Milliseconds(), Reason: limit})
+	if sm.verbose && limit != "" {
+		log.Printf("⌨️ Shell session %s (%s) stopped by its %s", session.ID, session.Name, sm.limits.Describe(limit))
+	} else if sm.verbose {
+		log.Printf("⌨️ Shell session %s (%s) ended", session.ID, session.Name)
+	}
+}
+
+// Callers must hold sm.mutex
+func (sm *ShellManager) nameTaken(owner, name, exceptID string) bool {
+	for _, session := range sm.sessions {
+		if session.Owner == owner && session.Name == name && session.ID != exceptID {
+			return true
+		}
+	}
+	return false
+}
+
+// Callers must hold sm.mutex
+func (sm *ShellManager) nextName(owner string) string {
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("shell-%d", i)
+		if !sm.nameTaken(owner, name, "") {
+			return name
+		}
+	}
+}
+
+// Rename changes a session's name, keeping names unique per owner
+func (sm *ShellManager) Rename(owner, id, name string) (*ShellSession, error) {
+	if name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	session, exists := sm.sessions[id]
+	if !exists || session.Owner != owner {
+		return nil, fmt.Errorf("shell session not found")
+	}
+	if sm.nameTaken(owner, name, id) {
+		return nil, fmt.Errorf("a shell named %q already exists", name)
+	}
+
+	session.mutex.Lock()
+	session.Name = name
+	for client := range session.clients {
+		client.SendControl(ShellMessage{Type: "renamed", ID: session.ID, Name: name})
+	}
+	session.mutex.Unlock()
+	return session, nil
+}
+
+// FindByName returns the owner's session with the given name, if any
+func (sm *ShellManager) FindByName(owner, name string) *ShellSession {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	for _, session := range sm.sessions {
+		if session.Owner == owner && session.Name == name {
+			return session
+		}
+	}
+	return nil
+}
+
+// Get returns a session by ID if it belongs to the owner
+func (sm *ShellManager) Get(owner, id string) (*ShellSession, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	session, exists := sm.sessions[id]
+	if !exists || session.Owner != owner {
+		return nil, fmt.Errorf("shell session not found")
+	}
+	return session, nil
+}
+
+// Lookup returns a session the identity may watch: its own, or one shared with it
+func (sm *ShellManager) Lookup(identity, id string) (*ShellSession, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	session, exists := sm.sessions[id]
+	if !exists || !session.CanView(identity) {
+		return nil, fmt.Errorf("shell session not found")
+	}
+	return session, nil
+}
+
+// Visible returns the identity's own shells and every shell shared by others, oldest first
+func (sm *ShellManager) Visible(identity string) []*ShellSession {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	var sessions []*ShellSession
+	for _, session := range sm.sessions {
+		if session.CanView(identity) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions
+}
+
+// List describes the owner's sessions, oldest first
+func (sm *ShellManager) List(owner string) []ShellInfo {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	sessions := []ShellInfo{}
+	for _, session := range sm.sessions {
+		if session.Owner == owner {
+			sessions = append(sessions, session.Info())
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions
+}
+
+// CleanupIdleSessions terminates sessions nobody has been attached to for longer than the idle timeout
+func (sm *ShellManager) CleanupIdleSessions() {
+	sm.mutex.Lock()
+	var idle []*ShellSession
+	now := time.Now()
+	for _, session := range sm.sessions {
+		info := session.Info()
+		if info.Clients == 0 && now.Sub(info.LastActivity) > sm.idleTimeout {
+			idle = append(idle, session)
+		}
+	}
+	sm.mutex.Unlock()
+
+	for _, session := range idle {
+		if sm.verbose {
+			log.Printf("⌨️ Terminating idle shell session %s (%s)", session.ID, session.Info().Name)
+		}
+		session.Terminate()
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often certificate files are checked for renewal, and how long a
+// generated self-signed certificate is valid
+const (
+	certCheckInterval  = 30 * time.Second
+	selfSignedLifetime = 365 * 24 * time.Hour
+)
+
+// CertReloader serves the certificate from a pair of PEM files and picks up
+// renewed files without restarting the listener, so shells and runs survive
+type CertReloader struct {
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	modTime  time.Time // newest of the two files when last loaded
+	mutex    sync.RWMutex
+}
+
+func NewCertReloader(certPath, keyPath string) (*CertReloader, error) {
+	cr := &CertReloader{certPath: certPath, keyPath: keyPath}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+
+	// Reload renewed certificates, e.g. from certbot, as soon as they change
+	go func() {
+		ticker := time.NewTicker(certCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if cr.changed() {
+				cr.reloadAndLog()
+			}
+		}
+	}()
+
+	return cr, nil
+}
+
+func (cr *CertReloader) filesModTime() time.Time {
+	var newest time.Time
+	for _, path := range []string{cr.certPath, cr.keyPath} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest
+}
+
+func (cr *CertReloader) changed() bool {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	return !cr.filesModTime().Equal(cr.modTime)
+}
+
+// Reload reads the files again; on failure the previous certificate stays in use
+func (cr *CertReloader) Reload() error {
+	modTime := cr.filesModTime()
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	// Remember this version even if it is broken, so it is reported once
+	cr.modTime = modTime
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %v", err)
+	}
+	cr.cert = &cert
+	return nil
+}
+
+func (cr *CertReloader) reloadAndLog() {
+	if err := cr.Reload(); err != nil {
+		log.Printf("⚠️ Keeping previous TLS certificate, reload failed: %v", err)
+		return
+	}
+	log.Printf("🔄 Reloaded TLS certificate from %s", cr.certPath)
+}
+
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	return cr.cert, nil
+}
+
+// generateSelfSigned creates a certificate for localhost and this machine's
+// name. The PEM blocks are returned so they can be kept across restarts.
+func generateSelfSigned() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Snakeflex self-signed"}, CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// ensureSelfSigned writes a new self-signed pair unless both files exist
+func ensureSelfSigned(certPath, keyPath string) (bool, error) {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if certErr == nil && keyErr == nil {
+		return false, nil
+	}
+	certPEM, keyPEM, err := generateSelfSigned()
+	if err != nil {
+		return false, fmt.Errorf("generating self-signed certificate: %v", err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return false, fmt.Errorf("writing TLS key: %v", err)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return false, fmt.Errorf("writing TLS certificate: %v", err)
+	}
+	return true, nil
+}
+
+// SHA-256 fingerprint to compare with what the browser shows for a self-signed certificate
+func certFingerprint(cert *tls.Certificate) string {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	hexSum := strings.ToUpper(hex.EncodeToString(sum[:]))
+	var pairs []string
+	for i := 0; i < len(hexSum); i += 2 {
+		pairs = append(pairs, hexSum[i:i+2])
+	}
+	return strings.Join(pairs, ":")
+}
+
+// httpsRedirectHandler sends plain HTTP requests to the HTTPS port
+func httpsRedirectHandler(tlsPort string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]" // IPv6 literal
+		}
+		if tlsPort != "443" {
+			host += ":" + tlsPort
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
+
+// Whether the browser reached us over HTTPS, directly or through a trusted proxy;
+// cookies are marked Secure accordingly
+func (ts *TerminalServer) secureRequest(r *http.Request) bool {
+	return r.TLS != nil || (ts.fromTrustedProxy(r) && r.Header.Get("X-Forwarded-Proto") == "https")
+}
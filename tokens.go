@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix that makes API tokens recognisable in configs and secret scanners
+const apiTokenPrefix = "sfx_"
+
+// APIToken lets scripts act as a user, limited to a set of scopes. Only a
+// hash of the token itself is stored.
+type APIToken struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Username  string     `json:"username"`
+	Scopes    []string   `json:"scopes"`
+	Hash      string     `json:"hash,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"` // nil never expires
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+}
+
+func (t *APIToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && now.After(*t.ExpiresAt)
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Scopes are permission names; parseScopes rejects anything else
+func parseScopes(list string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(list, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !containsPermission(rolePermissions["admin"], scope) {
+			return nil, fmt.Errorf("unknown scope %q (expected one of %s)", scope, strings.Join(rolePermissions["admin"], ", "))
+		}
+		if !containsPermission(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+// TokenStore keeps API tokens in a JSON file. The file is re-read whenever it
+// changes, so tokens added or revoked with the `token` command apply to a
+// running server.
+type TokenStore struct {
+	path    string
+	tokens  map[string]*APIToken // by hash
+	modTime time.Time
+	mutex   sync.Mutex
+}
+
+func LoadTokenStore(path string) (*TokenStore, error) {
+	store := &TokenStore{path: path, tokens: make(map[string]*APIToken)}
+	if err := store.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Re-read the file if it changed on disk; the caller holds the lock
+func (store *TokenStore) reloadIfChanged() error {
+	info, err := os.Stat(store.path)
+	if os.IsNotExist(err) {
+		store.tokens = make(map[string]*APIToken)
+		store.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading token file: %v", err)
+	}
+	if info.ModTime().Equal(store.modTime) {
+		return nil
+	}
+
+	// Remember this version even if it is broken, so it is reported once
+	store.modTime = info.ModTime()
+	data, err := os.ReadFile(store.path)
+	if err != nil {
+		return fmt.Errorf("reading token file: %v", err)
+	}
+	var list []*APIToken
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("parsing token file %s: %v", store.path, err)
+		}
+	}
+
+	tokens := make(map[string]*APIToken, len(list))
+	for _, token := range list {
+		if token.Hash == "" || token.Username == "" {
+			return fmt.Errorf("token %q in %s has no hash or username", token.ID, store.path)
+		}
+		// Keep in-memory usage times across reloads
+		if previous, exists := store.tokens[token.Hash]; exists && previous.LastUsed != nil {
+			token.LastUsed = previous.LastUsed
+		}
+		tokens[token.Hash] = token
+	}
+	store.tokens = tokens
+	return nil
+}
+
+// Write the tokens to a temporary file and rename it into place; the caller holds the lock
+func (store *TokenStore) save() error {
+	list := make([]*APIToken, 0, len(store.tokens))
+	for _, token := range store.tokens {
+		list = append(list, token)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(store.path), ".tokens-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), store.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(store.path); err == nil {
+		store.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Create issues a token for a user; the returned secret is shown only once
+func (store *TokenStore) Create(username, name string, scopes []string, ttl time.Duration) (string, *APIToken, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.reloadIfChanged(); err != nil {
+		return "", nil, err
+	}
+
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", nil, err
+	}
+	secret := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(bytes)
+	hash := hashAPIToken(secret)
+
+	token := &APIToken{
+		ID:        hash[:12],
+		Name:      name,
+		Username:  username,
+		Scopes:    scopes,
+		Hash:      hash,
+		CreatedAt: time.Now(),
+	}
+	if ttl > 0 {
+		expiresAt := token.CreatedAt.Add(ttl)
+		token.ExpiresAt = &expiresAt
+	}
+	store.tokens[hash] = token
+	if err := store.save(); err != nil {
+		delete(store.tokens, hash)
+		return "", nil, fmt.Errorf("saving token file: %v", err)
+	}
+	return secret, token, nil
+}
+
+// Authenticate returns the token a bearer secret belongs to, if it is still valid
+func (store *TokenStore) Authenticate(secret string) (*APIToken, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.reloadIfChanged(); err != nil {
+		log.Printf("⚠️  Keeping previous API tokens, reload failed: %v", err)
+	}
+
+	now := time.Now()
+	token, exists := store.tokens[hashAPIToken(secret)]
+	if !exists || token.Expired(now) {
+		return nil, false
+	}
+	token.LastUsed = &now
+	snapshot := *token
+	return &snapshot, true
+}
+
+// List returns all tokens, oldest first, without their hashes
+func (store *TokenStore) List() ([]APIToken, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+
+	list := make([]APIToken, 0, len(store.tokens))
+	for _, token := range store.tokens {
+		snapshot := *token
+		snapshot.Hash = ""
+		list = append(list, snapshot)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+// Revoke deletes a token by ID
+func (store *TokenStore) Revoke(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.reloadIfChanged(); err != nil {
+		return err
+	}
+
+	for hash, token := range store.tokens {
+		if token.ID == id {
+			delete(store.tokens, hash)
+			return store.save()
+		}
+	}
+	return fmt.Errorf("token %s not found", id)
+}
+
+// serveWithToken authenticates a request by its bearer token and runs the
+// handler as the token's user. Failures get a JSON 401, not a login redirect.
+func (ts *TerminalServer) serveWithToken(w http.ResponseWriter, r *http.Request, secret string, next http.HandlerFunc) {
+	var token *APIToken
+	valid := false
+	if ts.authConfig.Tokens != nil {
+		token, valid = ts.authConfig.Tokens.Authenticate(secret)
+		// Tokens of users removed from the users file stop working
+		valid = valid && ts.authConfig.Users.Exists(token.Username)
+	}
+	if !valid {
+		if ts.verbose {
+			log.Printf("⛔ Rejected API token from %s for %s %s", ts.rateLimiter.getClientIP(r), r.Method, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="snakeflex"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(APIResponse{Success: false, Message: "Invalid or expired API token"})
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), userContextKey, token.Username)
+	ctx = context.WithValue(ctx, tokenContextKey, token)
+	next(w, r.WithContext(ctx))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := parseScopes(" run, files:read ,run,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(scopes, []string{"run", "files:read"}) {
+		t.Errorf("scopes = %q", scopes)
+	}
+	for _, list := range []string{"", " , ", "run,root", "Run"} {
+		if _, err := parseScopes(list); err == nil {
+			t.Errorf("parseScopes(%q) succeeded", list)
+		}
+	}
+}
+
+func TestServeWithToken(t *testing.T) {
+	store, err := LoadTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := &UserStore{users: map[string]*User{"alice": {Username: "alice", Role: "editor"}}}
+	ts := &TerminalServer{authConfig: &AuthConfig{Enabled: true, Users: users, Tokens: store}, rateLimiter: NewRateLimiter(nil)}
+
+	runOnly, _, err := store.Create("alice", "ci", []string{PermRun}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, token, err := store.Create("alice", "old", []string{PermRun}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	store.tokens[token.Hash].ExpiresAt = &past
+	sso, _, err := store.Create("jane", "sso user", []string{PermRun}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		secret      string
+		valid       bool
+		permissions []string
+	}{
+		{"scoped token", runOnly, true, []string{PermRun}},
+		{"unknown token", apiTokenPrefix + "guessed", false, nil},
+		{"expired token", expired, false, nil},
+		{"user not in the users file", sso, false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var permissions []string
+			reached := false
+			w := httptest.NewRecorder()
+			ts.serveWithToken(w, httptest.NewRequest("GET", "/api/files", nil), test.secret, func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+				permissions = ts.permissions(r)
+			})
+			if reached != test.valid {
+				t.Fatalf("handler reached = %t, want %t (status %d)", reached, test.valid, w.Code)
+			}
+			if !test.valid && w.Code != http.StatusUnauthorized {
+				t.Errorf("status %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			if test.valid && !reflect.DeepEqual(permissions, test.permissions) {
+				t.Errorf("permissions = %q, want %q", permissions, test.permissions)
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RFC 6238 parameters understood by every common authenticator app
+const (
+	totpIssuer    = "Snakeflex"
+	totpPeriod    = 30
+	totpDigits    = 6
+	totpSkew      = 1 // accept codes one period either side for clock drift
+	totpSecretLen = 20
+)
+
+const recoveryCodeCount = 10
+
+// How long the code step of a login stays open, and how many codes it accepts
+const (
+	pendingLoginLifetime    = 5 * time.Minute
+	pendingLoginMaxAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the HOTP value (RFC 4226) for one time step
+func totpCode(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// Time step whose code matches, or -1
+func matchTOTP(secret string, code string, now time.Time) int64 {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return -1
+	}
+	current := now.Unix() / totpPeriod
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, counter)), []byte(code)) == 1 {
+			return counter
+		}
+	}
+	return -1
+}
+
+func totpURI(username, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Recovery codes are compared case-insensitively and without separators
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		encoded := hex.EncodeToString(raw)
+		codes[i] = encoded[:5] + "-" + encoded[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// TOTPAccount is one user's enrolled authenticator
+type TOTPAccount struct {
+	Secret        string    `json:"secret"`        // base32
+	RecoveryCodes []string  `json:"recoveryCodes"` // SHA-256 of the unused codes
+	LastCounter   int64     `json:"lastCounter"`   // time step of the last accepted code, against replays
+	EnrolledAt    time.Time `json:"enrolledAt"`
+}
+
+// TOTPStatus is what a user sees about their own two-factor setup
+type TOTPStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+}
+
+// TOTPStore keeps enrolled authenticators in a JSON file. Enrollments that
+// have not been confirmed with a first code only live in memory.
+type TOTPStore struct {
+	path     string
+	accounts map[string]*TOTPAccount
+	pending  map[string]string // username -> secret awaiting confirmation
+	mutex    sync.Mutex
+}
+
+func LoadTOTPStore(path string) (*TOTPStore, error) {
+	st := &TOTPStore{
+		path:     path,
+		accounts: make(map[string]*TOTPAccount),
+		pending:  make(map[string]string),
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return st, nil
+	case err != nil:
+		return nil, fmt.Errorf("reading TOTP file: %v", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &st.accounts); err != nil {
+			return nil, fmt.Errorf("parsing TOTP file %s: %v", path, err)
+		}
+	}
+	return st, nil
+}
+
+// Write the accounts to a temporary file and rename it into place; the caller holds the lock
+func (st *TOTPStore) save() error {
+	data, err := json.MarshalIndent(st.accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(st.path), ".totp-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), st.path)
+}
+
+func (st *TOTPStore) Enabled(username string) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	_, exists := st.accounts[username]
+	return exists
+}
+
+func (st *TOTPStore) Status(username string) TOTPStatus {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	account, exists := st.accounts[username]
+	if !exists {
+		return TOTPStatus{}
+	}
+	return TOTPStatus{Enabled: true, RecoveryCodesLeft: len(account.RecoveryCodes)}
+}
+
+// Begin starts an enrollment, returning the secret and its otpauth:// URI
+func (st *TOTPStore) Begin(username string) (string, string, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if _, exists := st.accounts[username]; exists {
+		return "", "", fmt.Errorf("two-factor authentication is already enabled")
+	}
+	raw := make([]byte, totpSecretLen)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	secret := totpEncoding.EncodeToString(raw)
+	st.pending[username] = secret
+	return secret, totpURI(username, secret), nil
+}
+
+// Confirm activates a pending enrollment once the user proves their app
+// produces valid codes, and returns fresh recovery codes
+func (st *TOTPStore) Confirm(username, code string) ([]string, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	secret, exists := st.pending[username]
+	if !exists {
+		return nil, fmt.Errorf("no enrollment in progress")
+	}
+	counter := matchTOTP(secret, strings.TrimSpace(code), time.Now())
+	if counter < 0 {
+		return nil, fmt.Errorf("invalid code")
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	st.accounts[username] = &TOTPAccount{
+		Secret:        secret,
+		RecoveryCodes: hashes,
+		LastCounter:   counter,
+		EnrolledAt:    time.Now(),
+	}
+	if err := st.save(); err != nil {
+		delete(st.accounts, username)
+		return nil, fmt.Errorf("saving TOTP file: %v", err)
+	}
+	delete(st.pending, username)
+	return codes, nil
+}
+
+// Verify accepts a current authenticator code or an unused recovery code.
+// Each code works once.
+func (st *TOTPStore) Verify(username, code string) (bool, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	account, exists := st.accounts[username]
+	if !exists {
+		return false, nil
+	}
+
+	code = strings.TrimSpace(code)
+	if counter := matchTOTP(account.Secret, strings.ReplaceAll(code, " ", ""), time.Now()); counter >= 0 {
+		if counter <= account.LastCounter {
+			return false, nil
+		}
+		account.LastCounter = counter
+		return true, st.save()
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, candidate := range account.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(hash)) == 1 {
+			account.RecoveryCodes = append(account.RecoveryCodes[:i], account.RecoveryCodes[i+1:]...)
+			return true, st.save()
+		}
+	}
+	return false, nil
+}
+
+// Disable removes a user's authenticator and recovery codes
+func (st *TOTPStore) Disable(username string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	delete(st.pending, username)
+	if _, exists := st.accounts[username]; !exists {
+		return nil
+	}
+	delete(st.accounts, username)
+	return st.save()
+}
+
+// PendingLogin is a user who passed the password step and still owes a code
+type PendingLogin struct {
+	Username string
+	Expiry   time.Time
+	Attempts int
+}
+
+// PendingLogins tracks logins between the password and the code step
+type PendingLogins struct {
+	logins map[string]*PendingLogin
+	mutex  sync.Mutex
+}
+
+func NewPendingLogins() *PendingLogins {
+	pl := &PendingLogins{
+		logins: make(map[string]*PendingLogin),
+	}
+
+	// Clean up abandoned logins every 10 minutes
+	go func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			pl.CleanupExpired()
+		}
+	}()
+
+	return pl
+}
+
+func (pl *PendingLogins) Create(username string) string {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+
+	bytes := make([]byte, 32)
+	rand.Read(bytes)
+	token := base64.URLEncoding.EncodeToString(bytes)
+	pl.logins[token] = &PendingLogin{Username: username, Expiry: time.Now().Add(pendingLoginLifetime)}
+	return token
+}
+
+func (pl *PendingLogins) Get(token string) (string, bool) {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	login, exists := pl.logins[token]
+	if !exists {
+		return "", false
+	}
+	if time.Now().After(login.Expiry) {
+		delete(pl.logins, token)
+		return "", false
+	}
+	return login.Username, true
+}
+
+// Fail counts a wrong code and reports whether the login may still be retried
+func (pl *PendingLogins) Fail(token string) bool {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	login, exists := pl.logins[token]
+	if !exists {
+		return false
+	}
+	login.Attempts++
+	if login.Attempts >= pendingLoginMaxAttempts {
+		delete(pl.logins, token)
+		return false
+	}
+	return true
+}
+
+func (pl *PendingLogins) Delete(token string) {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	delete(pl.logins, token)
+}
+
+func (pl *PendingLogins) CleanupExpired() {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	now := time.Now()
+	for token, login := range pl.logins {
+		if now.After(login.Expiry) {
+			delete(pl.logins, token)
+		}
+	}
+}
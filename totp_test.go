@@ -0,0 +1,178 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238, appendix B, cut to six digits
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		if got := totpCode(secret, test.unix/totpPeriod); got != test.want {
+			t.Errorf("totpCode at %d = %s, want %s", test.unix, got, test.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+	codeAt := func(counter int64) string {
+		return totpCode([]byte("12345678901234567890"), counter)
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		want   int64
+	}{
+		{"current", secret, codeAt(step), step},
+		{"previous", secret, codeAt(step - 1), step - 1},
+		{"next", secret, codeAt(step + 1), step + 1},
+		{"two steps old", secret, codeAt(step - 2), -1},
+		{"two steps ahead", secret, codeAt(step + 2), -1},
+		{"too short", secret, codeAt(step)[1:], -1},
+		{"too long", secret, codeAt(step) + "0", -1},
+		{"empty", secret, "", -1},
+		{"invalid secret", "not base32!", codeAt(step), -1},
+	}
+	for _, test := range tests {
+		if got := matchTOTP(test.secret, test.code, now); got != test.want {
+			t.Errorf("%s: matchTOTP = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	for _, code := range []string{"0a1b2-c3d4e", "0A1B2-C3D4E", "0a1b2c3d4e", "0a1b2 c3d4e", " 0a1b2-c3d4e"} {
+		if got := normalizeRecoveryCode(code); got != "0a1b2c3d4e" {
+			t.Errorf("normalizeRecoveryCode(%q) = %q", code, got)
+		}
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if len(code) != 11 || code[5] != '-' || hashes[i] != hashRecoveryCode(strings.ToUpper(code)) || seen[code] {
+			t.Errorf("recovery code %q with hash %s", code, hashes[i])
+		}
+		seen[code] = true
+	}
+}
+
+func TestTOTPStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "totp.json")
+	store, err := LoadTOTPStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, uri, err := store.Begin("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(uri, "otpauth://totp/Snakeflex:alice?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("enrollment URI %s", uri)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	step := time.Now().Unix() / totpPeriod
+
+	if _, err := store.Confirm("alice", "abcdef"); err == nil || store.Enabled("alice") {
+		t.Fatal("confirmed with an invalid code")
+	}
+	recovery, err := store.Confirm("alice", " "+totpCode(key, step)+" ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery) != recoveryCodeCount || !store.Enabled("alice") {
+		t.Fatalf("confirmed with %d recovery codes, enabled %t", len(recovery), store.Enabled("alice"))
+	}
+	if _, _, err := store.Begin("alice"); err == nil {
+		t.Error("enrolled twice")
+	}
+
+	steps := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"code used to confirm", totpCode(key, step), false},
+		{"older code", totpCode(key, step-1), false},
+		{"next code", totpCode(key, step+1), true},
+		{"next code again", totpCode(key, step+1), false},
+		{"recovery code", strings.ToUpper(recovery[0]), true},
+		{"recovery code again", recovery[0], false},
+		{"another recovery code without the dash", strings.ReplaceAll(recovery[1], "-", ""), true},
+		{"made-up recovery code", "00000-00000", false},
+		{"empty", "", false},
+	}
+	for _, step := range steps {
+		ok, err := store.Verify("alice", step.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != step.want {
+			t.Errorf("%s: Verify = %t, want %t", step.name, ok, step.want)
+		}
+	}
+	if ok, _ := store.Verify("bob", totpCode(key, step+1)); ok {
+		t.Error("verified a user who never enrolled")
+	}
+
+	// Used codes stay used after a restart
+	reloaded, err := LoadTOTPStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := reloaded.Status("alice"); !status.Enabled || status.RecoveryCodesLeft != recoveryCodeCount-2 {
+		t.Errorf("status after reloading = %+v", status)
+	}
+	if ok, _ := reloaded.Verify("alice", totpCode(key, step+1)); ok {
+		t.Error("replayed a code after reloading")
+	}
+	if err := reloaded.Disable("alice"); err != nil || reloaded.Enabled("alice") {
+		t.Errorf("Disable: %v, still enabled %t", err, reloaded.Enabled("alice"))
+	}
+}
+
+func TestPendingLoginAttempts(t *testing.T) {
+	pl := &PendingLogins{logins: make(map[string]*PendingLogin)}
+	token := pl.Create("alice")
+	if username, ok := pl.Get(token); !ok || username != "alice" {
+		t.Fatalf("Get = %q, %t", username, ok)
+	}
+	for i := 1; i < pendingLoginMaxAttempts; i++ {
+		if !pl.Fail(token) {
+			t.Fatalf("refused after %d wrong codes", i)
+		}
+	}
+	if pl.Fail(token) {
+		t.Errorf("still open after %d wrong codes", pendingLoginMaxAttempts)
+	}
+	if _, ok := pl.Get(token); ok {
+		t.Error("login still pending after too many wrong codes")
+	}
+
+	expired := pl.Create("bob")
+	pl.logins[expired].Expiry = time.Now().Add(-time.Second)
+	if _, ok := pl.Get(expired); ok {
+		t.Error("expired login still pending")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Username used when authentication is configured with a single --pass
+const defaultUsername = "admin"
+
+// Usernames double as identities in logs and sharing, so keep them plain
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// User is one account from the users file
+type User struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"passwordHash"` // argon2id or bcrypt hash (hex SHA-256 still accepted)
+	Role         string `json:"role,omitempty"`
+}
+
+// UserStore holds the accounts allowed to sign in. It is loaded from a JSON
+// file and can be reloaded while the server is running.
+type UserStore struct {
+	path  string
+	users map[string]*User
+	mutex sync.RWMutex
+}
+
+// LoadUserStore reads a users file of the form [{"username": ..., "passwordHash": ..., "role": ...}]
+func LoadUserStore(path string) (*UserStore, error) {
+	us := &UserStore{path: path}
+	if err := us.Reload(); err != nil {
+		return nil, err
+	}
+	return us, nil
+}
+
+// NewSingleUserStore keeps the original single-password mode working as one "admin" account
+func NewSingleUserStore(passwordHash string) (*UserStore, error) {
+	passwordHash, err := normalizePasswordHash(passwordHash)
+	if err != nil {
+		return nil, err
+	}
+	return &UserStore{
+		users: map[string]*User{
+			defaultUsername: {Username: defaultUsername, PasswordHash: passwordHash, Role: "admin"},
+		},
+	}, nil
+}
+
+// Reload re-reads the users file; on error the current accounts are kept
+func (us *UserStore) Reload() error {
+	if us.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(us.path)
+	if err != nil {
+		return fmt.Errorf("reading users file: %v", err)
+	}
+
+	var list []*User
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("parsing users file: %v", err)
+	}
+
+	users := make(map[string]*User)
+	for _, user := range list {
+		if !validUsername.MatchString(user.Username) {
+			return fmt.Errorf("invalid username %q in users file", user.Username)
+		}
+		if user.PasswordHash == "" {
+			return fmt.Errorf("user %q has no passwordHash", user.Username)
+		}
+		if user.PasswordHash, err = normalizePasswordHash(user.PasswordHash); err != nil {
+			return fmt.Errorf("user %q: %v", user.Username, err)
+		}
+		if user.Role == "" {
+			user.Role = defaultRole
+		}
+		if !validRole(user.Role) {
+			return fmt.Errorf("user %q has unknown role %q (expected one of %s)", user.Username, user.Role, strings.Join(roleNames(), ", "))
+		}
+		if _, exists := users[user.Username]; exists {
+			return fmt.Errorf("duplicate username %q in users file", user.Username)
+		}
+		users[user.Username] = user
+	}
+	if len(users) == 0 {
+		return fmt.Errorf("users file %s defines no users", us.path)
+	}
+
+	us.mutex.Lock()
+	us.users = users
+	us.mutex.Unlock()
+	return nil
+}
+
+// Authenticate checks a username and password, returning the matching user
+func (us *UserStore) Authenticate(username, password string) (*User, bool) {
+	us.mutex.RLock()
+	user, exists := us.users[username]
+	us.mutex.RUnlock()
+
+	if !exists {
+		// Still pay for a hash so unknown usernames are not faster to reject
+		burnPasswordCheck(password)
+		return nil, false
+	}
+	if !verifyPassword(user.PasswordHash, password) {
+		return nil, false
+	}
+	return user, true
+}
+
+// Exists reports whether an account is still present, so that sessions of
+// users removed from the file stop working after a reload
+func (us *UserStore) Exists(username string) bool {
+	us.mutex.RLock()
+	defer us.mutex.RUnlock()
+	_, exists := us.users[username]
+	return exists
+}
+
+// Role of an account, or "" if it does not exist
+func (us *UserStore) Role(username string) string {
+	us.mutex.RLock()
+	defer us.mutex.RUnlock()
+	if user, exists := us.users[username]; exists {
+		return user.Role
+	}
+	return ""
+}
+
+func (us *UserStore) Usernames() []string {
+	us.mutex.RLock()
+	defer us.mutex.RUnlock()
+	names := make([]string, 0, len(us.users))
+	for name := range us.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}